@@ -3,6 +3,7 @@ package api
 import (
 	"context"
 
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	ctrl "sigs.k8s.io/controller-runtime"
 )
@@ -26,12 +27,93 @@ type PluginConfig struct {
 	BootOrder int         `json:"bootOrder"`
 }
 
+// DefaultAdminAddress is where /metrics is served unless adminAddress is set
+const DefaultAdminAddress = ":8080"
+
 // SidecarConfig ...
 type SidecarConfig struct {
-	Plugins           []PluginConfig    `json:"plugins"`           // plugins and  configurations
-	RestartPolicy     string            `json:"restartPolicy"`     // Restart policy
-	Resources         map[string]string `json:"resources"`         // The resources required by Sidecar
-	SidecarStartOrder string            `json:"sidecarStartOrder"` // The startup sequence of Sidecar, is it after or before the main container
+	Plugins            []PluginConfig     `json:"plugins"`                      // plugins and  configurations
+	RestartPolicy      string             `json:"restartPolicy"`                // Restart policy
+	Resources          map[string]string  `json:"resources"`                    // The resources required by Sidecar
+	SidecarStartOrder  string             `json:"sidecarStartOrder"`            // The startup sequence of Sidecar, is it after or before the main container
+	WriteQueue         *WriteQueueConfig  `json:"writeQueue,omitempty"`         // Durable queue of storage writes that failed against the API server
+	KubeWriteLimit     *KubeWriteLimit    `json:"kubeWriteLimit,omitempty"`     // Client side rate limit and batching of writes to the API server
+	AdminAddress       string             `json:"adminAddress,omitempty"`       // Address of the admin server serving /healthz and /metrics, default is :8080, "0" disables it
+	HealthProbeAddress string             `json:"healthProbeAddress,omitempty"` // Address of the health probes /healthz and /readyz of the manager, empty means disabled
+	Telemetry          *TelemetryConfig   `json:"telemetry,omitempty"`          // Export traces of the sidecar operations
+	Persistence        *PersistenceConfig `json:"persistence,omitempty"`        // Location and retention of the persisted plugin results
+	Standalone         *StandaloneConfig  `json:"standalone,omitempty"`         // Run without a Kubernetes API server
+	DownwardAPIPath    string             `json:"downwardAPIPath,omitempty"`    // Mount path of the downward API volume with the name, namespace, labels and annotations of the pod, default is /etc/podinfo
+}
+
+// GetAdminAddress returns the address of the admin server, "0" means it is disabled
+func (s *SidecarConfig) GetAdminAddress() string {
+	if s == nil || s.AdminAddress == "" {
+		return DefaultAdminAddress
+	}
+	return s.AdminAddress
+}
+
+// StandaloneConfig describes the pod the sidecar pretends to run in, for running next to a game server outside Kubernetes
+type StandaloneConfig struct {
+	PodName      string            `json:"podName,omitempty"`      // default is --pod-name, POD_NAME or the hostname
+	PodNamespace string            `json:"podNamespace,omitempty"` // default is --pod-namespace, POD_NAMESPACE or default
+	Labels       map[string]string `json:"labels,omitempty"`       // Labels of the pod, used by templates
+	Annotations  map[string]string `json:"annotations,omitempty"`  // Annotations of the pod, used by templates
+}
+
+// OTLPConfig is the connection to an OpenTelemetry collector
+type OTLPConfig struct {
+	Endpoint string            `json:"endpoint"`           // host:port of the collector
+	Protocol string            `json:"protocol,omitempty"` // grpc or http, default is grpc
+	Insecure bool              `json:"insecure,omitempty"` // Disable TLS
+	Headers  map[string]string `json:"headers,omitempty"`
+}
+
+// TelemetryConfig ...
+type TelemetryConfig struct {
+	OTLP        OTLPConfig `json:"otlp"`
+	ServiceName string     `json:"serviceName,omitempty"` // default is kidecar
+}
+
+// KubeWriteLimit ...
+type KubeWriteLimit struct {
+	QPS                     float32 `json:"qps"`                     // Token bucket refill rate, 0 means unlimited
+	Burst                   int     `json:"burst"`                   // Token bucket size
+	BatchWindowMilliseconds int     `json:"batchWindowMilliseconds"` // Patches to the same object within the window are merged into one request
+}
+
+const (
+	PersistenceBackendConfigMap     = "ConfigMap"
+	PersistenceBackendSidecarResult = "SidecarResult"
+	PersistenceBackendFile          = "File"
+
+	// DefaultPersistencePath is the file of the File backend
+	DefaultPersistencePath = "/var/lib/kidecar/sidecar-result.yaml"
+)
+
+// PersistenceConfig ...
+type PersistenceConfig struct {
+	Backend       string               `json:"backend,omitempty"`       // ConfigMap, SidecarResult or File, default is ConfigMap, standalone sidecars always use File
+	Path          string               `json:"path,omitempty"`          // File of the File backend, default is /var/lib/kidecar/sidecar-result.yaml
+	ConfigMapName string               `json:"configMapName,omitempty"` // Name prefix of the result ConfigMaps, default is sidecar-result
+	Namespace     string               `json:"namespace,omitempty"`     // Namespace of the result ConfigMaps, default is the namespace of the pod
+	Shards        int                  `json:"shards,omitempty"`        // Number of ConfigMaps per GameServerSet the pods are spread over by hash, default is 1
+	MaxVersions   int                  `json:"maxVersions,omitempty"`   // Versions kept per pod and result type, 0 means unlimited
+	GC            *PersistenceGCConfig `json:"gc,omitempty"`            // Pruning of the results of deleted pods, run by the sidecar holding the lease
+}
+
+// PersistenceGCConfig ...
+type PersistenceGCConfig struct {
+	IntervalSeconds int    `json:"intervalSeconds,omitempty"` // Interval between two collections, default is 600
+	TTLSeconds      int    `json:"ttlSeconds,omitempty"`      // Results of a deleted pod not updated within the ttl are pruned even if its GameServer exists, 0 means never
+	LeaseName       string `json:"leaseName,omitempty"`       // Lease electing the collecting sidecar, default is <configMapName>-gc
+}
+
+// WriteQueueConfig ...
+type WriteQueueConfig struct {
+	Dir               string `json:"dir"`               // Directory holding pending writes, usually an emptyDir volume
+	MaxBackoffSeconds int    `json:"maxBackoffSeconds"` // Upper bound of the replay backoff
 }
 
 // PluginStatus =
@@ -54,12 +136,17 @@ type Sidecar interface {
 	Stop(ctx context.Context) error
 	SetupWithManager(mgr SidecarManager) error
 	LoadConfig(path string) error
+	// GetSidecarConfig returns the config loaded by LoadConfig
+	GetSidecarConfig() *SidecarConfig
+	// IsStandalone returns true if the sidecar runs without a Kubernetes API server
+	IsStandalone() bool
 }
 
 type SidecarManager interface {
 	ctrl.Manager
 	DBManager
 	kubernetes.Interface
+	dynamic.Interface
 }
 
 type DBManager interface {
@@ -0,0 +1,97 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SidecarResultSpec defines the GameServerSet the results belong to
+type SidecarResultSpec struct {
+	// GameServerSet is the name of the GameServerSet, empty for pods not managed by one
+	// +optional
+	GameServerSet string `json:"gameServerSet,omitempty"`
+}
+
+// ResultVersion is a version of a result type, e.g. a hot update file
+type ResultVersion struct {
+	// Type is the result type, e.g. hot_update
+	Type    string `json:"type"`
+	Version string `json:"version"`
+	URL     string `json:"url"`
+	// Checksum is the sha256 of the file of the version
+	// +optional
+	Checksum  string      `json:"checksum,omitempty"`
+	CreatedAt metav1.Time `json:"createdAt"`
+}
+
+// PodResult is the versions of a result type applied by a pod
+type PodResult struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Type      string `json:"type"`
+	// Versions applied by the pod, the last one is the current version
+	Versions  []string    `json:"versions"`
+	UpdatedAt metav1.Time `json:"updatedAt"`
+}
+
+// SidecarResultStatus defines the observed results of the pods
+type SidecarResultStatus struct {
+	// +optional
+	Versions []ResultVersion `json:"versions,omitempty"`
+	// +optional
+	Pods []PodResult `json:"pods,omitempty"`
+	// LatestVersion is the latest hot update version of the GameServerSet
+	// +optional
+	LatestVersion string `json:"latestVersion,omitempty"`
+	// UpdatedPods is the number of pods whose current hot update version is the latest
+	// +optional
+	UpdatedPods int32 `json:"updatedPods,omitempty"`
+	// TotalPods is the number of pods with a hot update result
+	// +optional
+	TotalPods int32 `json:"totalPods,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:shortName=sr
+// +kubebuilder:printcolumn:name="Latest",type=string,JSONPath=`.status.latestVersion`
+// +kubebuilder:printcolumn:name="Updated",type=integer,JSONPath=`.status.updatedPods`
+// +kubebuilder:printcolumn:name="Pods",type=integer,JSONPath=`.status.totalPods`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// SidecarResult is the Schema for the persisted sidecar results of a GameServerSet
+type SidecarResult struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SidecarResultSpec   `json:"spec,omitempty"`
+	Status SidecarResultStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// SidecarResultList contains a list of SidecarResult
+type SidecarResultList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []SidecarResult `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&SidecarResult{}, &SidecarResultList{})
+}
@@ -19,6 +19,7 @@ import (
 	"context"
 	"os"
 
+	"github.com/magicsong/kidecar/api"
 	"github.com/magicsong/kidecar/pkg/assembler"
 	"github.com/magicsong/kidecar/pkg/info"
 	"github.com/magicsong/kidecar/pkg/manager"
@@ -27,10 +28,16 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 )
 
-var configPath string
+var (
+	configPath   string
+	podName      string
+	podNamespace string
+)
 
 func init() {
 	flag.StringVar(&configPath, "config", "/opt/kidecar/config.yaml", "config file path")
+	flag.StringVar(&podName, "pod-name", "", "name of the pod, overrides POD_NAME")
+	flag.StringVar(&podNamespace, "pod-namespace", "", "namespace of the pod, overrides POD_NAMESPACE")
 }
 
 func main() {
@@ -42,18 +49,37 @@ func main() {
 		log.Error(err, "failed to load config")
 		os.Exit(1)
 	}
-	mgr, err := manager.NewManager()
-	if err != nil {
-		log.Error(err, "failed to create manager")
+	info.SetPodIdentity(podNamespace, podName)
+	if path := sidecar.GetSidecarConfig().DownwardAPIPath; path != "" {
+		info.SetDownwardAPIPath(path)
+	}
+	ctx := context.TODO()
+	var mgr api.SidecarManager
+	if sidecar.IsStandalone() {
+		mgr = manager.NewStandaloneManager()
+	} else {
+		var err error
+		mgr, err = manager.NewManager(sidecar.GetSidecarConfig())
+		if err != nil {
+			log.Error(err, "failed to create manager")
+			panic(err)
+		}
+		info.SetGlobalKubeInterface(mgr)
+		info.SetGlobalDynamicInterface(mgr)
+		// the pod and the GameServer are served from the cache of the manager once it is started
+		if err := info.UseCache(ctx, mgr.GetCache()); err != nil {
+			log.Error(err, "failed to watch the current pod")
+			panic(err)
+		}
+		go info.WatchDownwardAPI(ctx)
+	}
+	if err := sidecar.SetupWithManager(mgr); err != nil {
 		panic(err)
 	}
-	info.SetGlobalKubeInterface(mgr)
-	sidecar.SetupWithManager(mgr)
 	// add plugins
 	if err := sidecar.InitPlugins(); err != nil {
 		panic(err)
 	}
-	ctx := context.TODO()
 	if err := sidecar.Start(ctx); err != nil {
 		panic(err)
 	}
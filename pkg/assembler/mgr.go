@@ -18,6 +18,7 @@ package assembler
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -27,20 +28,26 @@ import (
 
 	"github.com/go-logr/logr"
 	"github.com/magicsong/kidecar/api"
+	"github.com/magicsong/kidecar/pkg/info"
 	"github.com/magicsong/kidecar/pkg/plugins"
+	"github.com/magicsong/kidecar/pkg/store"
+	"github.com/magicsong/kidecar/pkg/telemetry"
 	"github.com/magicsong/kidecar/pkg/utils"
 	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 )
 
 var _ api.Sidecar = &sidecar{}
 
 type sidecar struct {
-	plugins          map[string]api.Plugin
-	lock             sync.RWMutex
-	isStartWebServer bool
-	version          string
-	pluginStatuses   map[string]*api.PluginStatus
+	plugins        map[string]api.Plugin
+	lock           sync.RWMutex
+	version        string
+	pluginStatuses map[string]*api.PluginStatus
+	writeQueue     *store.WriteQueue
+	writeScheduler *store.WriteScheduler
 	*api.SidecarConfig
 	api.SidecarManager
 	log logr.Logger
@@ -61,16 +68,57 @@ func loadConfig(configPath string) (*api.SidecarConfig, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
+	raw := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal sidecarConfig file: %w", err)
+	}
+	// decode through json, so the keys match the json tags like adminAddress case insensitively
+	jsonData, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert sidecarConfig to json: %w", err)
+	}
 	sidecarConfig := &api.SidecarConfig{}
-	if err := yaml.Unmarshal(data, &sidecarConfig); err != nil {
+	if err := json.Unmarshal(jsonData, sidecarConfig); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal sidecarConfig file: %w", err)
 	}
 	return sidecarConfig, nil
 }
 
+// GetSidecarConfig implements api.Sidecar.
+func (s *sidecar) GetSidecarConfig() *api.SidecarConfig {
+	return s.SidecarConfig
+}
+
 // SetupWithManager implements api.Sidecar.
 func (s *sidecar) SetupWithManager(mgr api.SidecarManager) error {
 	s.SidecarManager = mgr
+	if s.IsStandalone() {
+		return nil
+	}
+	if err := mgr.AddReadyzCheck("plugins", s.pluginsReady); err != nil {
+		return fmt.Errorf("failed to add readyz check: %w", err)
+	}
+	return nil
+}
+
+// pluginsReady fails until all plugins are running
+func (s *sidecar) pluginsReady(_ *http.Request) error {
+	s.lock.RLock()
+	names := make([]string, 0, len(s.plugins))
+	for name := range s.plugins {
+		names = append(names, name)
+	}
+	s.lock.RUnlock()
+	for _, name := range names {
+		// ask the plugin, the polled status may be stale
+		status, err := s.updatePluginStatus(name)
+		if err != nil {
+			return err
+		}
+		if !status.Running {
+			return fmt.Errorf("plugin %s is %s", name, status.Health)
+		}
+	}
 	return nil
 }
 
@@ -82,7 +130,40 @@ func NewSidecar() api.Sidecar {
 	}
 }
 
+// IsStandalone implements api.Sidecar.
+func (s *sidecar) IsStandalone() bool {
+	return s.SidecarConfig != nil && s.SidecarConfig.Standalone != nil
+}
+
 func (s *sidecar) InitPlugins() error {
+	if s.IsStandalone() {
+		pod, err := standalonePod(s.SidecarConfig.Standalone)
+		if err != nil {
+			return err
+		}
+		info.SetStandalonePod(pod)
+		// there is no result ConfigMap without an API server
+		if s.SidecarConfig.Persistence == nil {
+			s.SidecarConfig.Persistence = &api.PersistenceConfig{}
+		}
+		s.SidecarConfig.Persistence.Backend = api.PersistenceBackendFile
+		s.SidecarConfig.Persistence.GC = nil
+		s.SidecarConfig.KubeWriteLimit = nil
+		s.log.Info("run in standalone mode", "pod", pod.Namespace+"/"+pod.Name)
+	}
+	if s.SidecarConfig.WriteQueue != nil {
+		queue, err := store.NewWriteQueue(s.SidecarConfig.WriteQueue)
+		if err != nil {
+			return fmt.Errorf("failed to create write queue: %w", err)
+		}
+		s.writeQueue = queue
+		store.SetGlobalWriteQueue(queue)
+	}
+	store.SetGlobalPersistence(s.SidecarConfig.Persistence)
+	if s.SidecarConfig.KubeWriteLimit != nil {
+		s.writeScheduler = store.NewWriteScheduler(s.SidecarManager, s.SidecarConfig.KubeWriteLimit)
+		store.SetGlobalWriteScheduler(s.writeScheduler)
+	}
 	for _, p := range s.SidecarConfig.Plugins {
 		if err := s.AddPlugin(p.Name, p.Config); err != nil {
 			return fmt.Errorf("failed to add built in plugin %s,err:%w", p.Name, err)
@@ -91,6 +172,37 @@ func (s *sidecar) InitPlugins() error {
 	return nil
 }
 
+// standalonePod builds the pod the sidecar pretends to run in from the config, the flags, the env or the hostname
+func standalonePod(config *api.StandaloneConfig) (*corev1.Pod, error) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        config.PodName,
+			Namespace:   config.PodNamespace,
+			Labels:      config.Labels,
+			Annotations: config.Annotations,
+		},
+	}
+	if nsName, err := info.GetCurrentPodNamespaceAndName(); err == nil {
+		if pod.Name == "" {
+			pod.Name = nsName.Name
+		}
+		if pod.Namespace == "" {
+			pod.Namespace = nsName.Namespace
+		}
+	}
+	if pod.Name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get hostname: %w", err)
+		}
+		pod.Name = hostname
+	}
+	if pod.Namespace == "" {
+		pod.Namespace = metav1.NamespaceDefault
+	}
+	return pod, nil
+}
+
 // AddPlugin implements api.Sidecar.
 func (s *sidecar) AddPlugin(name string, config interface{}) error {
 	//lock and add
@@ -175,30 +287,102 @@ func (s *sidecar) RemovePlugin(pluginName string) error {
 func (s *sidecar) Start(ctx context.Context) error {
 	// start all plugins
 	s.log.Info("start sidecar")
+	if s.SidecarConfig.Telemetry != nil {
+		shutdown, err := telemetry.Setup(ctx, s.SidecarConfig.Telemetry)
+		if err != nil {
+			return fmt.Errorf("failed to setup telemetry: %w", err)
+		}
+		defer shutdown(context.Background())
+	}
+	defer func() {
+		if err := store.ShutdownOTLPExporters(context.Background()); err != nil {
+			s.log.Error(err, "failed to shutdown otlp exporters")
+		}
+	}()
+	if s.writeScheduler != nil {
+		defer s.writeScheduler.Stop()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	errorCh := make(chan error)
-	s.startAllPlugins(ctx, errorCh)
+	if s.IsStandalone() {
+		if s.writeQueue != nil {
+			go s.writeQueue.Run(ctx, store.NewStorageFactory(s.SidecarManager))
+		}
+		s.startAllPlugins(ctx, errorCh)
+		if address := s.SidecarConfig.GetAdminAddress(); address != "0" {
+			// start server
+			go s.startServer(address)
+		}
+	} else {
+		if err := s.addRunnables(errorCh); err != nil {
+			return err
+		}
+		// the manager starts its cache, then the runnables, and serves the metrics and health probes
+		go func() {
+			if err := s.SidecarManager.Start(ctx); err != nil {
+				errorCh <- fmt.Errorf("failed to run manager: %w", err)
+			}
+		}()
+	}
 	for _, plugin := range s.plugins {
 		s.pollPluginStatus(plugin.Name(), time.Second*30)
 		time.Sleep(time.Second)
 	}
-	if s.isStartWebServer {
-		// start server
-		go s.startServer()
-	}
 	s.log.Info("sidecar started successfully")
 	// wait for error
-	err := <-errorCh
-	s.log.Error(err, "plugin error")
-	return err
+	select {
+	case err := <-errorCh:
+		s.log.Error(err, "plugin error")
+		return err
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// addRunnables registers the plugins, the write queue and the persistent gc to the manager
+func (s *sidecar) addRunnables(errorCh chan<- error) error {
+	if s.writeQueue != nil {
+		factory := store.NewStorageFactory(s.SidecarManager)
+		if err := s.Add(backgroundRunnable(func(ctx context.Context) error {
+			s.writeQueue.Run(ctx, factory)
+			return nil
+		})); err != nil {
+			return fmt.Errorf("failed to add write queue: %w", err)
+		}
+	}
+	if s.SidecarConfig.Persistence != nil && s.SidecarConfig.Persistence.GC != nil {
+		gc := store.NewPersistentGC(s.SidecarManager, s.SidecarManager, s.SidecarConfig.Persistence)
+		if err := s.Add(backgroundRunnable(func(ctx context.Context) error {
+			if err := gc.Run(ctx); err != nil {
+				s.log.Error(err, "failed to run persistent gc")
+			}
+			return nil
+		})); err != nil {
+			return fmt.Errorf("failed to add persistent gc: %w", err)
+		}
+	}
+	for _, plugin := range s.plugins {
+		if s.isPluginRunning(plugin.Name()) {
+			continue
+		}
+		if err := s.Add(&pluginRunnable{plugin: plugin, errorCh: errorCh, log: s.log}); err != nil {
+			return fmt.Errorf("failed to add plugin %s: %w", plugin.Name(), err)
+		}
+	}
+	return nil
 }
 
-func (s *sidecar) startServer() {
+func (s *sidecar) startServer(address string) {
 	// start server
-	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	mux.Handle("/metrics", store.MetricsHandler())
+	s.log.Info("start admin server", "address", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
 		log.Fatalf("start web server failed: %v", err)
 	}
 }
@@ -0,0 +1,59 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package assembler
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := `
+plugins:
+  - name: http_probe
+    config:
+      startDelaySeconds: 10
+sidecarstartorder: Before
+adminAddress: ":9091"
+downwardAPIPath: /etc/podinfo
+standalone:
+  podName: game-0
+persistence:
+  backend: File
+`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	if config.SidecarStartOrder != "Before" || config.AdminAddress != ":9091" || config.DownwardAPIPath != "/etc/podinfo" {
+		t.Errorf("Unexpected config: %+v", config)
+	}
+	if config.Standalone == nil || config.Standalone.PodName != "game-0" {
+		t.Errorf("Unexpected standalone config: %+v", config.Standalone)
+	}
+	if config.Persistence == nil || config.Persistence.Backend != "File" {
+		t.Errorf("Unexpected persistence config: %+v", config.Persistence)
+	}
+	if len(config.Plugins) != 1 || config.Plugins[0].Config.(map[string]interface{})["startDelaySeconds"] != float64(10) {
+		t.Errorf("Unexpected plugins: %+v", config.Plugins)
+	}
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package assembler
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	"github.com/magicsong/kidecar/api"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+var (
+	_ manager.Runnable               = &pluginRunnable{}
+	_ manager.LeaderElectionRunnable = &pluginRunnable{}
+	_ manager.LeaderElectionRunnable = backgroundRunnable(nil)
+)
+
+// pluginRunnable runs a plugin as a runnable of the manager, it is started once the cache of the manager synced
+type pluginRunnable struct {
+	plugin  api.Plugin
+	errorCh chan<- error
+	log     logr.Logger
+}
+
+// Start implements manager.Runnable.
+func (r *pluginRunnable) Start(ctx context.Context) error {
+	r.log.Info("start plugin", "plugin", r.plugin.Name())
+	r.plugin.Start(ctx, r.errorCh)
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, every sidecar runs its plugins.
+func (r *pluginRunnable) NeedLeaderElection() bool {
+	return false
+}
+
+// backgroundRunnable runs a function of the sidecar as a runnable of the manager
+type backgroundRunnable func(ctx context.Context) error
+
+// Start implements manager.Runnable.
+func (r backgroundRunnable) Start(ctx context.Context) error {
+	return r(ctx)
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable.
+func (r backgroundRunnable) NeedLeaderElection() bool {
+	return false
+}
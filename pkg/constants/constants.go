@@ -17,12 +17,17 @@ limitations under the License.
 package constants
 
 const (
-	SidecarResultConfigMapName      = "sidecar-result"
-	SidecarResultConfigMapNamespace = "kube-system"
+	SidecarResultConfigMapName = "sidecar-result"
+	// SidecarResultLabelKey marks the result ConfigMaps, the value is the configured name
+	SidecarResultLabelKey = "kidecar.io/sidecar-result"
+	// GameServerSetLabelKey is set by OpenKruiseGame on the pods of a GameServerSet
+	GameServerSetLabelKey = "game.kruise.io/owner-gss"
 
 	SidecarResultType = "hot_update"
 
 	GameServersGroup    = "game.kruise.io"
 	GameServersVersion  = "v1alpha1"
 	GameServersResource = "gameservers"
+	// GameServerSetsResource is in the group and version of GameServers
+	GameServerSetsResource = "gameserversets"
 )
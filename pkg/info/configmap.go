@@ -20,9 +20,16 @@ import (
 	"context"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
 )
 
 func GetConfigmap(ctx context.Context, name, nemaspace string) (*corev1.ConfigMap, error) {
+	if standalonePod != nil {
+		return nil, ErrStandalone
+	}
 	cm, err := globalKubeInterface.CoreV1().ConfigMaps(nemaspace).Get(ctx, name, metav1.GetOptions{})
 	if err != nil {
 		return nil, err
@@ -37,3 +44,26 @@ func UpdateConfigmap(ctx context.Context, cm *corev1.ConfigMap) (*corev1.ConfigM
 	}
 	return cm, nil
 }
+
+func WatchConfigmap(ctx context.Context, name, namespace string) (watch.Interface, error) {
+	return globalKubeInterface.CoreV1().ConfigMaps(namespace).Watch(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", name).String(),
+	})
+}
+
+func CreateConfigmap(ctx context.Context, cm *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	return globalKubeInterface.CoreV1().ConfigMaps(cm.Namespace).Create(ctx, cm, metav1.CreateOptions{})
+}
+
+func ListConfigmaps(ctx context.Context, namespace string, selector labels.Selector) ([]corev1.ConfigMap, error) {
+	list, err := globalKubeInterface.CoreV1().ConfigMaps(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// PatchConfigmap applies a json merge patch, keys of data not in the patch are kept
+func PatchConfigmap(ctx context.Context, name, namespace string, patch []byte) (*corev1.ConfigMap, error) {
+	return globalKubeInterface.CoreV1().ConfigMaps(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package info
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DefaultDownwardAPIPath is the usual mount path of the downward API volume of the sidecar
+const DefaultDownwardAPIPath = "/etc/podinfo"
+
+// files of the downward API volume, each item of the volume has the name of the field
+const (
+	downwardNameFile        = "name"
+	downwardNamespaceFile   = "namespace"
+	downwardLabelsFile      = "labels"
+	downwardAnnotationsFile = "annotations"
+)
+
+var downwardAPIPath = DefaultDownwardAPIPath
+
+// downwardAPIWatchInterval is how often WatchDownwardAPI reads the files, the kubelet updates them within a minute
+var downwardAPIWatchInterval = 5 * time.Second
+
+// SetDownwardAPIPath sets the directory of the downward API volume, empty disables it
+func SetDownwardAPIPath(path string) {
+	downwardAPIPath = path
+}
+
+// downwardPod is the metadata of the pod in the downward API volume, the fields are nil if their files do not exist
+type downwardPod struct {
+	name        *string
+	namespace   *string
+	labels      map[string]string
+	annotations map[string]string
+}
+
+func (p *downwardPod) empty() bool {
+	return p.name == nil && p.namespace == nil && p.labels == nil && p.annotations == nil
+}
+
+// readDownwardAPI reads the files of the volume, missing files are skipped
+func readDownwardAPI() (*downwardPod, error) {
+	pod := &downwardPod{}
+	if downwardAPIPath == "" {
+		return pod, nil
+	}
+	var err error
+	if pod.name, err = readDownwardValue(downwardNameFile); err != nil {
+		return nil, err
+	}
+	if pod.namespace, err = readDownwardValue(downwardNamespaceFile); err != nil {
+		return nil, err
+	}
+	if pod.labels, err = readDownwardMap(downwardLabelsFile); err != nil {
+		return nil, err
+	}
+	if pod.annotations, err = readDownwardMap(downwardAnnotationsFile); err != nil {
+		return nil, err
+	}
+	return pod, nil
+}
+
+func readDownwardFile(name string) ([]byte, bool, error) {
+	data, err := os.ReadFile(filepath.Join(downwardAPIPath, name))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read downward api file %s: %w", name, err)
+	}
+	return data, true, nil
+}
+
+func readDownwardValue(name string) (*string, error) {
+	data, ok, err := readDownwardFile(name)
+	if err != nil || !ok {
+		return nil, err
+	}
+	value := strings.TrimSpace(string(data))
+	return &value, nil
+}
+
+// readDownwardMap parses the key="value" lines of the labels and annotations files, the values are quoted like go strings
+func readDownwardMap(name string) (map[string]string, error) {
+	data, ok, err := readDownwardFile(name)
+	if err != nil || !ok {
+		return nil, err
+	}
+	result := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		key, quoted, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid line %q in downward api file %s", line, name)
+		}
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of %s in downward api file %s: %w", key, name, err)
+		}
+		result[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read downward api file %s: %w", name, err)
+	}
+	return result, nil
+}
+
+// GetCurrentPodLabels returns the labels of the current pod from the downward API volume, or from the pod if the volume has no labels
+func GetCurrentPodLabels() (map[string]string, error) {
+	return currentPodMeta(func(pod *downwardPod) map[string]string { return pod.labels },
+		func(pod *corev1.Pod) map[string]string { return pod.Labels })
+}
+
+// GetCurrentPodAnnotations returns the annotations of the current pod from the downward API volume, or from the pod if the volume has no annotations
+func GetCurrentPodAnnotations() (map[string]string, error) {
+	return currentPodMeta(func(pod *downwardPod) map[string]string { return pod.annotations },
+		func(pod *corev1.Pod) map[string]string { return pod.Annotations })
+}
+
+func currentPodMeta(fromFile func(pod *downwardPod) map[string]string, fromPod func(pod *corev1.Pod) map[string]string) (map[string]string, error) {
+	if standalonePod == nil {
+		downward, err := readDownwardAPI()
+		if err != nil {
+			return nil, err
+		}
+		if meta := fromFile(downward); meta != nil {
+			return meta, nil
+		}
+	}
+	pod, err := GetCurrentPod()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current pod: %w", err)
+	}
+	return fromPod(pod), nil
+}
+
+// WatchDownwardAPI reads the downward API volume periodically until the context is done, the subscribers of OnPodChange
+// are notified when the labels or annotations in the volume changed. Without a pod informer the notified pod only has the metadata of the volume.
+func WatchDownwardAPI(ctx context.Context) {
+	last, _ := readDownwardAPI()
+	ticker := time.NewTicker(downwardAPIWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		current, err := readDownwardAPI()
+		if err != nil || current.empty() {
+			continue
+		}
+		if last != nil && reflect.DeepEqual(last.labels, current.labels) && reflect.DeepEqual(last.annotations, current.annotations) {
+			continue
+		}
+		last = current
+		pod, ok, err := currentObjects.getPod()
+		if !ok || err != nil || pod == nil {
+			pod = &corev1.Pod{}
+			if nsName, err := GetCurrentPodNamespaceAndName(); err == nil {
+				pod.ObjectMeta = metav1.ObjectMeta{Namespace: nsName.Namespace, Name: nsName.Name}
+			}
+		}
+		if current.labels != nil {
+			pod.Labels = current.labels
+		}
+		if current.annotations != nil {
+			pod.Annotations = current.annotations
+		}
+		currentObjects.notifyPod(pod)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package info
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func writeDownwardFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadDownwardMap(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:    "labels",
+			content: "app=\"game\"\napp.kubernetes.io/version=\"v1\"\n",
+			want:    map[string]string{"app": "game", "app.kubernetes.io/version": "v1"},
+		},
+		{
+			name:    "escaped values",
+			content: "config=\"{\\\"a\\\": \\\"b=c\\\"}\\n\"\nempty=\"\"",
+			want:    map[string]string{"config": "{\"a\": \"b=c\"}\n", "empty": ""},
+		},
+		{
+			name:    "empty file",
+			content: "",
+			want:    map[string]string{},
+		},
+		{
+			name:    "invalid line",
+			content: "app",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			defer SetDownwardAPIPath(DefaultDownwardAPIPath)
+			SetDownwardAPIPath(dir)
+			writeDownwardFiles(t, dir, map[string]string{downwardLabelsFile: tt.content})
+			got, err := readDownwardMap(downwardLabelsFile)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readDownwardMap() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readDownwardMap() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDownwardAPI(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "")
+	t.Setenv("POD_NAME", "")
+	dir := t.TempDir()
+	defer SetDownwardAPIPath(DefaultDownwardAPIPath)
+	SetDownwardAPIPath(dir)
+	writeDownwardFiles(t, dir, map[string]string{
+		downwardNameFile:        "game-0",
+		downwardNamespaceFile:   "default\n",
+		downwardLabelsFile:      "version=\"v1\"",
+		downwardAnnotationsFile: "owner=\"ops\"",
+	})
+	// the pod must not be read from the API server
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("get", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		t.Errorf("Unexpected get of the pod")
+		return false, nil, nil
+	})
+	SetGlobalKubeInterface(client)
+
+	nsName, err := GetCurrentPodNamespaceAndName()
+	if err != nil || nsName.Namespace != "default" || nsName.Name != "game-0" {
+		t.Errorf("Expected default/game-0, but got %v, err: %v", nsName, err)
+	}
+	if labels, err := GetCurrentPodLabels(); err != nil || labels["version"] != "v1" {
+		t.Errorf("Expected the labels of the file, but got %v, err: %v", labels, err)
+	}
+	if annotations, err := GetCurrentPodAnnotations(); err != nil || annotations["owner"] != "ops" {
+		t.Errorf("Expected the annotations of the file, but got %v, err: %v", annotations, err)
+	}
+
+	defer func(interval time.Duration) { downwardAPIWatchInterval = interval }(downwardAPIWatchInterval)
+	downwardAPIWatchInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan *corev1.Pod, 10)
+	defer OnPodChange(func(pod *corev1.Pod) { changes <- pod })()
+	go WatchDownwardAPI(ctx)
+	time.Sleep(50 * time.Millisecond)
+	if len(changes) != 0 {
+		t.Errorf("Expected no change before the files changed")
+	}
+	writeDownwardFiles(t, dir, map[string]string{downwardLabelsFile: "version=\"v2\""})
+	select {
+	case pod := <-changes:
+		if pod.Name != "game-0" || pod.Labels["version"] != "v2" || pod.Annotations["owner"] != "ops" {
+			t.Errorf("Unexpected changed pod: %v", pod.ObjectMeta)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Label change was not notified")
+	}
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package info
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/magicsong/kidecar/pkg/constants"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// GameServerGVR is the resource of the GameServers of OpenKruiseGame
+var GameServerGVR = schema.GroupVersionResource{
+	Group:    constants.GameServersGroup,
+	Version:  constants.GameServersVersion,
+	Resource: constants.GameServersResource,
+}
+
+// GameServerGVK is the kind of the GameServer of a pod
+var GameServerGVK = GameServerGVR.GroupVersion().WithKind("GameServer")
+
+var globalDynamicInterface dynamic.Interface
+
+func SetGlobalDynamicInterface(dynamicClient dynamic.Interface) {
+	globalDynamicInterface = dynamicClient
+}
+
+// GetDynamicInterface returns the client of custom resources like GameServers
+func GetDynamicInterface() dynamic.Interface {
+	return globalDynamicInterface
+}
+
+// GetCurrentGameServer returns the GameServer of the current pod, it has the same namespace and name.
+// It is served from the informer cache once UseCache has it, the returned object is a copy.
+func GetCurrentGameServer(ctx context.Context) (*unstructured.Unstructured, error) {
+	if standalonePod != nil {
+		return nil, ErrStandalone
+	}
+	if gs, ok := currentObjects.getGameServer(); ok {
+		return gs, nil
+	}
+	if globalDynamicInterface == nil {
+		return nil, fmt.Errorf("dynamic client is not set")
+	}
+	nsName, err := GetCurrentPodNamespaceAndName()
+	if err != nil {
+		return nil, err
+	}
+	return globalDynamicInterface.Resource(GameServerGVR).Namespace(nsName.Namespace).Get(ctx, nsName.Name, metav1.GetOptions{})
+}
@@ -0,0 +1,241 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package info
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/magicsong/kidecar/pkg/constants"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// GameServerSetGVR is the resource of the GameServerSets of OpenKruiseGame
+var GameServerSetGVR = schema.GroupVersionResource{
+	Group:    constants.GameServersGroup,
+	Version:  constants.GameServersVersion,
+	Resource: constants.GameServerSetsResource,
+}
+
+// OpsStates of a GameServer set by users and the sidecar
+const (
+	OpsStateNone            = "None"
+	OpsStateAllocated       = "Allocated"
+	OpsStateMaintaining     = "Maintaining"
+	OpsStateWaitToBeDeleted = "WaitToBeDeleted"
+	OpsStateKill            = "Kill"
+)
+
+// States of a GameServer reported by OpenKruiseGame
+const (
+	GameServerStateCreating = "Creating"
+	GameServerStateReady    = "Ready"
+	GameServerStateNotReady = "NotReady"
+	GameServerStateCrash    = "Crash"
+	GameServerStateUpdating = "Updating"
+	GameServerStateDeleting = "Deleting"
+)
+
+// NetworkStates of the network of a GameServer
+const (
+	NetworkReady    = "Ready"
+	NetworkNotReady = "NotReady"
+)
+
+// NetworkStatus is status.networkStatus of a GameServer, filled by the network plugins of OpenKruiseGame
+type NetworkStatus struct {
+	NetworkType         string           `json:"networkType,omitempty"`
+	InternalAddresses   []NetworkAddress `json:"internalAddresses,omitempty"`
+	ExternalAddresses   []NetworkAddress `json:"externalAddresses,omitempty"`
+	DesiredNetworkState string           `json:"desiredNetworkState,omitempty"`
+	CurrentNetworkState string           `json:"currentNetworkState,omitempty"`
+	CreateTime          metav1.Time      `json:"createTime,omitempty"`
+	LastTransitionTime  metav1.Time      `json:"lastTransitionTime,omitempty"`
+}
+
+// NetworkAddress is an address of a GameServer and its ports
+type NetworkAddress struct {
+	IP        string            `json:"ip"`
+	Ports     []NetworkPort     `json:"ports,omitempty"`
+	PortRange *NetworkPortRange `json:"portRange,omitempty"`
+	EndPoint  string            `json:"endPoint,omitempty"`
+}
+
+// NetworkPort is a port of a NetworkAddress
+type NetworkPort struct {
+	Name     string              `json:"name"`
+	Protocol corev1.Protocol     `json:"protocol,omitempty"`
+	Port     *intstr.IntOrString `json:"port,omitempty"`
+}
+
+// NetworkPortRange is a range of ports of a NetworkAddress, like 1000-1100
+type NetworkPortRange struct {
+	Protocol  corev1.Protocol `json:"protocol,omitempty"`
+	PortRange string          `json:"portRange"`
+}
+
+// IsReady returns true if the network plugin reports the network as Ready
+func (s *NetworkStatus) IsReady() bool {
+	return s != nil && s.CurrentNetworkState == NetworkReady
+}
+
+// GameServer is a typed view of a GameServer of OpenKruiseGame, backed by the unstructured object
+type GameServer struct {
+	*unstructured.Unstructured
+}
+
+// OpsState returns spec.opsState
+func (gs *GameServer) OpsState() string {
+	value, _, _ := unstructured.NestedString(gs.Object, "spec", "opsState")
+	return value
+}
+
+// CurrentState returns status.currentState
+func (gs *GameServer) CurrentState() string {
+	value, _, _ := unstructured.NestedString(gs.Object, "status", "currentState")
+	return value
+}
+
+// UpdatePriority returns spec.updatePriority, nil if not set
+func (gs *GameServer) UpdatePriority() *intstr.IntOrString {
+	return nestedIntOrString(gs.Object, "spec", "updatePriority")
+}
+
+// DeletionPriority returns spec.deletionPriority, nil if not set
+func (gs *GameServer) DeletionPriority() *intstr.IntOrString {
+	return nestedIntOrString(gs.Object, "spec", "deletionPriority")
+}
+
+// NetworkStatus returns status.networkStatus, nil if the GameServer has no network
+func (gs *GameServer) NetworkStatus() (*NetworkStatus, error) {
+	raw, found, err := unstructured.NestedMap(gs.Object, "status", "networkStatus")
+	if err != nil {
+		return nil, fmt.Errorf("invalid network status: %w", err)
+	}
+	if !found {
+		return nil, nil
+	}
+	status := &NetworkStatus{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(raw, status); err != nil {
+		return nil, fmt.Errorf("invalid network status: %w", err)
+	}
+	return status, nil
+}
+
+// GameServerSet is a typed view of a GameServerSet of OpenKruiseGame, backed by the unstructured object
+type GameServerSet struct {
+	*unstructured.Unstructured
+}
+
+// Replicas returns spec.replicas
+func (gss *GameServerSet) Replicas() int64 {
+	return nestedInt64(gss.Object, "spec", "replicas")
+}
+
+// ReadyReplicas returns status.readyReplicas
+func (gss *GameServerSet) ReadyReplicas() int64 {
+	return nestedInt64(gss.Object, "status", "readyReplicas")
+}
+
+// UpdatedReplicas returns status.updatedReplicas
+func (gss *GameServerSet) UpdatedReplicas() int64 {
+	return nestedInt64(gss.Object, "status", "updatedReplicas")
+}
+
+// MaintainingReplicas returns status.maintainingReplicas
+func (gss *GameServerSet) MaintainingReplicas() int64 {
+	return nestedInt64(gss.Object, "status", "maintainingReplicas")
+}
+
+// nestedInt64 also accepts floats, like the numbers of objects decoded from yaml
+func nestedInt64(obj map[string]interface{}, fields ...string) int64 {
+	value, found, err := unstructured.NestedFieldNoCopy(obj, fields...)
+	if err != nil || !found {
+		return 0
+	}
+	switch v := value.(type) {
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
+
+func nestedIntOrString(obj map[string]interface{}, fields ...string) *intstr.IntOrString {
+	value, found, err := unstructured.NestedFieldNoCopy(obj, fields...)
+	if err != nil || !found {
+		return nil
+	}
+	switch v := value.(type) {
+	case int64:
+		result := intstr.FromInt32(int32(v))
+		return &result
+	case float64:
+		result := intstr.FromInt32(int32(v))
+		return &result
+	case string:
+		result := intstr.Parse(v)
+		return &result
+	}
+	return nil
+}
+
+// GetGameServer returns the GameServer of the current pod, served from the cache like GetCurrentGameServer
+func GetGameServer(ctx context.Context) (*GameServer, error) {
+	gs, err := GetCurrentGameServer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &GameServer{Unstructured: gs}, nil
+}
+
+// GetGameServerSet returns the GameServerSet of the current pod, found by the owner label set by OpenKruiseGame.
+// It is served from the cache once the informer of UseCache has it, the returned object is a copy.
+func GetGameServerSet(ctx context.Context) (*GameServerSet, error) {
+	if standalonePod != nil {
+		return nil, ErrStandalone
+	}
+	if globalDynamicInterface == nil {
+		return nil, fmt.Errorf("dynamic client is not set")
+	}
+	nsName, err := GetCurrentPodNamespaceAndName()
+	if err != nil {
+		return nil, err
+	}
+	labels, err := GetCurrentPodLabels()
+	if err != nil {
+		return nil, err
+	}
+	name := labels[constants.GameServerSetLabelKey]
+	if name == "" {
+		return nil, fmt.Errorf("pod %s is not owned by a gameserverset", nsName.Name)
+	}
+	if gss, ok := currentObjects.getGameServerSet(name); ok {
+		return &GameServerSet{Unstructured: gss}, nil
+	}
+	gss, err := globalDynamicInterface.Resource(GameServerSetGVR).Namespace(nsName.Namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &GameServerSet{Unstructured: gss}, nil
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package info
+
+import (
+	"context"
+	"testing"
+
+	"github.com/magicsong/kidecar/pkg/constants"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/controller-runtime/pkg/cache/informertest"
+	"sigs.k8s.io/yaml"
+)
+
+const testGameServer = `
+apiVersion: game.kruise.io/v1alpha1
+kind: GameServer
+metadata:
+  name: game-0
+  namespace: default
+spec:
+  opsState: Allocated
+  updatePriority: 10
+  deletionPriority: "50%"
+status:
+  currentState: Ready
+  networkStatus:
+    networkType: Kubernetes-HostPort
+    currentNetworkState: Ready
+    desiredNetworkState: Ready
+    internalAddresses:
+      - ip: 10.0.0.5
+        ports:
+          - name: game
+            protocol: TCP
+            port: 8080
+    externalAddresses:
+      - ip: 47.1.2.3
+        ports:
+          - name: game
+            protocol: TCP
+            port: 30080
+      - ip: 47.1.2.4
+        portRange:
+          protocol: UDP
+          portRange: 1000-1100
+`
+
+func newTestObject(t *testing.T, content string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	if err := yaml.Unmarshal([]byte(content), &obj.Object); err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+func TestGameServer(t *testing.T) {
+	gs := &GameServer{Unstructured: newTestObject(t, testGameServer)}
+	if gs.OpsState() != OpsStateAllocated {
+		t.Errorf("Expected opsState Allocated, but got %s", gs.OpsState())
+	}
+	if gs.CurrentState() != GameServerStateReady {
+		t.Errorf("Expected currentState Ready, but got %s", gs.CurrentState())
+	}
+	if p := gs.UpdatePriority(); p == nil || *p != intstr.FromInt32(10) {
+		t.Errorf("Expected updatePriority 10, but got %v", p)
+	}
+	if p := gs.DeletionPriority(); p == nil || *p != intstr.FromString("50%") {
+		t.Errorf("Expected deletionPriority 50%%, but got %v", p)
+	}
+	status, err := gs.NetworkStatus()
+	if err != nil {
+		t.Fatalf("NetworkStatus() error = %v", err)
+	}
+	if !status.IsReady() || status.NetworkType != "Kubernetes-HostPort" {
+		t.Errorf("Unexpected network status: %+v", status)
+	}
+	if len(status.ExternalAddresses) != 2 || status.ExternalAddresses[0].IP != "47.1.2.3" ||
+		status.ExternalAddresses[0].Ports[0].Port.IntValue() != 30080 || status.ExternalAddresses[1].PortRange.PortRange != "1000-1100" {
+		t.Errorf("Unexpected external addresses: %+v", status.ExternalAddresses)
+	}
+
+	empty := &GameServer{Unstructured: &unstructured.Unstructured{Object: map[string]interface{}{}}}
+	if empty.OpsState() != "" || empty.UpdatePriority() != nil {
+		t.Errorf("Expected empty fields of an empty gameserver")
+	}
+	if status, err := empty.NetworkStatus(); err != nil || status != nil || status.IsReady() {
+		t.Errorf("Expected no network status, but got %v, err: %v", status, err)
+	}
+}
+
+func TestGetGameServerSet(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "game-0")
+	gss := newTestObject(t, `
+apiVersion: game.kruise.io/v1alpha1
+kind: GameServerSet
+metadata:
+  name: game
+  namespace: default
+spec:
+  replicas: 3
+status:
+  readyReplicas: 2
+  updatedReplicas: 1
+`)
+	SetGlobalDynamicInterface(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), gss))
+	defer SetGlobalDynamicInterface(nil)
+	SetStandalonePod(nil)
+
+	// drop the pod cached by other tests
+	currentObjects.begin(types.NamespacedName{})
+	SetGlobalKubeInterface(fake.NewSimpleClientset(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "game-0", Namespace: "default"}}))
+	if _, err := GetGameServerSet(context.Background()); err == nil {
+		t.Errorf("Expected an error for a pod without gameserverset")
+	}
+
+	SetGlobalKubeInterface(fake.NewSimpleClientset(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name: "game-0", Namespace: "default", Labels: map[string]string{constants.GameServerSetLabelKey: "game"},
+	}}))
+	got, err := GetGameServerSet(context.Background())
+	if err != nil {
+		t.Fatalf("GetGameServerSet() error = %v", err)
+	}
+	if got.GetName() != "game" || got.Replicas() != 3 || got.ReadyReplicas() != 2 || got.UpdatedReplicas() != 1 {
+		t.Errorf("Unexpected gameserverset: %v", got.Object)
+	}
+}
+
+func TestGetGameServerSet_ServedFromCache(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "game-0")
+	gss := newTestObject(t, `
+apiVersion: game.kruise.io/v1alpha1
+kind: GameServerSet
+metadata:
+  name: game
+  namespace: default
+spec:
+  replicas: 3
+`)
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		GameServerGVR:    "GameServerList",
+		GameServerSetGVR: "GameServerSetList",
+	}, gss)
+	SetGlobalDynamicInterface(client)
+	defer SetGlobalDynamicInterface(nil)
+	SetStandalonePod(nil)
+	kube := fake.NewSimpleClientset(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name: "game-0", Namespace: "default", Labels: map[string]string{constants.GameServerSetLabelKey: "game"},
+	}})
+	kube.PrependReactor("create", "selfsubjectaccessreviews", allowAccess(nil))
+	SetGlobalKubeInterface(kube)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := UseCache(ctx, &informertest.FakeInformers{}); err != nil {
+		t.Fatalf("UseCache() error = %v", err)
+	}
+	if err := wait(func() bool {
+		_, ok := currentObjects.getGameServerSet("game")
+		return ok
+	}); err != nil {
+		t.Fatalf("GameServerSet was not cached: %v", err)
+	}
+
+	client.ClearActions()
+	got, err := GetGameServerSet(ctx)
+	if err != nil {
+		t.Fatalf("GetGameServerSet() error = %v", err)
+	}
+	if got.Replicas() != 3 {
+		t.Errorf("Unexpected gameserverset: %v", got.Object)
+	}
+	if actions := client.Actions(); len(actions) != 0 {
+		t.Errorf("Expected the gameserverset from the cache, but got requests %v", actions)
+	}
+}
@@ -0,0 +1,377 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package info
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/magicsong/kidecar/pkg/constants"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	ctrlcache "sigs.k8s.io/controller-runtime/pkg/cache"
+)
+
+// objectCache holds the current pod, its GameServer and GameServerSet, kept up to date by the informers of UseCache
+type objectCache struct {
+	mu sync.RWMutex
+	// generation identifies the informers of the last UseCache, events of older ones are dropped
+	generation int
+	// key is the pod the informers select, the cache is bypassed if the pod of the env differs
+	key types.NamespacedName
+	// synced reports whether the pod informer synced, nil before the informers are set up
+	synced  func() bool
+	pod     *corev1.Pod
+	gs      *unstructured.Unstructured
+	gss     *unstructured.Unstructured
+	nextID  int
+	podSubs map[int]func(pod *corev1.Pod)
+	gsSubs  map[int]func(gs *unstructured.Unstructured)
+}
+
+var currentObjects = &objectCache{
+	podSubs: map[int]func(pod *corev1.Pod){},
+	gsSubs:  map[int]func(gs *unstructured.Unstructured){},
+}
+
+// getPod returns false if the informer is not synced, the caller should ask the API server instead
+func (c *objectCache) getPod() (*corev1.Pod, bool, error) {
+	nsName, err := GetCurrentPodNamespaceAndName()
+	if err != nil {
+		return nil, true, err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.synced == nil || !c.synced() || c.key != *nsName {
+		return nil, false, nil
+	}
+	if c.pod == nil {
+		return nil, true, apierrors.NewNotFound(corev1.Resource("pods"), nsName.Name)
+	}
+	return c.pod.DeepCopy(), true, nil
+}
+
+func (c *objectCache) getGameServer() (*unstructured.Unstructured, bool) {
+	nsName, err := GetCurrentPodNamespaceAndName()
+	if err != nil {
+		return nil, false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.gs == nil || c.key != *nsName {
+		return nil, false
+	}
+	return c.gs.DeepCopy(), true
+}
+
+func (c *objectCache) getGameServerSet(name string) (*unstructured.Unstructured, bool) {
+	nsName, err := GetCurrentPodNamespaceAndName()
+	if err != nil {
+		return nil, false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.gss == nil || c.key != *nsName || c.gss.GetName() != name {
+		return nil, false
+	}
+	return c.gss.DeepCopy(), true
+}
+
+func (c *objectCache) setGameServerSet(generation int, gss *unstructured.Unstructured) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation == c.generation {
+		c.gss = gss
+	}
+}
+
+func (c *objectCache) setPod(generation int, pod *corev1.Pod) {
+	c.mu.Lock()
+	if generation != c.generation {
+		c.mu.Unlock()
+		return
+	}
+	c.pod = pod
+	c.mu.Unlock()
+	if pod == nil {
+		return
+	}
+	c.notifyPod(pod)
+}
+
+// notifyPod calls the subscribers of OnPodChange with copies of the pod
+func (c *objectCache) notifyPod(pod *corev1.Pod) {
+	c.mu.RLock()
+	subs := make([]func(pod *corev1.Pod), 0, len(c.podSubs))
+	for _, sub := range c.podSubs {
+		subs = append(subs, sub)
+	}
+	c.mu.RUnlock()
+	for _, sub := range subs {
+		sub(pod.DeepCopy())
+	}
+}
+
+func (c *objectCache) setGameServer(generation int, gs *unstructured.Unstructured) {
+	c.mu.Lock()
+	if generation != c.generation {
+		c.mu.Unlock()
+		return
+	}
+	c.gs = gs
+	subs := make([]func(gs *unstructured.Unstructured), 0, len(c.gsSubs))
+	for _, sub := range c.gsSubs {
+		subs = append(subs, sub)
+	}
+	c.mu.Unlock()
+	if gs == nil {
+		return
+	}
+	for _, sub := range subs {
+		sub(gs.DeepCopy())
+	}
+}
+
+func (c *objectCache) reset(generation int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	c.synced = nil
+	c.pod = nil
+	c.gs = nil
+	c.gss = nil
+}
+
+// begin starts a new generation for the informers of the pod, events of the previous informers are dropped from now on
+func (c *objectCache) begin(key types.NamespacedName) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.key = key
+	c.synced = nil
+	c.pod = nil
+	c.gs = nil
+	c.gss = nil
+	return c.generation
+}
+
+func (c *objectCache) setSynced(generation int, synced func() bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation == c.generation {
+		c.synced = synced
+	}
+}
+
+// podEventHandler keeps the pod of the generation up to date
+func podEventHandler(generation int) cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if pod, ok := obj.(*corev1.Pod); ok {
+				currentObjects.setPod(generation, pod)
+			}
+		},
+		UpdateFunc: func(_, newObj interface{}) {
+			if pod, ok := newObj.(*corev1.Pod); ok {
+				currentObjects.setPod(generation, pod)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			currentObjects.setPod(generation, nil)
+		},
+	}
+}
+
+// gameServerEventHandler keeps the GameServer of the generation up to date
+func gameServerEventHandler(generation int) cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if gs, ok := obj.(*unstructured.Unstructured); ok {
+				currentObjects.setGameServer(generation, gs)
+			}
+		},
+		UpdateFunc: func(_, newObj interface{}) {
+			if gs, ok := newObj.(*unstructured.Unstructured); ok {
+				currentObjects.setGameServer(generation, gs)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			currentObjects.setGameServer(generation, nil)
+		},
+	}
+}
+
+// gameServerSetEventHandler keeps the GameServerSet of the generation up to date
+func gameServerSetEventHandler(generation int) cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if gss, ok := obj.(*unstructured.Unstructured); ok {
+				currentObjects.setGameServerSet(generation, gss)
+			}
+		},
+		UpdateFunc: func(_, newObj interface{}) {
+			if gss, ok := newObj.(*unstructured.Unstructured); ok {
+				currentObjects.setGameServerSet(generation, gss)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			currentObjects.setGameServerSet(generation, nil)
+		},
+	}
+}
+
+// OnPodChange calls the handler with a copy of the current pod every time it changes, until unsubscribed.
+// Handlers are called by the informer one at a time and should return quickly.
+func OnPodChange(handler func(pod *corev1.Pod)) (unsubscribe func()) {
+	c := currentObjects
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := c.nextID
+	c.nextID++
+	c.podSubs[id] = handler
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.podSubs, id)
+	}
+}
+
+// OnGameServerChange calls the handler with a copy of the GameServer of the pod every time it changes, until unsubscribed
+func OnGameServerChange(handler func(gs *unstructured.Unstructured)) (unsubscribe func()) {
+	c := currentObjects
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := c.nextID
+	c.nextID++
+	c.gsSubs[id] = handler
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.gsSubs, id)
+	}
+}
+
+// watchGameServerSet caches the GameServerSet owning the pod, it is selected by name like the pod.
+// Pods without the owner label of OpenKruiseGame and sidecars which may not list GameServerSets skip it.
+func watchGameServerSet(ctx context.Context, generation int, namespace string) error {
+	labels, err := GetCurrentPodLabels()
+	if err != nil {
+		return fmt.Errorf("failed to get the labels of the current pod: %w", err)
+	}
+	name := labels[constants.GameServerSetLabelKey]
+	if name == "" {
+		return nil
+	}
+	selectByName := func(options *metav1.ListOptions) {
+		options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+	}
+	listOptions := metav1.ListOptions{Limit: 1}
+	selectByName(&listOptions)
+	if _, err := globalDynamicInterface.Resource(GameServerSetGVR).Namespace(namespace).List(ctx, listOptions); err != nil {
+		return nil
+	}
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(globalDynamicInterface, 0, namespace, selectByName)
+	informer := factory.ForResource(GameServerSetGVR).Informer()
+	if _, err := informer.AddEventHandler(gameServerSetEventHandler(generation)); err != nil {
+		return fmt.Errorf("failed to add gameserverset event handler: %w", err)
+	}
+	factory.Start(ctx.Done())
+	return nil
+}
+
+// UseCache serves the current pod and its GameServer from the informers of a controller-runtime cache, like the cache of
+// the manager scoped to the pod. It can be called before the cache is started, the objects are served from the cache once
+// the pod informer synced and from the API server before. An object is not watched if the sidecar may not list and watch it,
+// so the pod permissions can be dropped when templates only need the downward API volume. The GameServer is also skipped
+// if the cache has no informer for it. The GameServerSet is watched by an informer of its own, selected by name.
+func UseCache(ctx context.Context, c ctrlcache.Informers) error {
+	nsName, err := GetCurrentPodNamespaceAndName()
+	if err != nil {
+		return err
+	}
+	generation := currentObjects.begin(*nsName)
+	go func() {
+		<-ctx.Done()
+		currentObjects.reset(generation)
+	}()
+	if canListAndWatch(ctx, nsName.Namespace, corev1.SchemeGroupVersion.WithResource("pods")) {
+		podInformer, err := c.GetInformer(ctx, &corev1.Pod{})
+		if err != nil {
+			return fmt.Errorf("failed to get the informer of the current pod: %w", err)
+		}
+		if _, err := podInformer.AddEventHandler(podEventHandler(generation)); err != nil {
+			return fmt.Errorf("failed to add pod event handler: %w", err)
+		}
+		currentObjects.setSynced(generation, podInformer.HasSynced)
+	}
+
+	if !canListAndWatch(ctx, nsName.Namespace, GameServerGVR) {
+		return nil
+	}
+	gs := &unstructured.Unstructured{}
+	gs.SetGroupVersionKind(GameServerGVK)
+	gsInformer, err := c.GetInformer(ctx, gs)
+	if err != nil {
+		// the CRD is not installed
+		return nil
+	}
+	if _, err := gsInformer.AddEventHandler(gameServerEventHandler(generation)); err != nil {
+		return fmt.Errorf("failed to add gameserver event handler: %w", err)
+	}
+	if globalDynamicInterface == nil {
+		return nil
+	}
+	return watchGameServerSet(ctx, generation, nsName.Namespace)
+}
+
+// canListAndWatch reviews the permissions of the sidecar, it assumes they are granted if the review fails
+func canListAndWatch(ctx context.Context, namespace string, gvr schema.GroupVersionResource) bool {
+	if globalKubeInterface == nil {
+		return true
+	}
+	for _, verb := range []string{"list", "watch"} {
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace: namespace,
+					Verb:      verb,
+					Group:     gvr.Group,
+					Resource:  gvr.Resource,
+				},
+			},
+		}
+		result, err := globalKubeInterface.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+		if err != nil {
+			return true
+		}
+		if !result.Status.Allowed {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,218 @@
+/*
+Copyright 2024
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package info
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/controller-runtime/pkg/cache/informertest"
+)
+
+func TestUseCache_NotifiesChanges(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "game-0")
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "game-0", Namespace: "default", Labels: map[string]string{"version": "v1"}}}
+	gs := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "game.kruise.io/v1alpha1",
+		"kind":       "GameServer",
+		"metadata":   map[string]interface{}{"name": "game-0", "namespace": "default"},
+		"spec":       map[string]interface{}{"opsState": "None"},
+	}}
+	client := fake.NewSimpleClientset(pod)
+	client.PrependReactor("create", "selfsubjectaccessreviews", allowAccess(nil))
+	SetGlobalKubeInterface(client)
+	informers := &informertest.FakeInformers{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := UseCache(ctx, informers); err != nil {
+		t.Fatalf("Failed to use cache: %v", err)
+	}
+	podInformer, err := informers.FakeInformerFor(ctx, &corev1.Pod{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gsInformer, err := informers.FakeInformerFor(ctx, gs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	podInformer.Add(pod.DeepCopy())
+	podInformer.Synced = true
+	podChanges := make(chan *corev1.Pod, 10)
+	unsubscribe := OnPodChange(func(pod *corev1.Pod) { podChanges <- pod })
+	gsChanges := make(chan *unstructured.Unstructured, 10)
+	defer OnGameServerChange(func(gs *unstructured.Unstructured) { gsChanges <- gs })()
+
+	// the pod is served from the cache, gets of the API server are counted
+	gets := 0
+	client.PrependReactor("get", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		gets++
+		return false, nil, nil
+	})
+	got, err := GetCurrentPod()
+	if err != nil || got.Labels["version"] != "v1" {
+		t.Fatalf("Unexpected pod %v, err: %v", got, err)
+	}
+	got.Labels["version"] = "modified"
+	if got, _ := GetCurrentPod(); got.Labels["version"] != "v1" {
+		t.Errorf("The cached pod was modified by the caller")
+	}
+	if gets != 0 {
+		t.Errorf("Expected the pod from the cache, but got %d gets", gets)
+	}
+
+	updated := pod.DeepCopy()
+	updated.Labels["version"] = "v2"
+	podInformer.Update(pod, updated)
+	select {
+	case changed := <-podChanges:
+		if changed.Labels["version"] != "v2" {
+			t.Errorf("Expected the updated pod, but got: %v", changed.Labels)
+		}
+	default:
+		t.Fatal("Pod change was not notified")
+	}
+	if got, _ := GetCurrentPod(); got.Labels["version"] != "v2" {
+		t.Errorf("Expected the updated pod in the cache, but got: %v", got.Labels)
+	}
+
+	gsInformer.Add(gs.DeepCopy())
+	maintaining := gs.DeepCopy()
+	if err := unstructured.SetNestedField(maintaining.Object, "Maintaining", "spec", "opsState"); err != nil {
+		t.Fatal(err)
+	}
+	gsInformer.Update(gs, maintaining)
+	if len(gsChanges) != 2 {
+		t.Fatalf("Expected 2 gameserver changes, but got %d", len(gsChanges))
+	}
+	if got, err := GetCurrentGameServer(ctx); err != nil || got.Object["spec"].(map[string]interface{})["opsState"] != "Maintaining" {
+		t.Errorf("Expected the updated gameserver, but got: %v, err: %v", got, err)
+	}
+
+	unsubscribe()
+	podInformer.Delete(updated)
+	if _, err := GetCurrentPod(); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected the deleted pod to be not found, but got: %v", err)
+	}
+	if len(podChanges) != 0 {
+		t.Errorf("Unsubscribed handler was called")
+	}
+
+	// the cache is dropped with the context
+	cancel()
+	if err := wait(func() bool { _, ok, _ := currentObjects.getPod(); return !ok }); err != nil {
+		t.Error("Expected the cache to be dropped")
+	}
+}
+
+func TestUseCache(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "game-0")
+	client := fake.NewSimpleClientset(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "game-0", Namespace: "default", Labels: map[string]string{"version": "api"}}})
+	client.PrependReactor("create", "selfsubjectaccessreviews", allowAccess(nil))
+	SetGlobalKubeInterface(client)
+	synced := false
+	informers := &informertest.FakeInformers{Synced: &synced}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := UseCache(ctx, informers); err != nil {
+		t.Fatalf("Failed to use cache: %v", err)
+	}
+	podInformer, err := informers.FakeInformerFor(ctx, &corev1.Pod{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := &unstructured.Unstructured{}
+	gs.SetGroupVersionKind(GameServerGVK)
+	gsInformer, err := informers.FakeInformerFor(ctx, gs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the API server answers until the informer synced
+	podInformer.Synced = false
+	if got, err := GetCurrentPod(); err != nil || got.Labels["version"] != "api" {
+		t.Errorf("Expected the pod of the API server, but got: %v, err: %v", got, err)
+	}
+	podChanges := make(chan *corev1.Pod, 10)
+	defer OnPodChange(func(pod *corev1.Pod) { podChanges <- pod })()
+	podInformer.Add(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "game-0", Namespace: "default", Labels: map[string]string{"version": "cache"}}})
+	podInformer.Synced = true
+	if got, err := GetCurrentPod(); err != nil || got.Labels["version"] != "cache" {
+		t.Errorf("Expected the pod of the cache, but got: %v, err: %v", got, err)
+	}
+	if len(podChanges) != 1 {
+		t.Errorf("Expected 1 pod change, but got %d", len(podChanges))
+	}
+
+	gs.SetName("game-0")
+	gs.SetNamespace("default")
+	gsInformer.Add(gs)
+	if got, err := GetCurrentGameServer(ctx); err != nil || got.GetName() != "game-0" {
+		t.Errorf("Expected the gameserver of the cache, but got: %v, err: %v", got, err)
+	}
+}
+
+func TestUseCacheWithoutPermission(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "game-0")
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "selfsubjectaccessreviews", allowAccess(map[string]bool{"pods": false}))
+	SetGlobalKubeInterface(client)
+	informers := &informertest.FakeInformers{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := UseCache(ctx, informers); err != nil {
+		t.Fatalf("Failed to use cache: %v", err)
+	}
+	if _, ok := informers.InformersByGVK[corev1.SchemeGroupVersion.WithKind("Pod")]; ok {
+		t.Errorf("Expected no pod informer without permission")
+	}
+	if _, ok := informers.InformersByGVK[GameServerGVK]; !ok {
+		t.Errorf("Expected the gameserver informer")
+	}
+}
+
+// allowAccess answers the access reviews, resources missing from allowed are granted
+func allowAccess(allowed map[string]bool) k8stesting.ReactionFunc {
+	return func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		granted, ok := allowed[review.Spec.ResourceAttributes.Resource]
+		review.Status.Allowed = !ok || granted
+		return true, review, nil
+	}
+}
+
+func wait(condition func() bool) error {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return context.DeadlineExceeded
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package info
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// GetNode returns the node by name, the sidecar needs the permission to get nodes
+func GetNode(ctx context.Context, name string) (*corev1.Node, error) {
+	if standalonePod != nil {
+		return nil, ErrStandalone
+	}
+	return globalKubeInterface.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+}
@@ -20,7 +20,6 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -28,39 +27,40 @@ import (
 	"k8s.io/client-go/kubernetes"
 )
 
-// GetCurrentPod return pod the sidecar running
-var cacheExpiration time.Duration = 1 * time.Minute
-var cache map[string]*corev1.Pod = make(map[string]*corev1.Pod)
-
+// GetCurrentPod return pod the sidecar running, served from the informer cache once the pod informer of UseCache synced.
+// The returned pod is a copy and may be modified by the caller.
 func GetCurrentPod() (*corev1.Pod, error) {
-	nsname, err := GetCurrentPodNamespaceAndName()
-	if err != nil {
-		return nil, err
+	if standalonePod != nil {
+		return standalonePod.DeepCopy(), nil
 	}
-	// Check if the pod is already cached
-	if pod, ok := cache[nsname.String()]; ok {
-		return pod, nil
+	if pod, ok, err := currentObjects.getPod(); ok {
+		return pod, err
 	}
-
-	// Fetch the pod from the Kubernetes API
-	pod, err := globalKubeInterface.CoreV1().Pods(nsname.Namespace).Get(context.TODO(), nsname.Name, metav1.GetOptions{})
+	nsname, err := GetCurrentPodNamespaceAndName()
 	if err != nil {
 		return nil, err
 	}
-
-	// Cache the pod for future use
-	cache[nsname.String()] = pod
-
-	// Set a timer to expire the cache entry after the specified duration
-	time.AfterFunc(cacheExpiration, func() {
-		delete(cache, nsname.String())
-	})
-
-	return pod, nil
+	// Fetch the pod from the Kubernetes API
+	return globalKubeInterface.CoreV1().Pods(nsname.Namespace).Get(context.TODO(), nsname.Name, metav1.GetOptions{})
 }
+
+// GetCurrentPodNamespaceAndName returns the standalone pod, the flags, POD_NAMESPACE and POD_NAME
+// or the name and namespace files of the downward API volume in this order
 func GetCurrentPodNamespaceAndName() (*types.NamespacedName, error) {
+	if standalonePod != nil {
+		return &types.NamespacedName{Namespace: standalonePod.Namespace, Name: standalonePod.Name}, nil
+	}
+	if podIdentity != nil {
+		nsName := *podIdentity
+		return &nsName, nil
+	}
 	ns := os.Getenv("POD_NAMESPACE")
 	name := os.Getenv("POD_NAME")
+	if ns == "" || name == "" {
+		if downward, err := readDownwardAPI(); err == nil && downward.name != nil && downward.namespace != nil {
+			ns, name = *downward.namespace, *downward.name
+		}
+	}
 	if ns == "" || name == "" {
 		return nil, fmt.Errorf("failed to get current pod namespace and name")
 	}
@@ -71,13 +71,12 @@ func GetCurrentPodNamespaceAndName() (*types.NamespacedName, error) {
 }
 
 func GetCurrentPodInfo() (string, error) {
-	ns := os.Getenv("POD_NAMESPACE")
-	name := os.Getenv("POD_NAME")
-	if ns == "" || name == "" {
-		return "", fmt.Errorf("failed to get current pod namespace and name")
+	nsName, err := GetCurrentPodNamespaceAndName()
+	if err != nil {
+		return "", err
 	}
 
-	return fmt.Sprintf("%s-%s", ns, name), nil
+	return fmt.Sprintf("%s-%s", nsName.Namespace, nsName.Name), nil
 
 }
 
@@ -17,9 +17,13 @@ limitations under the License.
 package info
 
 import (
+	"context"
+	"errors"
 	"os"
 	"testing"
 
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 )
 
@@ -131,3 +135,30 @@ func TestGetCurrentPodInfo(t *testing.T) {
 		})
 	}
 }
+
+func TestGetCurrentPodNamespaceAndNamePrecedence(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "env-namespace")
+	t.Setenv("POD_NAME", "env-pod")
+
+	SetPodIdentity("flag-namespace", "flag-pod")
+	defer SetPodIdentity("", "")
+	if got, _ := GetCurrentPodNamespaceAndName(); got.String() != "flag-namespace/flag-pod" {
+		t.Errorf("Expected the flags to override the env, got %s", got)
+	}
+	if got, _ := GetCurrentPodInfo(); got != "flag-namespace-flag-pod" {
+		t.Errorf("Expected the pod info of the flags, got %s", got)
+	}
+
+	SetStandalonePod(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "local-pod", Namespace: "local", Labels: map[string]string{"app": "game"}}})
+	defer SetStandalonePod(nil)
+	if got, _ := GetCurrentPodNamespaceAndName(); got.String() != "local/local-pod" {
+		t.Errorf("Expected the standalone pod, got %s", got)
+	}
+	pod, err := GetCurrentPod()
+	if err != nil || pod.Labels["app"] != "game" {
+		t.Errorf("Expected the standalone pod, got %v, err: %v", pod, err)
+	}
+	if _, err := GetCurrentGameServer(context.TODO()); !errors.Is(err, ErrStandalone) {
+		t.Errorf("Expected ErrStandalone, got %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package info
+
+import (
+	"errors"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// ErrStandalone is returned by the getters needing the Kubernetes API server in standalone mode
+var ErrStandalone = errors.New("not available in standalone mode")
+
+var standalonePod *corev1.Pod
+
+// SetStandalonePod makes the sidecar serve the given pod instead of asking the API server
+func SetStandalonePod(pod *corev1.Pod) {
+	standalonePod = pod
+}
+
+// IsStandalone returns true if the sidecar runs without a Kubernetes API server
+func IsStandalone() bool {
+	return standalonePod != nil
+}
+
+var podIdentity *types.NamespacedName
+
+// SetPodIdentity overrides POD_NAMESPACE and POD_NAME, usually from command line flags
+func SetPodIdentity(namespace, name string) {
+	if namespace == "" || name == "" {
+		podIdentity = nil
+		return
+	}
+	podIdentity = &types.NamespacedName{Namespace: namespace, Name: name}
+}
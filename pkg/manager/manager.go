@@ -18,33 +18,127 @@ package manager
 
 import (
 	"fmt"
+	"net/http"
 
 	"github.com/magicsong/kidecar/api"
+	"github.com/magicsong/kidecar/pkg/constants"
+	"github.com/magicsong/kidecar/pkg/info"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 )
 
 type sidecarManager struct {
 	ctrl.Manager
 	api.DBManager
 	kubernetes.Interface
+	dynamicClient dynamic.Interface
 }
 
-func NewManager() (api.SidecarManager, error) {
+// Resource implements dynamic.Interface.
+func (m sidecarManager) Resource(resource schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
+	return m.dynamicClient.Resource(resource)
+}
+
+// NewStandaloneManager returns a manager without a Kubernetes API server, its manager and client must not be used
+func NewStandaloneManager() api.SidecarManager {
+	return sidecarManager{}
+}
+
+// NewManager creates the manager of the sidecar, its cache only holds the current pod and its GameServer.
+// The metrics server listens on the admin address of the config and the health probes on the health probe address.
+func NewManager(sidecarConfig *api.SidecarConfig) (api.SidecarManager, error) {
 	cfg, err := config.GetConfig()
 	if err != nil {
 		return nil, fmt.Errorf("unable to get kubeconfig: %w", err)
 	}
+	nsName, err := info.GetCurrentPodNamespaceAndName()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get current pod: %w", err)
+	}
+	// the cache options depend on the installed CRDs, so discovery runs before the manager exists
+	disc, err := discovery.NewDiscoveryClientForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create discovery client: %w", err)
+	}
+	withGameServer, err := gameServerInstalled(disc)
+	if err != nil {
+		return nil, err
+	}
 
-	mgr, err := manager.New(cfg, manager.Options{})
+	mgr, err := manager.New(cfg, managerOptions(sidecarConfig, *nsName, withGameServer))
 	if err != nil {
 		return nil, fmt.Errorf("unable to create manager: %w", err)
 	}
-	kube, err := kubernetes.NewForConfig(cfg)
+	// the typed and dynamic interfaces share the http client of the manager
+	kube, err := kubernetes.NewForConfigAndClient(mgr.GetConfig(), mgr.GetHTTPClient())
 	if err != nil {
 		return nil, fmt.Errorf("unable to create kubernetes client: %w", err)
 	}
-	return sidecarManager{Manager: mgr, Interface: kube}, nil
+	dyn, err := dynamic.NewForConfigAndClient(mgr.GetConfig(), mgr.GetHTTPClient())
+	if err != nil {
+		return nil, fmt.Errorf("unable to create dynamic client: %w", err)
+	}
+	if err := mgr.AddHealthzCheck("ping", healthz.Ping); err != nil {
+		return nil, fmt.Errorf("unable to add healthz check: %w", err)
+	}
+	return sidecarManager{Manager: mgr, Interface: kube, dynamicClient: dyn}, nil
+}
+
+// managerOptions scopes the cache to the pod and its GameServer, they are selected by name in the namespace of the pod
+func managerOptions(sidecarConfig *api.SidecarConfig, pod types.NamespacedName, withGameServer bool) manager.Options {
+	byName := cache.ByObject{Field: fields.OneTermEqualSelector("metadata.name", pod.Name)}
+	byObject := map[client.Object]cache.ByObject{&corev1.Pod{}: byName}
+	if withGameServer {
+		gs := &unstructured.Unstructured{}
+		gs.SetGroupVersionKind(info.GameServerGVK)
+		byObject[gs] = byName
+	}
+	healthProbeAddress := ""
+	if sidecarConfig != nil {
+		healthProbeAddress = sidecarConfig.HealthProbeAddress
+	}
+	return manager.Options{
+		Cache: cache.Options{
+			DefaultNamespaces: map[string]cache.Config{pod.Namespace: {}},
+			ByObject:          byObject,
+		},
+		Metrics: metricsserver.Options{
+			// "0" disables the metrics server
+			BindAddress: sidecarConfig.GetAdminAddress(),
+			// the admin server has always served /healthz next to /metrics
+			ExtraHandlers: map[string]http.Handler{"/healthz": &healthz.Handler{Checks: map[string]healthz.Checker{"ping": healthz.Ping}}},
+		},
+		HealthProbeBindAddress: healthProbeAddress,
+	}
+}
+
+// gameServerInstalled returns false if the GameServer CRD of OpenKruiseGame is not installed
+func gameServerInstalled(client discovery.DiscoveryInterface) (bool, error) {
+	resources, err := client.ServerResourcesForGroupVersion(info.GameServerGVK.GroupVersion().String())
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to discover gameservers: %w", err)
+	}
+	for _, resource := range resources.APIResources {
+		if resource.Name == constants.GameServersResource {
+			return true, nil
+		}
+	}
+	return false, nil
 }
@@ -0,0 +1,98 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"testing"
+
+	"github.com/magicsong/kidecar/api"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestManagerOptions(t *testing.T) {
+	pod := types.NamespacedName{Namespace: "game", Name: "game-0"}
+	tests := []struct {
+		name               string
+		config             *api.SidecarConfig
+		withGameServer     bool
+		wantObjects        int
+		wantMetricsAddress string
+		wantHealthAddress  string
+	}{
+		{
+			name:               "default metrics address",
+			config:             &api.SidecarConfig{},
+			wantObjects:        1,
+			wantMetricsAddress: ":8080",
+		},
+		{
+			name:               "disabled metrics server",
+			config:             &api.SidecarConfig{AdminAddress: "0"},
+			wantObjects:        1,
+			wantMetricsAddress: "0",
+		},
+		{
+			name:               "admin and health probe address",
+			config:             &api.SidecarConfig{AdminAddress: ":9091", HealthProbeAddress: ":8081"},
+			withGameServer:     true,
+			wantObjects:        2,
+			wantMetricsAddress: ":9091",
+			wantHealthAddress:  ":8081",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := managerOptions(tt.config, pod, tt.withGameServer)
+			if _, ok := options.Cache.DefaultNamespaces["game"]; !ok || len(options.Cache.DefaultNamespaces) != 1 {
+				t.Errorf("Expected the cache scoped to namespace game, but got: %v", options.Cache.DefaultNamespaces)
+			}
+			if len(options.Cache.ByObject) != tt.wantObjects {
+				t.Errorf("Expected %d objects, but got %d", tt.wantObjects, len(options.Cache.ByObject))
+			}
+			for obj, byObject := range options.Cache.ByObject {
+				if selector := byObject.Field.String(); selector != "metadata.name=game-0" {
+					t.Errorf("Expected %T selected by name, but got: %s", obj, selector)
+				}
+			}
+			if options.Metrics.BindAddress != tt.wantMetricsAddress {
+				t.Errorf("Expected metrics address %q, but got %q", tt.wantMetricsAddress, options.Metrics.BindAddress)
+			}
+			if _, ok := options.Metrics.ExtraHandlers["/healthz"]; !ok {
+				t.Errorf("Expected /healthz served by the metrics server")
+			}
+			if options.HealthProbeBindAddress != tt.wantHealthAddress {
+				t.Errorf("Expected health probe address %q, but got %q", tt.wantHealthAddress, options.HealthProbeBindAddress)
+			}
+		})
+	}
+}
+
+func TestGameServerInstalled(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	if installed, err := gameServerInstalled(client.Discovery()); err != nil || installed {
+		t.Errorf("Expected gameservers not installed, but got %v, err: %v", installed, err)
+	}
+	client.Resources = []*metav1.APIResourceList{{
+		GroupVersion: "game.kruise.io/v1alpha1",
+		APIResources: []metav1.APIResource{{Name: "gameservers", Kind: "GameServer", Namespaced: true}},
+	}}
+	if installed, err := gameServerInstalled(client.Discovery()); err != nil || !installed {
+		t.Errorf("Expected gameservers installed, but got %v, err: %v", installed, err)
+	}
+}
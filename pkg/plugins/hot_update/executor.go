@@ -17,6 +17,10 @@ limitations under the License.
 package hot_update
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -27,14 +31,19 @@ import (
 	"strings"
 
 	"github.com/magicsong/kidecar/pkg/store"
+	"github.com/magicsong/kidecar/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/mod/semver"
-
-	"github.com/magicsong/kidecar/pkg/template"
 )
 
 func (h *hotUpdate) HotUpdateHandle(w http.ResponseWriter, r *http.Request) {
+	ctx, span := telemetry.Tracer().Start(r.Context(), "hot_update.HotUpdate")
+	var err error
+	defer func() { telemetry.EndSpan(span, err) }()
+	r = r.WithContext(ctx)
 
-	err := h.DownloadHotUpdateFile(w, r)
+	err = h.DownloadHotUpdateFile(w, r)
 	if err != nil {
 		h.log.Error(err, "Failed to download file")
 		return
@@ -45,10 +54,13 @@ func (h *hotUpdate) HotUpdateHandle(w http.ResponseWriter, r *http.Request) {
 	// According to the input Config, determine which way to trigger the update
 	switch h.config.LoadPatchType {
 	case LoadPatchTypeSignal:
-		err := h.LoadHotUpdateFileBySignal()
+		err := h.traceStep(ctx, "signal", h.LoadHotUpdateFileBySignal)
 		if err != nil {
 			h.log.Error(err, "Failed to load hot update file by signal")
 			h.result.Result = fmt.Sprintf("%s: Failed to load hot update file by signal: %s", h.result.Version, err)
+			if err := h.traceStep(ctx, "store", h.StoreData); err != nil {
+				h.log.Error(err, "Failed to store data")
+			}
 			return
 		}
 		w.WriteHeader(http.StatusOK)
@@ -62,13 +74,13 @@ func (h *hotUpdate) HotUpdateHandle(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	err = h.StoreData()
+	err = h.traceStep(ctx, "store", h.StoreData)
 	if err != nil {
 		h.log.Error(err, "Failed to store data")
 		return
 	}
 
-	err = h.StoreDataToConfigmap()
+	err = h.traceStep(ctx, "persist", h.StoreDataToConfigmap)
 	if err != nil {
 		h.log.Error(err, "failed to store data to configmap")
 		return
@@ -100,7 +112,7 @@ func (h *hotUpdate) DownloadHotUpdateFile(w http.ResponseWriter, r *http.Request
 	}
 	h.result.Url = url
 
-	err := h.DownloadFileByUrl()
+	err := h.traceStep(r.Context(), "download", h.DownloadFileByUrl)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "failed to download file: %v", err)
@@ -111,6 +123,7 @@ func (h *hotUpdate) DownloadHotUpdateFile(w http.ResponseWriter, r *http.Request
 }
 
 func (h *hotUpdate) DownloadFileByUrl() error {
+	h.result.Checksum = ""
 	// Check if the hot update file  exists, if not, create it
 	if _, err := os.Stat(FileDir); os.IsNotExist(err) {
 		err := os.MkdirAll(FileDir, 0755)
@@ -138,7 +151,10 @@ func (h *hotUpdate) DownloadFileByUrl() error {
 	}
 
 	// download file
-	resp, err := http.Get(h.result.Url)
+	for key, value := range h.expanded.Get().DownloadHeaders {
+		fileURL.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(fileURL)
 	if err != nil {
 		return fmt.Errorf("failed to download file: %w", err)
 	}
@@ -149,11 +165,14 @@ func (h *hotUpdate) DownloadFileByUrl() error {
 	if err != nil {
 		return fmt.Errorf("failed to create file: %w", err)
 	}
+	defer out.Close()
 
-	_, err = io.Copy(out, resp.Body)
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, hash), resp.Body)
 	if err != nil {
 		return fmt.Errorf("failed to save file: %w", err)
 	}
+	h.result.Checksum = hex.EncodeToString(hash.Sum(nil))
 
 	return nil
 }
@@ -198,12 +217,14 @@ func (h *hotUpdate) LoadHotUpdateFileByRequest() error {
 func (h *hotUpdate) StoreData() error {
 
 	h.log.Info("store update result, ", "result: ", h.result.Result)
-	err := template.ParseConfig(h.config.StorageConfig)
-	if err != nil {
-		return fmt.Errorf("failed to parse config: %v", err)
+	storageConfig := h.expanded.Get().StorageConfig
+	storageConfig.SetSource(store.DataSource{Plugin: pluginName, Endpoint: h.result.Url})
+	err := storageConfig.StoreData(h.StorageFactory, h.result.Result)
+	if errors.Is(err, store.ErrWriteQueued) {
+		h.log.Info("update result is queued and written once the api server is reachable", "reason", err.Error())
+		return nil
 	}
-
-	return h.config.StorageConfig.StoreData(h.StorageFactory, h.result.Result)
+	return err
 }
 
 func (h *hotUpdate) StoreDataToConfigmap() error {
@@ -214,6 +235,9 @@ func (h *hotUpdate) StoreDataToConfigmap() error {
 			h.result.Version: h.result.Url,
 		},
 	}
+	if h.result.Checksum != "" {
+		persistentResult.Checksums = map[string]string{h.result.Version: h.result.Checksum}
+	}
 
 	err := persistentResult.SetPersistenceInfo()
 	if err != nil {
@@ -223,12 +247,14 @@ func (h *hotUpdate) StoreDataToConfigmap() error {
 	return nil
 }
 
-func (h *hotUpdate) SetHotUpdateConfigWhenStart() error {
+func (h *hotUpdate) SetHotUpdateConfigWhenStart() (err error) {
+	ctx, span := telemetry.Tracer().Start(context.Background(), "hot_update.Restore")
+	defer func() { telemetry.EndSpan(span, err) }()
 
 	persistentResult := &store.PersistentConfig{
 		Type: pluginName,
 	}
-	err := persistentResult.GetPersistenceInfo()
+	err = persistentResult.GetPersistenceInfo()
 	if err != nil {
 		return fmt.Errorf("failed to GetPersistenceInfo of %v ", pluginName)
 	}
@@ -236,7 +262,7 @@ func (h *hotUpdate) SetHotUpdateConfigWhenStart() error {
 	if len(persistentResult.Result) == 0 {
 		h.result.Version = OriginVersion
 		h.result.Url = OriginUrl
-		err = h.StoreDataToConfigmap()
+		err = h.traceStep(ctx, "persist", h.StoreDataToConfigmap)
 		if err != nil {
 			return fmt.Errorf("failed to store data to configmap: %v", err)
 		}
@@ -247,7 +273,7 @@ func (h *hotUpdate) SetHotUpdateConfigWhenStart() error {
 	if len(persistentResult.Result) == 1 && persistentResult.Result[OriginVersion] == OriginUrl {
 		h.result.Version = OriginVersion
 		h.result.Url = OriginUrl
-		err = h.StoreDataToConfigmap()
+		err = h.traceStep(ctx, "persist", h.StoreDataToConfigmap)
 		if err != nil {
 			return fmt.Errorf("failed to store data to configmap: %v", err)
 		}
@@ -269,14 +295,14 @@ func (h *hotUpdate) SetHotUpdateConfigWhenStart() error {
 	h.result.Url = url
 
 	// down load
-	err = h.DownloadFileByUrl()
+	err = h.traceStep(ctx, "download", h.DownloadFileByUrl)
 	if err != nil {
 		return fmt.Errorf("failed to download file: %v", err)
 	}
 
 	switch h.config.LoadPatchType {
 	case LoadPatchTypeSignal:
-		err := h.LoadHotUpdateFileBySignal()
+		err := h.traceStep(ctx, "signal", h.LoadHotUpdateFileBySignal)
 		if err != nil {
 			h.log.Error(err, "Failed to load hot update file by signal")
 			h.result.Result = fmt.Sprintf("%s: Failed to load hot update file by signal: %s", h.result.Version, err)
@@ -291,14 +317,25 @@ func (h *hotUpdate) SetHotUpdateConfigWhenStart() error {
 		}
 	}
 
-	err = h.StoreData()
+	err = h.traceStep(ctx, "store", h.StoreData)
 	if err != nil {
 		return fmt.Errorf("failed to store data: %v", err)
 	}
 
-	err = h.StoreDataToConfigmap()
+	err = h.traceStep(ctx, "persist", h.StoreDataToConfigmap)
 	if err != nil {
 		return fmt.Errorf("failed to store data to configmap: %v", err)
 	}
 	return nil
 }
+
+// traceStep runs one step of the hot update in its own span
+func (h *hotUpdate) traceStep(ctx context.Context, step string, fn func() error) error {
+	_, span := telemetry.Tracer().Start(ctx, "hot_update."+step, trace.WithAttributes(
+		attribute.String("hot_update.version", h.result.Version),
+		attribute.String("hot_update.url", h.result.Url),
+	))
+	err := fn()
+	telemetry.EndSpan(span, err)
+	return err
+}
@@ -24,11 +24,14 @@ import (
 	"github.com/go-logr/logr"
 	"github.com/magicsong/kidecar/api"
 	"github.com/magicsong/kidecar/pkg/store"
+	"github.com/magicsong/kidecar/pkg/template"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 )
 
 type hotUpdate struct {
 	config HotUpdateConfig
+	// expanded is the config with the expressions expanded, refreshed when the pod changes
+	expanded *template.Expanded[HotUpdateConfig]
 	store.StorageFactory
 	status *HotUpdateStatus
 	result *HotUpdateResult
@@ -36,9 +39,10 @@ type hotUpdate struct {
 }
 
 type HotUpdateResult struct {
-	Result  string `json:"result"`
-	Version string `json:"version"`
-	Url     string `json:"url"`
+	Result   string `json:"result"`
+	Version  string `json:"version"`
+	Url      string `json:"url"`
+	Checksum string `json:"checksum,omitempty"` // sha256 of the downloaded file
 }
 
 type HotUpdateConfig struct {
@@ -46,6 +50,8 @@ type HotUpdateConfig struct {
 	Signal        Signal              `json:"signal,omitempty"`
 	Request       Request             `json:"request,omitempty"`
 	StorageConfig store.StorageConfig `json:"storageConfig,omitempty"`
+	// DownloadHeaders are set on the download requests, the values support expressions like ${SECRET:name/key}
+	DownloadHeaders map[string]string `json:"downloadHeaders,omitempty" parse:"true"`
 }
 
 // Signal ...
@@ -55,7 +61,7 @@ type Signal struct {
 }
 
 type Request struct {
-	Address string `json:"address"`
+	Address string `json:"address" parse:"true"`
 	Port    int    `json:"port"`
 }
 
@@ -78,6 +84,11 @@ func (h *hotUpdate) Init(config interface{}, mgr api.SidecarManager) error {
 	h.result = &HotUpdateResult{}
 	h.StorageFactory = store.NewStorageFactory(mgr)
 	h.log = logf.Log.WithName("hot-update")
+	h.expanded, err = template.NewExpanded(h.config)
+	if err != nil {
+		// the expressions may resolve later, e.g. once the GameServer is created
+		h.log.Error(err, "Failed to parse config of hot-update, use the raw config until it is expanded")
+	}
 	return nil
 }
 
@@ -92,8 +103,11 @@ func (h *hotUpdate) Start(ctx context.Context, errCh chan<- error) {
 		return
 	}
 
+	go h.expanded.RefreshOnPodChange(ctx, nil)
 	http.HandleFunc("/hot-update", h.HotUpdateHandle)
 
+	// ListenAndServe only returns on errors
+	h.status.setStatus("Running")
 	err = http.ListenAndServe(":5000", nil)
 	if err != nil {
 		h.log.Error(err, "Failed to start hot-update plugin")
@@ -101,7 +115,6 @@ func (h *hotUpdate) Start(ctx context.Context, errCh chan<- error) {
 		errCh <- err
 		return
 	}
-	h.status.setStatus("Running")
 }
 
 func (h *hotUpdate) Stop(ctx context.Context) error {
@@ -118,6 +131,7 @@ func (h *hotUpdate) Status() (*api.PluginStatus, error) {
 		Name:    pluginName,
 		Health:  h.status.getStatus(),
 		Running: h.status.getStatus() == "Running",
+		Infos:   store.StatusInfos(h.StorageFactory),
 	}, nil
 }
 
@@ -19,13 +19,15 @@ package httpprobe
 import "github.com/magicsong/kidecar/pkg/store"
 
 type EndpointConfig struct {
-	URL                string                `json:"url"`
+	URL                string                `json:"url" parse:"true"`
 	Method             string                `json:"method"`
-	Headers            map[string]string     `json:"headers"`
+	Headers            map[string]string     `json:"headers" parse:"true"`
 	Timeout            int                   `json:"timeout"`
 	ExpectedStatusCode int                   `json:"expectedStatusCode"`
 	StorageConfig      store.StorageConfig   `json:"storageConfig"`
 	JSONPathConfig     *store.JSONPathConfig `json:"jsonPathConfig"`
+	// ReassertOnDrift watches the stored data and stores the last probed value again when someone else changes it
+	ReassertOnDrift bool `json:"reassertOnDrift,omitempty"`
 }
 
 type HttpProbeConfig struct {
@@ -17,6 +17,7 @@ limitations under the License.
 package httpprobe
 
 import (
+	"context"
 	"fmt"
 	"github.com/tidwall/gjson"
 	"io"
@@ -24,13 +25,18 @@ import (
 	"time"
 
 	"github.com/magicsong/kidecar/pkg/store"
+	"github.com/magicsong/kidecar/pkg/telemetry"
 	"github.com/magicsong/kidecar/pkg/template"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Executor holds the HTTP client and provides methods for probing
 type Executor struct {
 	client *http.Client
 	store.StorageFactory
+	// onData is called with the probed data before it is stored
+	onData func(data string)
 }
 
 // NewExecutor creates a new Prober with the provided timeout
@@ -44,8 +50,13 @@ func NewExecutor(timeout int, factory store.StorageFactory) *Executor {
 }
 
 // Probe performs the HTTP request based on the provided configuration
-func (p *Executor) Probe(config EndpointConfig) error {
-	req, err := http.NewRequest(config.Method, config.URL, nil)
+func (p *Executor) Probe(ctx context.Context, config EndpointConfig) (err error) {
+	ctx, span := telemetry.Tracer().Start(ctx, "http_probe.Probe", trace.WithAttributes(
+		attribute.String("http.url", template.Redact(config.URL)),
+		attribute.String("http.method", config.Method),
+	))
+	defer func() { telemetry.EndSpan(span, err) }()
+	req, err := http.NewRequestWithContext(ctx, config.Method, config.URL, nil)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %v", err)
 	}
@@ -77,9 +88,13 @@ func (p *Executor) Probe(config EndpointConfig) error {
 	if err != nil {
 		return fmt.Errorf("failed to extract data: %v", err)
 	}
+	if p.onData != nil {
+		p.onData(data.(string))
+	}
 	// Store data
-	if err := p.storeData(data.(string), &config.StorageConfig); err != nil {
-		return fmt.Errorf("failed to store data: %v", err)
+	config.StorageConfig.SetSource(store.DataSource{Plugin: pluginName, Endpoint: template.Redact(config.URL)})
+	if err := p.storeData(ctx, data.(string), &config.StorageConfig); err != nil {
+		return fmt.Errorf("failed to store data: %w", err)
 	}
 	return nil
 }
@@ -91,12 +106,8 @@ func (p *Executor) extractData(data []byte, extractorConfig *store.JSONPathConfi
 	return string(data), nil
 }
 
-func (p *Executor) storeData(data string, storeConfig *store.StorageConfig) error {
-	err := template.ParseConfig(storeConfig)
-	if err != nil {
-		return fmt.Errorf("failed to parse config: %v", err)
-	}
-	return storeConfig.StoreData(p.StorageFactory, data)
+func (p *Executor) storeData(ctx context.Context, data string, storeConfig *store.StorageConfig) error {
+	return storeConfig.StoreDataWithContext(ctx, p.StorageFactory, data)
 }
 
 func getDataFromJsonText(json, path string) (interface{}, error) {
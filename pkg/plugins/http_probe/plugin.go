@@ -18,6 +18,7 @@ package httpprobe
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -25,6 +26,7 @@ import (
 	"github.com/go-logr/logr"
 	"github.com/magicsong/kidecar/api"
 	"github.com/magicsong/kidecar/pkg/store"
+	"github.com/magicsong/kidecar/pkg/template"
 	"k8s.io/client-go/util/retry"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 )
@@ -36,9 +38,13 @@ const (
 
 type httpProber struct {
 	config HttpProbeConfig
+	// expanded is the config with the expressions expanded, refreshed when the pod changes
+	expanded *template.Expanded[HttpProbeConfig]
 	store.StorageFactory
 	status *HttpProbeStatus
 	log    logr.Logger
+	// probed is the last probed data of every endpoint url
+	probed sync.Map
 }
 
 // GetConfigType implements api.Plugin.
@@ -62,6 +68,12 @@ func (h *httpProber) Init(config interface{}, mgr api.SidecarManager) error {
 	if h.config.StartDelaySeconds <= 0 {
 		h.config.StartDelaySeconds = 30
 	}
+	expanded, err := template.NewExpanded(h.config)
+	if err != nil {
+		// the expressions may resolve later, e.g. once the GameServer is created
+		h.log.Error(err, "Failed to parse config, probe with the raw config until it is expanded")
+	}
+	h.expanded = expanded
 	return nil
 }
 
@@ -85,7 +97,13 @@ func (h *httpProber) Start(ctx context.Context, errorCh chan<- error) {
 		}
 	}
 	h.log.Info("Starting http probe plugin")
-	reloadConfig := make(chan struct{})
+	reloadConfig := make(chan struct{}, 1)
+	go h.expanded.RefreshOnPodChange(ctx, func(HttpProbeConfig) {
+		select {
+		case reloadConfig <- struct{}{}:
+		default:
+		}
+	})
 	if len(h.config.Endpoints) == 0 {
 		h.log.Info("No endpoints to probe")
 		h.status.setStatus("Stopped")
@@ -97,7 +115,7 @@ func (h *httpProber) Start(ctx context.Context, errorCh chan<- error) {
 		ctxWithCancel, cancel := context.WithCancel(context.Background())
 		h.status.setStatus("Running")
 
-		for _, ep := range h.config.Endpoints {
+		for _, ep := range h.expanded.Get().Endpoints {
 			wg.Add(1)
 			h.status.incrementGoroutines()
 			go func(ec EndpointConfig) {
@@ -105,11 +123,18 @@ func (h *httpProber) Start(ctx context.Context, errorCh chan<- error) {
 				h.probeAndStore(ctxWithCancel, errorCh, ec)
 				h.status.decrementGoroutines()
 			}(ep)
+			if ep.ReassertOnDrift {
+				wg.Add(1)
+				go func(ec EndpointConfig) {
+					defer wg.Done()
+					h.reassertOnDrift(ctxWithCancel, ec)
+				}(ep)
+			}
 		}
 
 		select {
 		case <-reloadConfig:
-			fmt.Println("Received reload signal, restarting goroutines...")
+			h.log.Info("Config changed, restarting probes")
 			cancel()
 			wg.Wait()
 		case <-ctx.Done():
@@ -125,35 +150,59 @@ func (h *httpProber) probeAndStore(ctx context.Context, _ chan<- error, config E
 	for {
 		select {
 		case <-ctx.Done():
-			h.log.Info("Context cancelled, exiting", "endpoint", config.URL)
+			h.log.Info("Context cancelled, exiting", "endpoint", template.Redact(config.URL))
 			return
 		default:
-			h.log.Info("Probing", "endpoint", config.URL)
-			err := retry.OnError(retry.DefaultBackoff, func(err error) bool { return true }, func() error {
+			h.log.Info("Probing", "endpoint", template.Redact(config.URL))
+			// a queued write is replayed by the write queue, probing again would only supersede it
+			err := retry.OnError(retry.DefaultBackoff, func(err error) bool { return !errors.Is(err, store.ErrWriteQueued) }, func() error {
 				executor := NewExecutor(10, h.StorageFactory)
-				err := executor.Probe(config)
+				executor.onData = func(data string) { h.probed.Store(config.URL, data) }
+				err := executor.Probe(ctx, config)
 				if err != nil {
-					h.log.Error(err, "Failed to probe, retry again", "endpoint", config.URL)
+					h.log.Error(template.RedactError(err), "Failed to probe, retry again", "endpoint", template.Redact(config.URL))
 					return err
 				}
 				return nil
 			})
 			if err != nil {
-				h.log.Error(err, "Failed to probe", "endpoint", config.URL)
+				h.log.Error(template.RedactError(err), "Failed to probe", "endpoint", template.Redact(config.URL))
 			} else {
-				h.log.Info("Probed successfully", "endpoint", config.URL)
+				h.log.Info("Probed successfully", "endpoint", template.Redact(config.URL))
 			}
 			time.Sleep(time.Second * time.Duration(h.config.ProbeIntervalSeconds))
 		}
 	}
 }
 
+// reassertOnDrift stores the last probed data again whenever the stored data is changed by someone else,
+// for example an operator editing the opsState of the GameServer
+func (h *httpProber) reassertOnDrift(ctx context.Context, config EndpointConfig) {
+	endpoint := template.Redact(config.URL)
+	storageConfig := config.StorageConfig
+	err := storageConfig.WatchData(ctx, h.StorageFactory, func(data string) {
+		probed, ok := h.probed.Load(config.URL)
+		if !ok || probed.(string) == data {
+			return
+		}
+		h.log.Info("Stored data drifted, store the probed data again", "endpoint", endpoint, "stored", data, "probed", probed)
+		storageConfig.SetSource(store.DataSource{Plugin: pluginName, Endpoint: endpoint})
+		if err := storageConfig.StoreDataWithContext(ctx, h.StorageFactory, probed.(string)); err != nil {
+			h.log.Error(template.RedactError(err), "Failed to store the probed data again", "endpoint", endpoint)
+		}
+	})
+	if err != nil {
+		h.log.Error(template.RedactError(err), "Failed to watch stored data", "endpoint", endpoint)
+	}
+}
+
 // Status implements api.Plugin.
 func (h *httpProber) Status() (*api.PluginStatus, error) {
 	return &api.PluginStatus{
 		Name:    pluginName,
 		Health:  h.status.getStatus(),
 		Running: h.status.getStatus() == "Running",
+		Infos:   store.StatusInfos(h.StorageFactory),
 	}, nil
 }
 
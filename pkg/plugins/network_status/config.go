@@ -0,0 +1,40 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package networkstatus
+
+import "fmt"
+
+type NetworkStatusConfig struct {
+	// File is where the network status is written as json, usually in a volume shared with the game container
+	File string `json:"file,omitempty"`
+	// Address of the http server serving the network status, like :5001
+	Address string `json:"address,omitempty"`
+	// WaitForReady delays the file and the readiness of the plugin until the network is Ready
+	WaitForReady bool `json:"waitForReady,omitempty"`
+	// RefreshIntervalSeconds is how often the GameServer is read besides its change events, default is 5
+	RefreshIntervalSeconds int `json:"refreshIntervalSeconds,omitempty"`
+}
+
+func (c *NetworkStatusConfig) IsValid() error {
+	if c.File == "" && c.Address == "" {
+		return fmt.Errorf("file or address is required")
+	}
+	if c.RefreshIntervalSeconds < 0 {
+		return fmt.Errorf("refreshIntervalSeconds must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package networkstatus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/magicsong/kidecar/api"
+	"github.com/magicsong/kidecar/pkg/info"
+	"github.com/magicsong/kidecar/pkg/utils"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// pluginName is the name of the plugin.
+	pluginName = "network_status"
+
+	// StatusPath serves the network status of the GameServer as json
+	StatusPath = "/network-status"
+	// ReadyPath answers 200 once the network is Ready, for the startup probe of the sidecar
+	ReadyPath = "/network-status/ready"
+
+	defaultRefreshIntervalSeconds = 5
+
+	statusRunning = "Running"
+	statusWaiting = "WaitingForNetwork"
+	statusStopped = "Stopped"
+)
+
+type networkStatus struct {
+	config NetworkStatusConfig
+	log    logr.Logger
+
+	mu      sync.RWMutex
+	current *info.NetworkStatus
+	status  string
+	// written is the status in the file, nil if not written yet
+	written *info.NetworkStatus
+	// wasReady is set once the network has been Ready, waitForReady only holds back the first write
+	wasReady bool
+	// cancel stops the running Start
+	cancel context.CancelFunc
+}
+
+// GetConfigType implements api.Plugin.
+func (n *networkStatus) GetConfigType() interface{} {
+	return &NetworkStatusConfig{}
+}
+
+// Init implements api.Plugin.
+func (n *networkStatus) Init(config interface{}, mgr api.SidecarManager) error {
+	networkConfig, ok := config.(*NetworkStatusConfig)
+	if !ok {
+		return fmt.Errorf("invalid config type")
+	}
+	if err := networkConfig.IsValid(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	if info.IsStandalone() {
+		return fmt.Errorf("network status of the gameserver: %w", info.ErrStandalone)
+	}
+	n.config = *networkConfig
+	if n.config.RefreshIntervalSeconds == 0 {
+		n.config.RefreshIntervalSeconds = defaultRefreshIntervalSeconds
+	}
+	n.log = logf.Log.WithName(pluginName)
+	n.setStatus(statusStopped)
+	return nil
+}
+
+// Name implements api.Plugin.
+func (n *networkStatus) Name() string {
+	return pluginName
+}
+
+// Start implements api.Plugin.
+func (n *networkStatus) Start(ctx context.Context, errorCh chan<- error) {
+	n.log.Info("Starting network status plugin")
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	n.mu.Lock()
+	n.cancel = cancel
+	n.mu.Unlock()
+	if n.config.WaitForReady {
+		n.setStatus(statusWaiting)
+	} else {
+		n.setStatus(statusRunning)
+	}
+	if n.config.Address != "" {
+		server := &http.Server{Addr: n.config.Address, Handler: n.handler()}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				n.log.Error(err, "Failed to serve network status")
+				n.setStatus(statusStopped)
+				errorCh <- fmt.Errorf("failed to serve network status: %w", err)
+			}
+		}()
+		defer server.Close()
+	}
+
+	// changes of the cached GameServer trigger a refresh, the ticker covers a sidecar not allowed to watch it
+	changes := make(chan struct{}, 1)
+	unsubscribe := info.OnGameServerChange(func(*unstructured.Unstructured) {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	})
+	defer unsubscribe()
+	ticker := time.NewTicker(time.Duration(n.config.RefreshIntervalSeconds) * time.Second)
+	defer ticker.Stop()
+	for {
+		if err := n.refresh(ctx); err != nil {
+			n.log.Error(err, "Failed to refresh network status")
+		}
+		select {
+		case <-ctx.Done():
+			n.setStatus(statusStopped)
+			return
+		case <-changes:
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh reads the network status of the GameServer and writes the file when it changed
+func (n *networkStatus) refresh(ctx context.Context) error {
+	gs, err := info.GetGameServer(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get gameserver: %w", err)
+	}
+	status, err := gs.NetworkStatus()
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	n.current = status
+	if status.IsReady() && !n.wasReady {
+		n.log.Info("Network is ready", "networkType", status.NetworkType)
+		n.wasReady = true
+		if n.status == statusWaiting {
+			n.status = statusRunning
+		}
+	}
+	write := n.config.File != "" && status != nil && (!n.config.WaitForReady || n.wasReady) &&
+		(n.written == nil || !reflect.DeepEqual(n.written, status))
+	n.mu.Unlock()
+	if !write {
+		return nil
+	}
+	if err := writeStatusFile(n.config.File, status); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	n.written = status
+	n.mu.Unlock()
+	n.log.Info("Network status written", "file", n.config.File, "state", status.CurrentNetworkState)
+	return nil
+}
+
+func writeStatusFile(path string, status *info.NetworkStatus) error {
+	content, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal network status: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create dir of %s: %w", path, err)
+	}
+	return utils.WriteFileAtomic(path, append(content, '\n'))
+}
+
+func (n *networkStatus) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(StatusPath, func(w http.ResponseWriter, r *http.Request) {
+		n.mu.RLock()
+		status := n.current
+		n.mu.RUnlock()
+		if status == nil {
+			http.Error(w, "network status is not available", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	})
+	mux.HandleFunc(ReadyPath, func(w http.ResponseWriter, r *http.Request) {
+		n.mu.RLock()
+		ready := n.current.IsReady()
+		n.mu.RUnlock()
+		if !ready {
+			http.Error(w, "network is not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	return mux
+}
+
+func (n *networkStatus) setStatus(status string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.status = status
+}
+
+func (n *networkStatus) getStatus() string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.status
+}
+
+// Status implements api.Plugin, the plugin is running once the network is Ready if it waits for it.
+func (n *networkStatus) Status() (*api.PluginStatus, error) {
+	status := n.getStatus()
+	var infos []string
+	n.mu.RLock()
+	if n.current != nil {
+		infos = append(infos, fmt.Sprintf("network %s: %s", n.current.NetworkType, n.current.CurrentNetworkState))
+	}
+	n.mu.RUnlock()
+	return &api.PluginStatus{
+		Name:    pluginName,
+		Health:  status,
+		Running: status == statusRunning,
+		Infos:   infos,
+	}, nil
+}
+
+// Stop implements api.Plugin, it cancels the running Start.
+func (n *networkStatus) Stop(ctx context.Context) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.cancel != nil {
+		n.cancel()
+	}
+	return nil
+}
+
+// Version implements api.Plugin.
+func (n *networkStatus) Version() string {
+	return "v0.0.1"
+}
+
+func NewPlugin() api.Plugin {
+	return &networkStatus{}
+}
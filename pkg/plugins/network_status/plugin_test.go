@@ -0,0 +1,189 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package networkstatus
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/magicsong/kidecar/pkg/info"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func newGameServer(networkState string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "game.kruise.io/v1alpha1",
+		"kind":       "GameServer",
+		"metadata":   map[string]interface{}{"name": "game-0", "namespace": "default"},
+		"status": map[string]interface{}{
+			"networkStatus": map[string]interface{}{
+				"networkType":         "Kubernetes-HostPort",
+				"currentNetworkState": networkState,
+				"externalAddresses": []interface{}{map[string]interface{}{
+					"ip":    "47.1.2.3",
+					"ports": []interface{}{map[string]interface{}{"name": "game", "protocol": "TCP", "port": int64(30080)}},
+				}},
+			},
+		},
+	}}
+}
+
+func TestNetworkStatus_Refresh(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "game-0")
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), newGameServer(info.NetworkNotReady))
+	info.SetGlobalDynamicInterface(client)
+	defer info.SetGlobalDynamicInterface(nil)
+
+	file := filepath.Join(t.TempDir(), "network", "status.json")
+	plugin := NewPlugin().(*networkStatus)
+	if err := plugin.Init(&NetworkStatusConfig{File: file, Address: ":0", WaitForReady: true}, nil); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+	plugin.setStatus(statusWaiting)
+	handler := plugin.handler()
+	get := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder
+	}
+	if code := get(StatusPath).Code; code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 before the first refresh, but got %d", code)
+	}
+
+	ctx := context.Background()
+	if err := plugin.refresh(ctx); err != nil {
+		t.Fatalf("refresh() error = %v", err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("Expected no file before the network is ready, err: %v", err)
+	}
+	if status, _ := plugin.Status(); status.Running {
+		t.Errorf("Expected the plugin not running before the network is ready")
+	}
+	if code := get(ReadyPath).Code; code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 before the network is ready, but got %d", code)
+	}
+	if code := get(StatusPath).Code; code != http.StatusOK {
+		t.Errorf("Expected the status served before the network is ready, but got %d", code)
+	}
+
+	if _, err := client.Resource(info.GameServerGVR).Namespace("default").Update(ctx, newGameServer(info.NetworkReady), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := plugin.refresh(ctx); err != nil {
+		t.Fatalf("refresh() error = %v", err)
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Expected the file once the network is ready, err: %v", err)
+	}
+	written := &info.NetworkStatus{}
+	if err := json.Unmarshal(content, written); err != nil {
+		t.Fatal(err)
+	}
+	if !written.IsReady() || written.ExternalAddresses[0].IP != "47.1.2.3" || written.ExternalAddresses[0].Ports[0].Port.IntValue() != 30080 {
+		t.Errorf("Unexpected written status: %s", content)
+	}
+	if status, _ := plugin.Status(); !status.Running {
+		t.Errorf("Expected the plugin running once the network is ready")
+	}
+	if code := get(ReadyPath).Code; code != http.StatusOK {
+		t.Errorf("Expected 200 once the network is ready, but got %d", code)
+	}
+
+	// only the first write waits for the network
+	if _, err := client.Resource(info.GameServerGVR).Namespace("default").Update(ctx, newGameServer(info.NetworkNotReady), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := plugin.refresh(ctx); err != nil {
+		t.Fatalf("refresh() error = %v", err)
+	}
+	if content, err = os.ReadFile(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(content, written); err != nil {
+		t.Fatal(err)
+	}
+	if written.IsReady() {
+		t.Errorf("Expected the NotReady network written after it was ready, but got: %s", content)
+	}
+}
+
+func TestNetworkStatus_Stop(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "game-0")
+	info.SetGlobalDynamicInterface(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), newGameServer(info.NetworkReady)))
+	defer info.SetGlobalDynamicInterface(nil)
+
+	plugin := NewPlugin().(*networkStatus)
+	if err := plugin.Init(&NetworkStatusConfig{File: filepath.Join(t.TempDir(), "status.json")}, nil); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		plugin.Start(context.Background(), make(chan error, 1))
+		close(done)
+	}()
+	if err := wait.PollUntilContextTimeout(context.Background(), 10*time.Millisecond, 5*time.Second, true, func(context.Context) (bool, error) {
+		status, _ := plugin.Status()
+		return status.Running, nil
+	}); err != nil {
+		t.Fatalf("Plugin did not start: %v", err)
+	}
+	if err := plugin.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not return after Stop")
+	}
+	if status, _ := plugin.Status(); status.Running {
+		t.Errorf("Expected the plugin stopped")
+	}
+}
+
+func TestNetworkStatusConfig_IsValid(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  NetworkStatusConfig
+		wantErr bool
+	}{
+		{name: "file", config: NetworkStatusConfig{File: "/etc/network/status.json"}},
+		{name: "address", config: NetworkStatusConfig{Address: ":5001"}},
+		{name: "empty", config: NetworkStatusConfig{}, wantErr: true},
+		{name: "negative interval", config: NetworkStatusConfig{File: "status.json", RefreshIntervalSeconds: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.IsValid(); (err != nil) != tt.wantErr {
+				t.Errorf("IsValid() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"github.com/magicsong/kidecar/api"
 	"github.com/magicsong/kidecar/pkg/plugins/hot_update"
 	httpprobe "github.com/magicsong/kidecar/pkg/plugins/http_probe"
+	networkstatus "github.com/magicsong/kidecar/pkg/plugins/network_status"
 )
 
 var PluginRegistry = make(map[string]api.Plugin)
@@ -34,4 +35,5 @@ func RegisterPlugin(plugin api.Plugin) {
 func init() {
 	RegisterPlugin(httpprobe.NewPlugin())
 	RegisterPlugin(hot_update.NewPlugin())
+	RegisterPlugin(networkstatus.NewPlugin())
 }
@@ -0,0 +1,170 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/magicsong/kidecar/pkg/template"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+type TargetPolicy string
+
+const (
+	// TargetPolicyRequired fails the store operation when the target fails, it is the default
+	TargetPolicyRequired TargetPolicy = "Required"
+	// TargetPolicyBestEffort logs the failure and continues with the other targets
+	TargetPolicyBestEffort TargetPolicy = "BestEffort"
+	// TargetPolicyAsync writes to the target in the background
+	TargetPolicyAsync TargetPolicy = "Async"
+)
+
+// CompositeConfig writes one value to several storages
+type CompositeConfig struct {
+	Targets []CompositeTarget `json:"targets"`
+}
+
+// CompositeTarget is a storage of the composite with its failure policy
+type CompositeTarget struct {
+	Policy TargetPolicy `json:"policy,omitempty"`
+	StorageConfig
+}
+
+// TargetResult is the outcome of the last write to a target of a composite storage
+type TargetResult struct {
+	Name   string       `json:"name"`
+	Source DataSource   `json:"source"`
+	Policy TargetPolicy `json:"policy"`
+	Error  string       `json:"error,omitempty"`
+	Time   time.Time    `json:"time"`
+}
+
+// key identifies the target, the endpoints of a plugin share the factory but have their own targets
+func (r TargetResult) key() string {
+	return r.Source.Plugin + "|" + r.Source.Endpoint + "|" + r.Name
+}
+
+func (r TargetResult) String() string {
+	name := r.Name
+	if r.Source.Endpoint != "" {
+		name = r.Source.Endpoint + " " + name
+	}
+	if r.Error != "" {
+		return fmt.Sprintf("storage %s (%s): failed: %s", name, r.Policy, r.Error)
+	}
+	return fmt.Sprintf("storage %s (%s): ok", name, r.Policy)
+}
+
+// targetResults keeps the last result of every composite target written through a factory
+type targetResults struct {
+	mu      sync.Mutex
+	results map[string]TargetResult
+}
+
+func (t *targetResults) RecordResult(result TargetResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.results == nil {
+		t.results = make(map[string]TargetResult)
+	}
+	t.results[result.key()] = result
+}
+
+func (t *targetResults) TargetResults() []TargetResult {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	results := make([]TargetResult, 0, len(t.results))
+	for _, r := range t.results {
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].key() < results[j].key() })
+	return results
+}
+
+func (c *CompositeConfig) IsValid() error {
+	if len(c.Targets) == 0 {
+		return fmt.Errorf("composite has no targets")
+	}
+	for i, t := range c.Targets {
+		switch t.Policy {
+		case "", TargetPolicyRequired, TargetPolicyBestEffort, TargetPolicyAsync:
+		default:
+			return fmt.Errorf("invalid policy %s of target %d", t.Policy, i)
+		}
+		if t.Type == StorageTypeComposite {
+			return fmt.Errorf("target %d: nested composite is not supported", i)
+		}
+	}
+	return nil
+}
+
+func (t *CompositeTarget) policy() TargetPolicy {
+	if t.Policy == "" {
+		return TargetPolicyRequired
+	}
+	return t.Policy
+}
+
+// storeComposite writes the data to every target in order, async targets are written in the background
+func (s *StorageConfig) storeComposite(ctx context.Context, factory StorageFactory, data string) error {
+	if s.Composite == nil {
+		return fmt.Errorf("composite config is empty")
+	}
+	if err := s.Composite.IsValid(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	log := logf.Log.WithName("composite_storage")
+	var errs []error
+	for i := range s.Composite.Targets {
+		target := s.Composite.Targets[i]
+		target.source = s.source
+		name := fmt.Sprintf("%d/%s", i, target.Type)
+		policy := target.policy()
+		store := func(ctx context.Context) error {
+			err := target.StoreDataWithContext(ctx, factory, data)
+			result := TargetResult{Name: name, Source: s.source, Policy: policy, Time: time.Now()}
+			if err != nil {
+				result.Error = template.Redact(err.Error())
+			}
+			factory.RecordResult(result)
+			return err
+		}
+		switch policy {
+		case TargetPolicyAsync:
+			go func() {
+				if err := store(context.WithoutCancel(ctx)); err != nil {
+					log.Error(template.RedactError(err), "failed to store data to async target", "target", name)
+				}
+			}()
+		case TargetPolicyBestEffort:
+			if err := store(ctx); err != nil {
+				log.Error(template.RedactError(err), "failed to store data to best effort target", "target", name)
+			}
+		default:
+			if err := store(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("target %s: %w", name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
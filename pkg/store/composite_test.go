@@ -0,0 +1,110 @@
+/*
+Copyright 2024
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type mapFactory struct {
+	fakeFactory
+	storages map[StorageType]Storage
+}
+
+func (f *mapFactory) GetStorage(storageType StorageType) (Storage, error) {
+	return f.storages[storageType], nil
+}
+
+func TestStorageConfig_StoreComposite(t *testing.T) {
+	var config StorageConfig
+	raw := `{"type":"Composite","composite":{"targets":[
+		{"type":"Webhook","webhook":{"url":"http://hook"}},
+		{"policy":"BestEffort","type":"File","file":{"path":"/tmp/result"}},
+		{"policy":"Async","type":"StatsD","statsD":{"address":"127.0.0.1:8125","metricName":"m"}}]}}`
+	if err := json.Unmarshal([]byte(raw), &config); err != nil {
+		t.Fatalf("failed to unmarshal config: %v", err)
+	}
+
+	required, bestEffort, async := &fakeStorage{}, &fakeStorage{err: fmt.Errorf("disk full")}, &fakeStorage{}
+	factory := &mapFactory{storages: map[StorageType]Storage{
+		StorageTypeWebhook: required,
+		StorageTypeFile:    bestEffort,
+		StorageTypeStatsD:  async,
+	}}
+	if err := config.StoreData(factory, "Allocated"); err != nil {
+		t.Fatalf("StoreData() should ignore best effort failures, got %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(async.getStored()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(required.getStored()) != 1 || len(async.getStored()) != 1 {
+		t.Errorf("expected required and async targets to be written, got %v and %v", required.getStored(), async.getStored())
+	}
+	results := factory.TargetResults()
+	if len(results) != 3 {
+		t.Fatalf("expected 3 target results, got %v", results)
+	}
+	if results[0].Error != "" || results[1].Error != "disk full" || results[1].Policy != TargetPolicyBestEffort {
+		t.Errorf("unexpected target results %v", results)
+	}
+
+	required.setErr(fmt.Errorf("unavailable"))
+	if err := config.StoreData(factory, "Allocated"); err == nil {
+		t.Errorf("StoreData() should fail when a required target fails")
+	}
+}
+
+func TestStorageConfig_StoreCompositeResultsPerEndpoint(t *testing.T) {
+	factory := &mapFactory{storages: map[StorageType]Storage{StorageTypeFile: &fakeStorage{}}}
+	for _, endpoint := range []string{"http://a", "http://b"} {
+		config := StorageConfig{Type: StorageTypeComposite, Composite: &CompositeConfig{Targets: []CompositeTarget{
+			{StorageConfig: StorageConfig{Type: StorageTypeFile, File: &FileConfig{Path: "/tmp/result"}}},
+		}}}
+		config.SetSource(DataSource{Plugin: "http_probe", Endpoint: endpoint})
+		if err := config.StoreData(factory, "Allocated"); err != nil {
+			t.Fatalf("StoreData() error = %v", err)
+		}
+	}
+	results := factory.TargetResults()
+	if len(results) != 2 || results[0].Source.Endpoint != "http://a" || results[1].Source.Endpoint != "http://b" {
+		t.Errorf("expected one result per endpoint, got %v", results)
+	}
+}
+
+func TestCompositeConfig_IsValid(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  CompositeConfig
+		wantErr bool
+	}{
+		{"Empty", CompositeConfig{}, true},
+		{"BadPolicy", CompositeConfig{Targets: []CompositeTarget{{Policy: "Sometimes"}}}, true},
+		{"Nested", CompositeConfig{Targets: []CompositeTarget{{StorageConfig: StorageConfig{Type: StorageTypeComposite}}}}, true},
+		{"Valid", CompositeConfig{Targets: []CompositeTarget{{Policy: TargetPolicyAsync, StorageConfig: StorageConfig{Type: StorageTypeFile}}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.IsValid(); (err != nil) != tt.wantErr {
+				t.Errorf("IsValid() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -17,9 +17,22 @@ limitations under the License.
 package store
 
 import (
+	"context"
 	"fmt"
+	"slices"
+	"sort"
+	"strings"
 
+	"github.com/magicsong/kidecar/api"
+	"github.com/magicsong/kidecar/pkg/info"
+	"github.com/magicsong/kidecar/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 type StorageType string
@@ -28,6 +41,18 @@ const (
 	// StorageTypeInKube represent store in kube object
 	StorageTypeInKube     StorageType = "InKube"
 	StorageTypeHTTPMetric StorageType = "HTTPMetric"
+	// StorageTypeWebhook represent post data to an external http endpoint
+	StorageTypeWebhook StorageType = "Webhook"
+	// StorageTypeKubeEvent represent record data as kube events
+	StorageTypeKubeEvent StorageType = "KubeEvent"
+	// StorageTypeFile represent write data to a local file
+	StorageTypeFile StorageType = "File"
+	// StorageTypeOTLP represent export data as OpenTelemetry metrics
+	StorageTypeOTLP StorageType = "OTLP"
+	// StorageTypeStatsD represent send data to a statsd server over udp
+	StorageTypeStatsD StorageType = "StatsD"
+	// StorageTypeComposite represent store data in several storages
+	StorageTypeComposite StorageType = "Composite"
 )
 
 // InKubeConfig is the configuration for storing data in kube object
@@ -49,17 +74,111 @@ type TargetKubeObject struct {
 	Version   string `json:"version"`
 	Resource  string `json:"resource"`
 	Namespace string `json:"namespace,omitempty" parse:"true"`
-	Name      string `json:"name" parse:"true"`
+	Name      string `json:"name,omitempty" parse:"true"`
 	PodOwner  bool   `json:"podOwner,omitempty"` // Whether it is the owner of the Pod
+	// LabelSelector selects all matched objects in the namespace as targets
+	LabelSelector *metav1.LabelSelector `json:"labelSelector,omitempty"`
 }
 type HTTPMetricConfig struct {
 	MetricName string `json:"metricName"`
+	// Type is Gauge, Counter or Histogram, default is Gauge.
+	// A Counter expects the data to be a running total and grows by the increase since the last value.
+	Type        string            `json:"type,omitempty"`
+	Help        string            `json:"help,omitempty"`
+	ConstLabels map[string]string `json:"constLabels,omitempty"`
+	// Labels are dynamic labels, the values support expressions like ${SELF:POD_NAME}
+	Labels map[string]string `json:"labels,omitempty" parse:"true"`
+	// LabelJSONPaths are dynamic labels extracted from the json data
+	LabelJSONPaths map[string]string `json:"labelJsonPaths,omitempty"`
+	// ValueJSONPath extracts the value from the json data, empty means the data is the value
+	ValueJSONPath string    `json:"valueJsonPath,omitempty"`
+	Buckets       []float64 `json:"buckets,omitempty"` // Buckets of Histogram
+}
+
+// WebhookConfig is the configuration for posting data to an external http endpoint
+type WebhookConfig struct {
+	URL            string            `json:"url" parse:"true"`
+	Headers        map[string]string `json:"headers,omitempty" parse:"true"`
+	SigningSecret  string            `json:"signingSecret,omitempty" parse:"true"` // HMAC-SHA256 key used to sign the request body
+	TimeoutSeconds int               `json:"timeoutSeconds,omitempty"`
+	Retries        int               `json:"retries,omitempty"`
+	// inner field
+	source DataSource
+}
+
+// KubeEventConfig is the configuration for recording data as kube events
+type KubeEventConfig struct {
+	// Target is the involved object of the events, Pod or GameServer, default is Pod
+	Target   string        `json:"target,omitempty"`
+	Policies []EventPolicy `json:"policies,omitempty"`
+	// inner field
+	source DataSource
+}
+
+// EventPolicy decides the event recorded for a state
+type EventPolicy struct {
+	// State is the value the policy applies to, empty means all values without their own policy
+	State  string `json:"state,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Type is Normal or Warning, default is Normal
+	Type string `json:"type,omitempty"`
+	// Message is a go template, .Value, .Plugin and .Endpoint are available, default is the value
+	Message string `json:"message,omitempty"`
+}
+
+// FileConfig is the configuration for writing data to a local file, usually on a shared emptyDir
+type FileConfig struct {
+	Path string `json:"path" parse:"true"`
+	// Mode is Latest or History, default is Latest
+	Mode string `json:"mode,omitempty"`
+	// MaxRecords limits the lines kept in History mode, 0 means unlimited
+	MaxRecords int `json:"maxRecords,omitempty"`
+	// inner field
+	source DataSource
+}
+
+// OTLPStorageConfig is the configuration for exporting data as an OpenTelemetry gauge
+type OTLPStorageConfig struct {
+	api.OTLPConfig
+	MetricName  string            `json:"metricName"`
+	Description string            `json:"description,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	// inner field
+	source DataSource
+}
+
+// DataSource describes where the stored data comes from
+type DataSource struct {
+	Plugin   string `json:"plugin,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// StatsDConfig is the configuration for sending data to a statsd or dogstatsd server
+type StatsDConfig struct {
+	Address    string `json:"address"` // host:port of the udp server
+	Prefix     string `json:"prefix,omitempty"`
+	MetricName string `json:"metricName"`
+	// Type is Gauge, Counter or Timing, default is Gauge
+	Type       string  `json:"type,omitempty"`
+	SampleRate float64 `json:"sampleRate,omitempty"`
+	// DogStatsD appends tags, the pod name and namespace are always tagged
+	DogStatsD bool `json:"dogStatsD,omitempty"`
+	// Tags values support expressions like ${SELF:POD_NAME}
+	Tags map[string]string `json:"tags,omitempty"`
 }
 
 type StorageConfig struct {
-	Type       StorageType       `json:"type"`
-	InKube     *InKubeConfig     `json:"inKube,omitempty"`
-	HTTPMetric *HTTPMetricConfig `json:"httpMetric,omitempty"`
+	Type       StorageType        `json:"type"`
+	InKube     *InKubeConfig      `json:"inKube,omitempty"`
+	HTTPMetric *HTTPMetricConfig  `json:"httpMetric,omitempty"`
+	Webhook    *WebhookConfig     `json:"webhook,omitempty"`
+	KubeEvent  *KubeEventConfig   `json:"kubeEvent,omitempty"`
+	File       *FileConfig        `json:"file,omitempty"`
+	OTLP       *OTLPStorageConfig `json:"otlp,omitempty"`
+	StatsD     *StatsDConfig      `json:"statsD,omitempty"`
+	Composite  *CompositeConfig   `json:"composite,omitempty"`
+	// inner field
+	source DataSource
 }
 
 // ProbeMarkerPolicy convert prob value to user defined values
@@ -71,9 +190,9 @@ type ProbeMarkerPolicy struct {
 	State              string `json:"state"`
 	GameServerOpsState string `json:"gameServerOpsState"`
 	// Patch Labels pod.labels
-	Labels map[string]string `json:"labels,omitempty"`
+	Labels map[string]string `json:"labels,omitempty" parse:"true"`
 	// Patch annotations pod.annotations
-	Annotations map[string]string `json:"annotations,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty" parse:"true"`
 	// Patch JSONPath
 	JsonPathConfigs []JSONPathConfig `json:"jsonPathConfigs,omitempty"`
 }
@@ -87,18 +206,215 @@ type JSONPathConfig struct {
 }
 
 func (s *StorageConfig) StoreData(factory StorageFactory, data string) error {
+	return s.StoreDataWithContext(context.Background(), factory, data)
+}
+
+// StoreDataWithContext is StoreData, the write is traced as a child of the span in the context
+func (s *StorageConfig) StoreDataWithContext(ctx context.Context, factory StorageFactory, data string) error {
+	if s.Type == StorageTypeComposite {
+		return s.storeComposite(ctx, factory, data)
+	}
+	queue := factory.WriteQueue()
+	if queue == nil || s.Type != StorageTypeInKube {
+		return s.storeDirect(ctx, factory, data)
+	}
+	if s.InKube == nil {
+		return fmt.Errorf("inKube config is empty")
+	}
+	if err := s.InKube.IsValid(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	key, err := s.queueKey()
+	if err != nil {
+		return err
+	}
+	// an older write for the same target is still pending, so this one must be replayed after it
+	if queue.HasPending(key) {
+		if err := queue.Enqueue(key, s, data); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: an older write of the target is pending", ErrWriteQueued)
+	}
+	err = s.storeDirect(ctx, factory, data)
+	if err != nil && isRetryable(err) {
+		if qerr := queue.Enqueue(key, s, data); qerr != nil {
+			return fmt.Errorf("failed to enqueue write after error %v: %w", err, qerr)
+		}
+		return fmt.Errorf("%w: %w", ErrWriteQueued, err)
+	}
+	return err
+}
+
+func (s *StorageConfig) storeDirect(ctx context.Context, factory StorageFactory, data string) (err error) {
+	ctx, span := telemetry.Tracer().Start(ctx, "store."+string(s.Type), trace.WithAttributes(
+		attribute.String("kidecar.plugin", s.source.Plugin),
+		attribute.String("kidecar.endpoint", s.source.Endpoint),
+	))
+	defer func() { telemetry.EndSpan(span, err) }()
 	storage, err := factory.GetStorage(s.Type)
 	if err != nil {
 		return fmt.Errorf("failed to get storage: %w", err)
 	}
+	// the source is set on copies, the config may be shared by concurrent writes
+	var config interface{}
 	switch s.Type {
 	case StorageTypeInKube:
-		return storage.Store(data, s.InKube)
+		config = s.InKube
 	case StorageTypeHTTPMetric:
-		return storage.Store(data, s.HTTPMetric)
+		config = s.HTTPMetric
+	case StorageTypeWebhook:
+		config = s.Webhook
+		if s.Webhook != nil {
+			c := *s.Webhook
+			c.source = s.source
+			config = &c
+		}
+	case StorageTypeKubeEvent:
+		config = s.KubeEvent
+		if s.KubeEvent != nil {
+			c := *s.KubeEvent
+			c.source = s.source
+			config = &c
+		}
+	case StorageTypeFile:
+		config = s.File
+		if s.File != nil {
+			c := *s.File
+			c.source = s.source
+			config = &c
+		}
+	case StorageTypeOTLP:
+		config = s.OTLP
+		if s.OTLP != nil {
+			c := *s.OTLP
+			c.source = s.source
+			config = &c
+		}
+	case StorageTypeStatsD:
+		config = s.StatsD
 	default:
 		return fmt.Errorf("unsupported storage type: %s", s.Type)
 	}
+	if cs, ok := storage.(ContextStorage); ok {
+		return cs.StoreWithContext(ctx, data, config)
+	}
+	return storage.Store(data, config)
+}
+
+// SetSource records the plugin and endpoint the stored data comes from
+func (s *StorageConfig) SetSource(source DataSource) {
+	s.source = source
+}
+
+// queueKey identifies the objects and fields of an InKube write, writes with the same key supersede each other.
+// It is built from the resolved pod and the target of the config, so writers with different configs writing
+// the same fields of the same objects share a key.
+func (s *StorageConfig) queueKey() (string, error) {
+	pod, err := info.GetCurrentPodNamespaceAndName()
+	if err != nil {
+		return "", err
+	}
+	c := s.InKube
+	var targets []string
+	if fields := c.podFields(); len(fields) > 0 {
+		targets = append(targets, writeTarget(podGvr, pod.String(), fields))
+	}
+	if c.writesGameServer() {
+		fields := append(c.patchFields(), "/spec/opsState")
+		targets = append(targets, writeTarget(gameServerGvr, pod.String(), fields))
+	}
+	if c.Target != nil && len(c.MarkerPolices) > 0 {
+		targets = append(targets, writeTarget(c.Target.ToGvr(), c.Target.queueName(*pod), c.patchFields()))
+	}
+	return strings.Join(targets, ";"), nil
+}
+
+// writeTarget formats an object and the sorted fields written to it
+func writeTarget(gvr schema.GroupVersionResource, name string, fields []string) string {
+	sort.Strings(fields)
+	return fmt.Sprintf("%s/%s[%s]", gvr.String(), name, strings.Join(fields, ","))
+}
+
+// queueName is the namespace and name of the target, or how the target is selected if the name is not static
+func (t *TargetKubeObject) queueName(pod types.NamespacedName) string {
+	namespace := t.Namespace
+	if namespace == "" || t.PodOwner {
+		namespace = pod.Namespace
+	}
+	switch {
+	case t.PodOwner:
+		return fmt.Sprintf("%s/ownerOf=%s", namespace, pod.Name)
+	case t.LabelSelector != nil:
+		return fmt.Sprintf("%s/selector=%s", namespace, metav1.FormatLabelSelector(t.LabelSelector))
+	}
+	return namespace + "/" + t.Name
+}
+
+// podFields are the fields storeInCurrentPod may write for any state
+func (c *InKubeConfig) podFields() []string {
+	if c.AnnotationKey == nil && c.LabelKey == nil {
+		if len(c.MarkerPolices) == 0 {
+			return nil
+		}
+		for _, m := range c.MarkerPolices {
+			if m.GameServerOpsState != "" {
+				return nil
+			}
+		}
+	}
+	return c.metadataFields()
+}
+
+// writesGameServer reports whether storeProbeInGameServer writes the GameServer of the pod
+func (c *InKubeConfig) writesGameServer() bool {
+	if len(c.MarkerPolices) == 0 {
+		return false
+	}
+	for _, policy := range c.MarkerPolices {
+		if policy.GameServerOpsState == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// patchFields are the paths generatePatch may write for any state
+func (c *InKubeConfig) patchFields() []string {
+	fields := c.metadataFields()
+	for _, policy := range c.MarkerPolices {
+		for _, jsonPath := range policy.JsonPathConfigs {
+			fields = append(fields, jsonPath.JSONPath)
+		}
+	}
+	if c.JsonPath != nil {
+		fields = append(fields, *c.JsonPath)
+	}
+	return uniqueFields(fields)
+}
+
+// metadataFields are the paths of the annotations and labels written for any state
+func (c *InKubeConfig) metadataFields() []string {
+	var fields []string
+	if c.AnnotationKey != nil {
+		fields = append(fields, "/metadata/annotations/"+rfc6901Encoder.Replace(*c.AnnotationKey))
+	}
+	if c.LabelKey != nil {
+		fields = append(fields, "/metadata/labels/"+rfc6901Encoder.Replace(*c.LabelKey))
+	}
+	for _, policy := range c.MarkerPolices {
+		for key := range policy.Annotations {
+			fields = append(fields, "/metadata/annotations/"+rfc6901Encoder.Replace(key))
+		}
+		for key := range policy.Labels {
+			fields = append(fields, "/metadata/labels/"+rfc6901Encoder.Replace(key))
+		}
+	}
+	return uniqueFields(fields)
+}
+
+func uniqueFields(fields []string) []string {
+	sort.Strings(fields)
+	return slices.Compact(fields)
 }
 
 func (t *TargetKubeObject) IsValid() error {
@@ -108,8 +424,21 @@ func (t *TargetKubeObject) IsValid() error {
 	if t.Resource == "" {
 		return fmt.Errorf("invalid resource")
 	}
-	if t.Name == "" {
-		return fmt.Errorf("invalid name")
+	set := 0
+	if t.Name != "" {
+		set++
+	}
+	if t.PodOwner {
+		set++
+	}
+	if t.LabelSelector != nil {
+		set++
+	}
+	if set == 0 {
+		return fmt.Errorf("one of name, podOwner or labelSelector must be set")
+	}
+	if set > 1 {
+		return fmt.Errorf("name, podOwner and labelSelector are mutually exclusive")
 	}
 	return nil
 }
@@ -122,6 +451,96 @@ func (t *TargetKubeObject) ToGvr() schema.GroupVersionResource {
 	}
 }
 
+func (c *HTTPMetricConfig) IsValid() error {
+	if c.MetricName == "" {
+		return fmt.Errorf("invalid metricName")
+	}
+	switch c.Type {
+	case "", MetricTypeGauge, MetricTypeCounter, MetricTypeHistogram:
+	default:
+		return fmt.Errorf("invalid metric type %s", c.Type)
+	}
+	for name := range c.Labels {
+		if _, ok := c.LabelJSONPaths[name]; ok {
+			return fmt.Errorf("label %s is defined twice", name)
+		}
+	}
+	return nil
+}
+
+func (c *WebhookConfig) IsValid() error {
+	if c.URL == "" {
+		return fmt.Errorf("invalid url")
+	}
+	if c.Retries < 0 {
+		return fmt.Errorf("invalid retries")
+	}
+	return nil
+}
+
+func (c *StatsDConfig) IsValid() error {
+	if c.Address == "" {
+		return fmt.Errorf("invalid address")
+	}
+	if c.MetricName == "" {
+		return fmt.Errorf("invalid metricName")
+	}
+	if _, ok := statsDTypeSuffix[c.Type]; c.Type != "" && !ok {
+		return fmt.Errorf("invalid statsd type %s", c.Type)
+	}
+	return nil
+}
+
+func (c *OTLPStorageConfig) IsValid() error {
+	if c.Endpoint == "" {
+		return fmt.Errorf("invalid endpoint")
+	}
+	if c.MetricName == "" {
+		return fmt.Errorf("invalid metricName")
+	}
+	return nil
+}
+
+func (c *FileConfig) IsValid() error {
+	if c.Path == "" {
+		return fmt.Errorf("invalid path")
+	}
+	if c.Mode != "" && c.Mode != FileModeLatest && c.Mode != FileModeHistory {
+		return fmt.Errorf("invalid mode %s", c.Mode)
+	}
+	return nil
+}
+
+func (c *KubeEventConfig) IsValid() error {
+	if c.Target != "" && c.Target != EventTargetPod && c.Target != EventTargetGameServer {
+		return fmt.Errorf("invalid target %s", c.Target)
+	}
+	for _, p := range c.Policies {
+		if p.Type != "" && p.Type != corev1.EventTypeNormal && p.Type != corev1.EventTypeWarning {
+			return fmt.Errorf("invalid event type %s", p.Type)
+		}
+	}
+	return nil
+}
+
+// GetPolicyOfState returns the policy of the state, falling back to the policy without state.
+// Without any policy a Normal event is recorded for every value.
+func (c *KubeEventConfig) GetPolicyOfState(state string) (*EventPolicy, bool) {
+	if len(c.Policies) == 0 {
+		return &EventPolicy{}, true
+	}
+	var fallback *EventPolicy
+	for i := range c.Policies {
+		if c.Policies[i].State == state {
+			return &c.Policies[i], true
+		}
+		if c.Policies[i].State == "" && fallback == nil {
+			fallback = &c.Policies[i]
+		}
+	}
+	return fallback, fallback != nil
+}
+
 func (c *InKubeConfig) IsValid() error {
 	if c.Target != nil {
 		if err := c.Target.IsValid(); err != nil {
@@ -20,29 +20,63 @@ import (
 	"fmt"
 
 	"github.com/magicsong/kidecar/api"
+	"github.com/magicsong/kidecar/pkg/info"
 )
 
 type StorageFactory interface {
 	GetStorage(storageType StorageType) (Storage, error)
+	// WriteQueue returns the queue of failed writes, nil if it is disabled
+	WriteQueue() *WriteQueue
+	// PendingWrites returns the number of writes waiting to be replayed
+	PendingWrites() int
+	// RecordResult keeps the result of a write to a composite target
+	RecordResult(result TargetResult)
+	// TargetResults returns the last result of every composite target
+	TargetResults() []TargetResult
 }
 
 type defaultStorageFactory struct {
 	storageMap map[StorageType]Storage
 	manager    api.SidecarManager
+	queue      *WriteQueue
+	targetResults
 }
 
 func NewStorageFactory(mgr api.SidecarManager) StorageFactory {
 	f := &defaultStorageFactory{
 		storageMap: make(map[StorageType]Storage),
 	}
-	f.storageMap[StorageTypeInKube] = &inKube{}
+	// storages writing to the API server are not available in standalone mode
+	if !info.IsStandalone() {
+		f.storageMap[StorageTypeInKube] = &inKube{}
+		f.storageMap[StorageTypeKubeEvent] = &kubeEvent{}
+	}
 	f.storageMap[StorageTypeHTTPMetric] = &promMetric{}
+	f.storageMap[StorageTypeWebhook] = &webhook{}
+	f.storageMap[StorageTypeFile] = &file{}
+	f.storageMap[StorageTypeOTLP] = &otlp{}
+	f.storageMap[StorageTypeStatsD] = &statsD{}
 	f.manager = mgr
+	f.queue = globalWriteQueue
 	return f
 }
 
+func (f *defaultStorageFactory) WriteQueue() *WriteQueue {
+	return f.queue
+}
+
+func (f *defaultStorageFactory) PendingWrites() int {
+	if f.queue == nil {
+		return 0
+	}
+	return f.queue.Len()
+}
+
 func (f *defaultStorageFactory) GetStorage(storageType StorageType) (Storage, error) {
 	s := f.storageMap[storageType]
+	if s == nil && info.IsStandalone() && (storageType == StorageTypeInKube || storageType == StorageTypeKubeEvent) {
+		return nil, fmt.Errorf("storage type %s is %w", storageType, info.ErrStandalone)
+	}
 	if s == nil {
 		return nil, fmt.Errorf("storage type %s not found", storageType)
 	}
@@ -53,3 +87,12 @@ func (f *defaultStorageFactory) GetStorage(storageType StorageType) (Storage, er
 	}
 	return s, nil
 }
+
+// StatusInfos describes the pending writes and the composite target results for plugin status
+func StatusInfos(f StorageFactory) []string {
+	infos := []string{fmt.Sprintf("pendingWrites: %d", f.PendingWrites())}
+	for _, r := range f.TargetResults() {
+		infos = append(infos, r.String())
+	}
+	return infos
+}
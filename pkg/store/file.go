@@ -0,0 +1,198 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/magicsong/kidecar/api"
+	"github.com/magicsong/kidecar/pkg/utils"
+)
+
+const (
+	// FileModeLatest keeps only the latest value in the file
+	FileModeLatest = "Latest"
+	// FileModeHistory appends every value as a json line
+	FileModeHistory = "History"
+)
+
+var _ ReadableStorage = &file{}
+
+// FileRecord is one line of the history file
+type FileRecord struct {
+	Value     string    `json:"value"`
+	Plugin    string    `json:"plugin,omitempty"`
+	Endpoint  string    `json:"endpoint,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type file struct {
+	// mu serializes writers of the same process, the rename keeps readers consistent
+	mu          sync.Mutex
+	initialized bool
+}
+
+// IsInitialized implements Storage.
+func (f *file) IsInitialized() bool {
+	return f.initialized
+}
+
+// SetupWithManager implements Storage.
+func (f *file) SetupWithManager(mgr api.SidecarManager) error {
+	f.initialized = true
+	return nil
+}
+
+// Store implements Storage.
+func (f *file) Store(data string, config interface{}) error {
+	myconfig, ok := config.(*FileConfig)
+	if !ok || myconfig == nil {
+		return fmt.Errorf("invalid file config type")
+	}
+	if err := myconfig.IsValid(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(myconfig.Path), 0755); err != nil {
+		return fmt.Errorf("failed to create dir of %s: %w", myconfig.Path, err)
+	}
+	if myconfig.Mode != FileModeHistory {
+		return utils.WriteFileAtomic(myconfig.Path, []byte(data))
+	}
+	line, err := json.Marshal(&FileRecord{
+		Value:     data,
+		Plugin:    myconfig.source.Plugin,
+		Endpoint:  myconfig.source.Endpoint,
+		Timestamp: time.Now().UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+	// without a cap nothing is dropped, so the record is simply appended
+	if myconfig.MaxRecords <= 0 {
+		return appendLine(myconfig.Path, line)
+	}
+	content, err := appendHistory(myconfig, line)
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(myconfig.Path, content)
+}
+
+// appendLine appends one line to the file
+func appendLine(path string, line []byte) error {
+	fd, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	if _, err := fd.Write(append(line, '\n')); err != nil {
+		fd.Close()
+		return fmt.Errorf("failed to append to %s: %w", path, err)
+	}
+	return fd.Close()
+}
+
+// appendHistory returns the existing history with the line appended, keeping at most MaxRecords lines
+func appendHistory(config *FileConfig, line []byte) ([]byte, error) {
+	var lines [][]byte
+	existing, err := os.ReadFile(config.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read %s: %w", config.Path, err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(existing))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			lines = append(lines, append([]byte{}, scanner.Bytes()...))
+		}
+	}
+	// rewriting the file after a failed read would drop the records that were not read
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read history of %s: %w", config.Path, err)
+	}
+	lines = append(lines, line)
+	if config.MaxRecords > 0 && len(lines) > config.MaxRecords {
+		lines = lines[len(lines)-config.MaxRecords:]
+	}
+	return append(bytes.Join(lines, []byte("\n")), '\n'), nil
+}
+
+// fileWatchInterval is how often Watch checks the file, shared volumes do not reliably support inotify
+var fileWatchInterval = time.Second
+
+// Load implements ReadableStorage, in History mode it returns the value of the last record.
+func (f *file) Load(ctx context.Context, config interface{}) (string, error) {
+	myconfig, ok := config.(*FileConfig)
+	if !ok || myconfig == nil {
+		return "", fmt.Errorf("invalid file config type")
+	}
+	if err := myconfig.IsValid(); err != nil {
+		return "", fmt.Errorf("invalid config: %w", err)
+	}
+	content, err := os.ReadFile(myconfig.Path)
+	if os.IsNotExist(err) {
+		return "", ErrNoData
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", myconfig.Path, err)
+	}
+	if myconfig.Mode != FileModeHistory {
+		return string(content), nil
+	}
+	lines := bytes.Split(bytes.TrimRight(content, "\n"), []byte("\n"))
+	last := lines[len(lines)-1]
+	if len(last) == 0 {
+		return "", ErrNoData
+	}
+	record := &FileRecord{}
+	if err := json.Unmarshal(last, record); err != nil {
+		return "", fmt.Errorf("failed to unmarshal record of %s: %w", myconfig.Path, err)
+	}
+	return record.Value, nil
+}
+
+// Watch implements ReadableStorage.
+func (f *file) Watch(ctx context.Context, config interface{}, handler func(data string)) error {
+	last, err := f.Load(ctx, config)
+	if err != nil && err != ErrNoData {
+		return err
+	}
+	ticker := time.NewTicker(fileWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		data, err := f.Load(ctx, config)
+		if err != nil || data == last {
+			continue
+		}
+		last = data
+		handler(data)
+	}
+}
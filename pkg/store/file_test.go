@@ -0,0 +1,118 @@
+/*
+Copyright 2024
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFile_Store(t *testing.T) {
+	dir := t.TempDir()
+	storage := &file{}
+	if err := storage.SetupWithManager(nil); err != nil {
+		t.Fatalf("SetupWithManager() error = %v", err)
+	}
+
+	t.Run("Latest", func(t *testing.T) {
+		config := &FileConfig{Path: filepath.Join(dir, "latest", "result")}
+		for _, v := range []string{"None", "Allocated"} {
+			if err := storage.Store(v, config); err != nil {
+				t.Fatalf("Store() error = %v", err)
+			}
+		}
+		content, err := os.ReadFile(config.Path)
+		if err != nil {
+			t.Fatalf("failed to read file: %v", err)
+		}
+		if string(content) != "Allocated" {
+			t.Errorf("content = %q, want %q", string(content), "Allocated")
+		}
+	})
+
+	t.Run("History", func(t *testing.T) {
+		config := &FileConfig{Path: filepath.Join(dir, "history.jsonl"), Mode: FileModeHistory, MaxRecords: 2}
+		config.source = DataSource{Plugin: "hot_update"}
+		for _, v := range []string{"v1", "v2", "v3"} {
+			if err := storage.Store(v, config); err != nil {
+				t.Fatalf("Store() error = %v", err)
+			}
+		}
+		content, err := os.ReadFile(config.Path)
+		if err != nil {
+			t.Fatalf("failed to read file: %v", err)
+		}
+		var values []string
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+		for scanner.Scan() {
+			record := &FileRecord{}
+			if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+				t.Fatalf("invalid line %q: %v", scanner.Text(), err)
+			}
+			if record.Plugin != "hot_update" {
+				t.Errorf("plugin = %s, want hot_update", record.Plugin)
+			}
+			values = append(values, record.Value)
+		}
+		if len(values) != 2 || values[0] != "v2" || values[1] != "v3" {
+			t.Errorf("history = %v, want [v2 v3]", values)
+		}
+	})
+
+	t.Run("UnboundedHistory", func(t *testing.T) {
+		config := &FileConfig{Path: filepath.Join(dir, "unbounded.jsonl"), Mode: FileModeHistory}
+		for _, v := range []string{"v1", "v2", "v3"} {
+			if err := storage.Store(v, config); err != nil {
+				t.Fatalf("Store() error = %v", err)
+			}
+		}
+		content, err := os.ReadFile(config.Path)
+		if err != nil {
+			t.Fatalf("failed to read file: %v", err)
+		}
+		if lines := strings.Split(strings.TrimRight(string(content), "\n"), "\n"); len(lines) != 3 {
+			t.Errorf("expected 3 records, got %d", len(lines))
+		}
+	})
+
+	t.Run("HistoryWithTooLongLine", func(t *testing.T) {
+		config := &FileConfig{Path: filepath.Join(dir, "long.jsonl"), Mode: FileModeHistory, MaxRecords: 2}
+		existing := strings.Repeat("x", 2*1024*1024) + "\n"
+		if err := os.WriteFile(config.Path, []byte(existing), 0644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+		if err := storage.Store("v1", config); err == nil {
+			t.Fatalf("Store() expected an error for an unreadable history")
+		}
+		content, _ := os.ReadFile(config.Path)
+		if string(content) != existing {
+			t.Errorf("history must not be overwritten after a failed read")
+		}
+	})
+
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if strings.Contains(e.Name(), ".tmp") {
+			t.Errorf("temp file %s left behind", e.Name())
+		}
+	}
+}
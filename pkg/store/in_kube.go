@@ -19,46 +19,58 @@ package store
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"sync"
 
-	"github.com/magicsong/kidecar/pkg/constants"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 
 	"github.com/go-logr/logr"
 	"github.com/magicsong/kidecar/api"
 	"github.com/magicsong/kidecar/pkg/info"
+	"github.com/magicsong/kidecar/pkg/template"
 	"gomodules.xyz/jsonpatch/v2"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/dynamic"
-	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/retry"
 )
 
-var _ Storage = &inKube{}
+var _ ReadableStorage = &inKube{}
 var rfc6901Encoder = strings.NewReplacer("~", "~0", "/", "~1")
 
+var (
+	podGvr        = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	gameServerGvr = info.GameServerGVR
+)
+
 type inKube struct {
-	log     logr.Logger
-	dynamic dynamic.Interface
-	kubernetes.Interface
+	log       logr.Logger
+	dynamic   dynamic.Interface
+	resolver  *targetResolver
+	scheduler *WriteScheduler
 }
 
 // IsInitialized implements Storage.
 func (c *inKube) IsInitialized() bool {
-	return c.Interface != nil
+	return c.scheduler != nil
 }
 
 // SetupWithManager implements Storage.
 func (c *inKube) SetupWithManager(mgr api.SidecarManager) error {
-	dynClient, err := dynamic.NewForConfig(mgr.GetConfig())
-	if err != nil {
-		return fmt.Errorf("failed to create dynamic client: %w", err)
-	}
 	c.log = mgr.GetLogger().WithName("in_kube")
-	c.dynamic = dynClient
-	c.Interface = mgr
+	c.dynamic = mgr
+	c.resolver = &targetResolver{dynamic: mgr, mapper: mgr.GetRESTMapper()}
+	c.scheduler = globalWriteScheduler
+	if c.scheduler == nil {
+		c.scheduler = NewWriteScheduler(mgr, nil)
+	}
 	return nil
 }
 
@@ -74,9 +86,9 @@ func (c *inKube) storeInCurrentPod(data string, config *InKubeConfig) error {
 		}
 	}
 
-	currentPod, err := info.GetCurrentPod()
+	currentPod, err := info.GetCurrentPodNamespaceAndName()
 	if err != nil {
-		return fmt.Errorf("failed to get current pod: %w", err)
+		return fmt.Errorf("failed to get current pod namespace and name: %w", err)
 	}
 	c.log.Info("store data in current pod", "data", data, "name", currentPod.Name)
 	defer c.log.Info("store data done", "data", data, "pod", currentPod.Name)
@@ -112,13 +124,8 @@ func (c *inKube) storeInCurrentPod(data string, config *InKubeConfig) error {
 		metadata["labels"] = labels
 	}
 	patchData["metadata"] = metadata
-	patchBytes, _ := json.Marshal(patchData)
 	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		_, err = c.CoreV1().Pods(currentPod.Namespace).Patch(context.Background(), currentPod.Name, types.StrategicMergePatchType, patchBytes, metav1.PatchOptions{})
-		if err != nil {
-			return err
-		}
-		return nil
+		return c.scheduler.PatchStrategicMerge(context.Background(), podGvr, currentPod.Namespace, currentPod.Name, patchData)
 	})
 	if err != nil {
 		return fmt.Errorf("failed to patch pod after mant retries: %w", err)
@@ -132,11 +139,14 @@ func (c *inKube) Store(data string, config interface{}) error {
 	if !ok || myconfig == nil {
 		return fmt.Errorf("invalid in kube config type")
 	}
-	c.log.Info("store data", "data", data, "inKube", myconfig)
+	c.log.Info("store data", "data", data, "inKube", template.Redacted(myconfig))
 	defer c.log.Info("store data done", "data", data)
 	if err := myconfig.IsValid(); err != nil {
 		return fmt.Errorf("invalid config: %w", err)
 	}
+	// the config may be shared by concurrent writes, the policy map is built on a copy
+	preprocessed := *myconfig
+	myconfig = &preprocessed
 	myconfig.Preprocess()
 	if err := c.storeInCurrentPod(data, myconfig); err != nil {
 		return fmt.Errorf("failed to store in current pod: %w", err)
@@ -160,21 +170,24 @@ func (c *inKube) storeProbeInGameServer(data string, config *InKubeConfig) error
 	}
 
 	// store probe result in gameserver
-	gvr := schema.GroupVersionResource{
-		Group:    constants.GameServersGroup,
-		Version:  constants.GameServersVersion,
-		Resource: constants.GameServersResource,
-	}
 	ns, err := info.GetCurrentPodNamespaceAndName()
 	if err != nil {
 		return fmt.Errorf("failed to get current pod namespace and name: %w", err)
 	}
 	patch := generatePatch(data, config)
+	if policy, ok := config.GetPolicyOfState(data); ok && policy.GameServerOpsState != "" {
+		patch = append(patch, jsonpatch.NewOperation("replace", "/spec/opsState", policy.GameServerOpsState))
+	}
 	patchBytes, _ := json.Marshal(patch)
+	// the gameserver is usually served from the cache, skip the write if it already has every value of the patch
+	if gs, err := info.GetGameServer(context.TODO()); err == nil && patchApplied(gs.Object, patch) {
+		c.log.V(1).Info("gameserver is up to date", "data", data, "opsState", gs.OpsState())
+		return nil
+	}
 
 	c.log.Info("store data in gameservers object", "data", data, "patch", string(patchBytes))
 
-	_, err = c.dynamic.Resource(gvr).Namespace(ns.Namespace).Patch(context.TODO(), ns.Name, types.JSONPatchType, patchBytes, metav1.PatchOptions{})
+	err = c.scheduler.PatchJSON(context.TODO(), gameServerGvr, ns.Namespace, ns.Name, patch)
 	if err != nil {
 		return fmt.Errorf("failed to patch inKube: %w", err)
 	}
@@ -187,15 +200,22 @@ func (c *inKube) storeInOtherObject(data string, myconfig *InKubeConfig) error {
 		return nil
 	}
 	gvr := myconfig.Target.ToGvr()
-	c.log.Info("store data in other object", "data", data, "inKube", myconfig, "gvr", gvr)
+	c.log.Info("store data in other object", "data", data, "inKube", template.Redacted(myconfig), "gvr", gvr)
+	targets, err := c.resolver.Resolve(context.TODO(), myconfig.Target)
+	if err != nil {
+		return fmt.Errorf("failed to resolve target: %w", err)
+	}
 	patch := generatePatch(data, myconfig)
 	patchBytes, _ := json.Marshal(patch)
-	c.log.Info("patch inKube", "inKube", myconfig, "patch", string(patchBytes), "gvr", gvr)
-	_, err := c.dynamic.Resource(gvr).Namespace(myconfig.Target.Namespace).Patch(context.TODO(), myconfig.Target.Name, types.JSONPatchType, patchBytes, metav1.PatchOptions{})
-	if err != nil {
-		return fmt.Errorf("failed to patch inKube: %w", err)
+	var errs []error
+	for _, target := range targets {
+		c.log.Info("patch inKube", "target", target, "patch", string(patchBytes), "gvr", gvr)
+		err := c.scheduler.PatchJSON(context.TODO(), gvr, target.Namespace, target.Name, patch)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to patch %s: %w", target.String(), err))
+		}
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
 func generatePatch(data string, myconfig *InKubeConfig) []jsonpatch.JsonPatchOperation {
@@ -228,3 +248,238 @@ func generatePatch(data string, myconfig *InKubeConfig) []jsonpatch.JsonPatchOpe
 	}
 	return patch
 }
+
+// patchApplied returns true if the value of every operation of the patch is already in the object
+func patchApplied(obj map[string]interface{}, patch []jsonpatch.JsonPatchOperation) bool {
+	for _, op := range patch {
+		current, ok := lookupJSONPointer(obj, op.Path)
+		if !ok {
+			return false
+		}
+		got, _ := json.Marshal(current)
+		want, _ := json.Marshal(op.Value)
+		if string(got) != string(want) {
+			return false
+		}
+	}
+	return true
+}
+
+// readTarget returns the object the stored data is read back from,
+// the current pod for annotation and label keys, otherwise the target or the GameServer
+func (c *inKube) readTarget(ctx context.Context, config *InKubeConfig) (schema.GroupVersionResource, types.NamespacedName, error) {
+	if config.AnnotationKey != nil || config.LabelKey != nil {
+		nsName, err := info.GetCurrentPodNamespaceAndName()
+		if err != nil {
+			return podGvr, types.NamespacedName{}, err
+		}
+		return podGvr, *nsName, nil
+	}
+	if config.Target != nil {
+		targets, err := c.resolver.Resolve(ctx, config.Target)
+		if err != nil {
+			return schema.GroupVersionResource{}, types.NamespacedName{}, fmt.Errorf("failed to resolve target: %w", err)
+		}
+		if len(targets) == 0 {
+			return schema.GroupVersionResource{}, types.NamespacedName{}, ErrNoData
+		}
+		return config.Target.ToGvr(), targets[0], nil
+	}
+	nsName, err := info.GetCurrentPodNamespaceAndName()
+	if err != nil {
+		return gameServerGvr, types.NamespacedName{}, err
+	}
+	return gameServerGvr, *nsName, nil
+}
+
+// Load implements ReadableStorage.
+func (c *inKube) Load(ctx context.Context, config interface{}) (string, error) {
+	myconfig, ok := config.(*InKubeConfig)
+	if !ok || myconfig == nil {
+		return "", fmt.Errorf("invalid in kube config type")
+	}
+	if err := myconfig.IsValid(); err != nil {
+		return "", fmt.Errorf("invalid config: %w", err)
+	}
+	gvr, target, err := c.readTarget(ctx, myconfig)
+	if err != nil {
+		return "", err
+	}
+	obj, err := c.dynamic.Resource(gvr).Namespace(target.Namespace).Get(ctx, target.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get %s: %w", target.String(), err)
+	}
+	data, ok := loadFromObject(obj, myconfig)
+	if !ok {
+		return "", ErrNoData
+	}
+	return data, nil
+}
+
+// Watch implements ReadableStorage, for a label selector target every matched object is watched.
+func (c *inKube) Watch(ctx context.Context, config interface{}, handler func(data string)) error {
+	myconfig, ok := config.(*InKubeConfig)
+	if !ok || myconfig == nil {
+		return fmt.Errorf("invalid in kube config type")
+	}
+	if err := myconfig.IsValid(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	gvr, namespace, tweak, err := c.watchTarget(ctx, myconfig)
+	if err != nil {
+		return err
+	}
+	informer := dynamicinformer.NewFilteredDynamicInformer(c.dynamic, gvr, namespace, 0, cache.Indexers{}, tweak).Informer()
+	var mu sync.Mutex
+	// last is the data of every watched object
+	last := map[string]string{}
+	notify := func(o interface{}) {
+		obj, ok := o.(*unstructured.Unstructured)
+		if !ok {
+			return
+		}
+		data, ok := loadFromObject(obj, myconfig)
+		if !ok {
+			return
+		}
+		mu.Lock()
+		previous, seen := last[obj.GetName()]
+		last[obj.GetName()] = data
+		mu.Unlock()
+		if !seen || data != previous {
+			handler(data)
+		}
+	}
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    notify,
+		UpdateFunc: func(_, newObj interface{}) { notify(newObj) },
+	}); err != nil {
+		return fmt.Errorf("failed to add event handler: %w", err)
+	}
+	informer.Run(ctx.Done())
+	return nil
+}
+
+// watchTarget returns the objects watched for the config, selected by label for a label selector target
+// and by name otherwise
+func (c *inKube) watchTarget(ctx context.Context, config *InKubeConfig) (schema.GroupVersionResource, string, dynamicinformer.TweakListOptionsFunc, error) {
+	if config.AnnotationKey == nil && config.LabelKey == nil && config.Target != nil && config.Target.LabelSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(config.Target.LabelSelector)
+		if err != nil {
+			return schema.GroupVersionResource{}, "", nil, fmt.Errorf("invalid label selector: %w", err)
+		}
+		namespace := config.Target.Namespace
+		if namespace == "" {
+			nsName, err := info.GetCurrentPodNamespaceAndName()
+			if err != nil {
+				return schema.GroupVersionResource{}, "", nil, fmt.Errorf("failed to get current pod namespace: %w", err)
+			}
+			namespace = nsName.Namespace
+		}
+		return config.Target.ToGvr(), namespace, func(options *metav1.ListOptions) {
+			options.LabelSelector = selector.String()
+		}, nil
+	}
+	gvr, target, err := c.readTarget(ctx, config)
+	if err != nil {
+		return schema.GroupVersionResource{}, "", nil, err
+	}
+	return gvr, target.Namespace, func(options *metav1.ListOptions) {
+		options.FieldSelector = fields.OneTermEqualSelector("metadata.name", target.Name).String()
+	}, nil
+}
+
+// loadFromObject reverses the write of the config, for marker policies it returns the state of the first matched policy
+func loadFromObject(obj *unstructured.Unstructured, config *InKubeConfig) (string, bool) {
+	if config.AnnotationKey != nil {
+		if v, ok := obj.GetAnnotations()[*config.AnnotationKey]; ok {
+			return v, true
+		}
+	}
+	if config.LabelKey != nil {
+		if v, ok := obj.GetLabels()[*config.LabelKey]; ok {
+			return v, true
+		}
+	}
+	if config.AnnotationKey != nil || config.LabelKey != nil {
+		return "", false
+	}
+	if config.JsonPath != nil {
+		v, ok := lookupJSONPointer(obj.Object, *config.JsonPath)
+		if !ok {
+			return "", false
+		}
+		if s, isString := v.(string); isString {
+			return s, true
+		}
+		bytes, _ := json.Marshal(v)
+		return string(bytes), true
+	}
+	for _, policy := range config.MarkerPolices {
+		if policyMatches(obj, &policy) {
+			return policy.State, true
+		}
+	}
+	return "", false
+}
+
+func policyMatches(obj *unstructured.Unstructured, policy *ProbeMarkerPolicy) bool {
+	checked := false
+	for k, v := range policy.Annotations {
+		if obj.GetAnnotations()[k] != v {
+			return false
+		}
+		checked = true
+	}
+	for k, v := range policy.Labels {
+		if obj.GetLabels()[k] != v {
+			return false
+		}
+		checked = true
+	}
+	for _, c := range policy.JsonPathConfigs {
+		v, ok := lookupJSONPointer(obj.Object, c.JSONPath)
+		if !ok {
+			return false
+		}
+		got, _ := json.Marshal(v)
+		want, _ := json.Marshal(c.Value)
+		if string(got) != string(want) {
+			return false
+		}
+		checked = true
+	}
+	if policy.GameServerOpsState != "" && obj.GetKind() == info.GameServerGVK.Kind {
+		gs := &info.GameServer{Unstructured: obj}
+		if gs.OpsState() != policy.GameServerOpsState {
+			return false
+		}
+		checked = true
+	}
+	return checked
+}
+
+// lookupJSONPointer returns the value at a RFC 6901 pointer like /spec/opsState
+func lookupJSONPointer(obj map[string]interface{}, pointer string) (interface{}, bool) {
+	var current interface{} = obj
+	for _, token := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+		switch v := current.(type) {
+		case map[string]interface{}:
+			next, ok := v[token]
+			if !ok {
+				return nil, false
+			}
+			current = next
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			current = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
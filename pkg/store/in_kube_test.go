@@ -0,0 +1,78 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"testing"
+
+	"github.com/magicsong/kidecar/pkg/info"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestInKube_StoreProbeInGameServer(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "minecraft-0")
+	gs := newTestObject(gsGvr, "GameServer", "minecraft-0", nil, nil)
+	if err := unstructured.SetNestedField(gs.Object, "None", "spec", "opsState"); err != nil {
+		t.Fatal(err)
+	}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		gsGvr: "GameServerList",
+	}, gs)
+	info.SetGlobalDynamicInterface(client)
+	defer info.SetGlobalDynamicInterface(nil)
+	storage := &inKube{dynamic: client, scheduler: NewWriteScheduler(client, nil)}
+	config := &InKubeConfig{MarkerPolices: []ProbeMarkerPolicy{
+		{State: "idle", GameServerOpsState: "None"},
+		{State: "busy", GameServerOpsState: "Allocated"},
+	}}
+	config.Preprocess()
+
+	patches := func() int {
+		count := 0
+		for _, action := range client.Actions() {
+			if action.GetVerb() == "patch" {
+				count++
+			}
+		}
+		return count
+	}
+	if err := storage.storeProbeInGameServer("busy", config); err != nil {
+		t.Fatalf("storeProbeInGameServer() error = %v", err)
+	}
+	got, err := info.GetGameServer(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.OpsState() != "Allocated" {
+		t.Errorf("Expected opsState Allocated, but got %s", got.OpsState())
+	}
+	if patches() != 1 {
+		t.Errorf("Expected 1 patch, but got %d", patches())
+	}
+	// the gameserver is already allocated
+	if err := storage.storeProbeInGameServer("busy", config); err != nil {
+		t.Fatalf("storeProbeInGameServer() error = %v", err)
+	}
+	if patches() != 1 {
+		t.Errorf("Expected no patch of an up to date gameserver, but got %d patches", patches())
+	}
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"text/template"
+
+	"github.com/magicsong/kidecar/api"
+	"github.com/magicsong/kidecar/pkg/info"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// EventTargetPod records events on the current pod
+	EventTargetPod = "Pod"
+	// EventTargetGameServer records events on the GameServer of the current pod
+	EventTargetGameServer = "GameServer"
+
+	eventRecorderName  = "kidecar"
+	defaultEventReason = "SidecarResult"
+)
+
+var _ Storage = &kubeEvent{}
+
+// eventMessageData is the data available in the message template
+type eventMessageData struct {
+	Value    string
+	Plugin   string
+	Endpoint string
+}
+
+type kubeEvent struct {
+	recorder record.EventRecorder
+	dynamic  dynamic.Interface
+}
+
+// IsInitialized implements Storage.
+func (k *kubeEvent) IsInitialized() bool {
+	return k.recorder != nil
+}
+
+// SetupWithManager implements Storage.
+func (k *kubeEvent) SetupWithManager(mgr api.SidecarManager) error {
+	k.dynamic = mgr
+	k.recorder = mgr.GetEventRecorderFor(eventRecorderName)
+	return nil
+}
+
+// Store implements Storage.
+func (k *kubeEvent) Store(data string, config interface{}) error {
+	myconfig, ok := config.(*KubeEventConfig)
+	if !ok || myconfig == nil {
+		return fmt.Errorf("invalid kube event config type")
+	}
+	if err := myconfig.IsValid(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	policy, ok := myconfig.GetPolicyOfState(data)
+	if !ok {
+		return nil
+	}
+	message, err := renderEventMessage(policy.Message, &eventMessageData{
+		Value:    data,
+		Plugin:   myconfig.source.Plugin,
+		Endpoint: myconfig.source.Endpoint,
+	})
+	if err != nil {
+		return err
+	}
+	object, err := k.involvedObject(myconfig.Target)
+	if err != nil {
+		return err
+	}
+	eventType := policy.Type
+	if eventType == "" {
+		eventType = corev1.EventTypeNormal
+	}
+	reason := policy.Reason
+	if reason == "" {
+		reason = defaultEventReason
+	}
+	k.recorder.Event(object, eventType, reason, message)
+	return nil
+}
+
+func (k *kubeEvent) involvedObject(target string) (runtime.Object, error) {
+	if target == EventTargetGameServer {
+		nsName, err := info.GetCurrentPodNamespaceAndName()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get current pod namespace and name: %w", err)
+		}
+		gs, err := k.dynamic.Resource(gameServerGvr).Namespace(nsName.Namespace).Get(context.TODO(), nsName.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get gameserver: %w", err)
+		}
+		return gs, nil
+	}
+	pod, err := info.GetCurrentPod()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current pod: %w", err)
+	}
+	return pod, nil
+}
+
+func renderEventMessage(text string, data *eventMessageData) (string, error) {
+	if text == "" {
+		return data.Value, nil
+	}
+	tmpl, err := template.New("message").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid message template: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render message: %w", err)
+	}
+	return buf.String(), nil
+}
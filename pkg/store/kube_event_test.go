@@ -0,0 +1,75 @@
+/*
+Copyright 2024
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"testing"
+
+	"github.com/agiledragon/gomonkey/v2"
+	"github.com/magicsong/kidecar/pkg/info"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestKubeEvent_Store(t *testing.T) {
+	patchPod := gomonkey.ApplyFunc(info.GetCurrentPod, func() (*corev1.Pod, error) {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "gs-0", Namespace: "default"}}, nil
+	})
+	defer patchPod.Reset()
+
+	config := &KubeEventConfig{
+		Policies: []EventPolicy{
+			{State: "WaitToBeDeleted", Reason: "OpsStateChanged", Type: corev1.EventTypeWarning, Message: "{{.Plugin}} set opsState to {{.Value}}"},
+			{Reason: "ProbeResult", Message: "got {{.Value}}"},
+		},
+		source: DataSource{Plugin: "http_probe"},
+	}
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{
+			name: "MatchedState",
+			data: "WaitToBeDeleted",
+			want: "Warning OpsStateChanged http_probe set opsState to WaitToBeDeleted",
+		},
+		{
+			name: "FallbackPolicy",
+			data: "None",
+			want: "Normal ProbeResult got None",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(1)
+			storage := &kubeEvent{recorder: recorder}
+			if err := storage.Store(tt.data, config); err != nil {
+				t.Fatalf("Store() error = %v", err)
+			}
+			select {
+			case event := <-recorder.Events:
+				if event != tt.want {
+					t.Errorf("event = %q, want %q", event, tt.want)
+				}
+			default:
+				t.Errorf("no event recorded")
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/magicsong/kidecar/api"
+	"github.com/magicsong/kidecar/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+const (
+	otlpMeterName    = "github.com/magicsong/kidecar/store"
+	otlpFlushTimeout = 10 * time.Second
+
+	// OTLPValueKey carries non numeric values, the current value is recorded as 1 and the previous one as 0
+	OTLPValueKey = attribute.Key("kidecar.value")
+)
+
+var _ Storage = &otlp{}
+
+// otlpExporter is a meter provider pushing to one collector
+type otlpExporter struct {
+	provider *sdkmetric.MeterProvider
+	mu       sync.Mutex
+	gauges   map[string]metric.Float64Gauge
+	// states is the last non numeric value of every series
+	states map[string]string
+}
+
+// otlpExporters are shared by the OTLP storages of all plugins, one collector gets one meter provider
+var otlpExporters = struct {
+	sync.Mutex
+	m map[string]*otlpExporter
+}{m: make(map[string]*otlpExporter)}
+
+// ShutdownOTLPExporters flushes and stops the meter providers of the OTLP storages
+func ShutdownOTLPExporters(ctx context.Context) error {
+	otlpExporters.Lock()
+	exporters := otlpExporters.m
+	otlpExporters.m = make(map[string]*otlpExporter)
+	otlpExporters.Unlock()
+	var errs []error
+	for _, exporter := range exporters {
+		if err := exporter.provider.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type otlp struct {
+	initialized bool
+}
+
+// IsInitialized implements Storage.
+func (o *otlp) IsInitialized() bool {
+	return o.initialized
+}
+
+// SetupWithManager implements Storage.
+func (o *otlp) SetupWithManager(mgr api.SidecarManager) error {
+	o.initialized = true
+	return nil
+}
+
+// Store implements Storage.
+func (o *otlp) Store(data string, config interface{}) error {
+	myconfig, ok := config.(*OTLPStorageConfig)
+	if !ok || myconfig == nil {
+		return fmt.Errorf("invalid otlp config type")
+	}
+	if err := myconfig.IsValid(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	attrs := telemetry.PodAttributes()
+	for k, v := range myconfig.Attributes {
+		attrs = append(attrs, attribute.String(k, v))
+	}
+	if myconfig.source.Plugin != "" {
+		attrs = append(attrs, attribute.String("kidecar.plugin", myconfig.source.Plugin))
+	}
+	if myconfig.source.Endpoint != "" {
+		attrs = append(attrs, attribute.String("kidecar.endpoint", myconfig.source.Endpoint))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), otlpFlushTimeout)
+	defer cancel()
+	exporter, gauge, err := getOrCreateGauge(ctx, myconfig)
+	if err != nil {
+		return err
+	}
+	if value, err := strconv.ParseFloat(data, 64); err == nil {
+		gauge.Record(ctx, value, metric.WithAttributes(attrs...))
+	} else {
+		exporter.recordState(ctx, gauge, myconfig.MetricName, attrs, data)
+	}
+	// results are pushed right away instead of waiting for the next export interval
+	if err := exporter.provider.ForceFlush(ctx); err != nil {
+		return fmt.Errorf("failed to export metric %s: %w", myconfig.MetricName, err)
+	}
+	return nil
+}
+
+// recordState records the state as 1 and resets the series of the previous state to 0,
+// so only the current state of a series reports 1.
+func (e *otlpExporter) recordState(ctx context.Context, gauge metric.Float64Gauge, metricName string, attrs []attribute.KeyValue, state string) {
+	set := attribute.NewSet(attrs...)
+	key := metricName + "/" + set.Encoded(attribute.DefaultEncoder())
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if previous, ok := e.states[key]; ok && previous != state {
+		gauge.Record(ctx, 0, metric.WithAttributes(append(attrs, OTLPValueKey.String(previous))...))
+	}
+	e.states[key] = state
+	gauge.Record(ctx, 1, metric.WithAttributes(append(attrs, OTLPValueKey.String(state))...))
+}
+
+func getOrCreateGauge(ctx context.Context, config *OTLPStorageConfig) (*otlpExporter, metric.Float64Gauge, error) {
+	otlpExporters.Lock()
+	defer otlpExporters.Unlock()
+	keyBytes, _ := json.Marshal(config.OTLPConfig)
+	key := string(keyBytes)
+	exporter, ok := otlpExporters.m[key]
+	if !ok {
+		metricExporter, err := telemetry.NewMetricExporter(ctx, &config.OTLPConfig)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create otlp exporter: %w", err)
+		}
+		exporter = &otlpExporter{
+			provider: sdkmetric.NewMeterProvider(
+				sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter)),
+				sdkmetric.WithResource(telemetry.NewResource(telemetry.ServiceName())),
+			),
+			gauges: make(map[string]metric.Float64Gauge),
+			states: make(map[string]string),
+		}
+		otlpExporters.m[key] = exporter
+	}
+	gauge, ok := exporter.gauges[config.MetricName]
+	if !ok {
+		var err error
+		gauge, err = exporter.provider.Meter(otlpMeterName).Float64Gauge(config.MetricName, metric.WithDescription(config.Description))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create gauge %s: %w", config.MetricName, err)
+		}
+		exporter.gauges[config.MetricName] = gauge
+	}
+	return exporter, gauge, nil
+}
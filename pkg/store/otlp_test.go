@@ -0,0 +1,119 @@
+/*
+Copyright 2024
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/magicsong/kidecar/api"
+	"github.com/magicsong/kidecar/pkg/telemetry"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/grpc"
+)
+
+// fakeMetricsCollector stands in for an OTLP collector receiving metrics over grpc
+type fakeMetricsCollector struct {
+	colmetricpb.UnimplementedMetricsServiceServer
+	mu sync.Mutex
+	// points are keyed by the metric name and the kidecar.value attribute of the data point
+	points  map[string]float64
+	attrs   map[string]string
+	service string
+}
+
+func (c *fakeMetricsCollector) Export(ctx context.Context, req *colmetricpb.ExportMetricsServiceRequest) (*colmetricpb.ExportMetricsServiceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rm := range req.GetResourceMetrics() {
+		for _, kv := range rm.GetResource().GetAttributes() {
+			if kv.GetKey() == "service.name" {
+				c.service = kv.GetValue().GetStringValue()
+			}
+		}
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, m := range sm.GetMetrics() {
+				for _, dp := range m.GetGauge().GetDataPoints() {
+					key := m.GetName()
+					for _, kv := range dp.GetAttributes() {
+						c.attrs[kv.GetKey()] = kv.GetValue().GetStringValue()
+						if kv.GetKey() == string(OTLPValueKey) {
+							key += "/" + kv.GetValue().GetStringValue()
+						}
+					}
+					c.points[key] = dp.GetAsDouble()
+				}
+			}
+		}
+	}
+	return &colmetricpb.ExportMetricsServiceResponse{}, nil
+}
+
+func TestOTLP_Store(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "gs-0")
+	telemetry.SetServiceName("tankwar-sidecar")
+	defer telemetry.SetServiceName("kidecar")
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	collector := &fakeMetricsCollector{points: map[string]float64{}, attrs: map[string]string{}}
+	server := grpc.NewServer()
+	colmetricpb.RegisterMetricsServiceServer(server, collector)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	storage := &otlp{}
+	if err := storage.SetupWithManager(nil); err != nil {
+		t.Fatalf("SetupWithManager() error = %v", err)
+	}
+	config := &OTLPStorageConfig{
+		OTLPConfig: api.OTLPConfig{Endpoint: lis.Addr().String(), Insecure: true},
+		MetricName: "game_players",
+		Attributes: map[string]string{"game": "tankwar"},
+	}
+	if err := storage.Store("7", config); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+	config.MetricName = "game_ops_state"
+	for _, state := range []string{"Allocated", "Maintaining"} {
+		if err := storage.Store(state, config); err != nil {
+			t.Fatalf("Store() error = %v", err)
+		}
+	}
+	if err := ShutdownOTLPExporters(context.TODO()); err != nil {
+		t.Errorf("ShutdownOTLPExporters() error = %v", err)
+	}
+
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	want := map[string]float64{"game_players": 7, "game_ops_state/Allocated": 0, "game_ops_state/Maintaining": 1}
+	for key, value := range want {
+		if got, ok := collector.points[key]; !ok || got != value {
+			t.Errorf("point %s = %v, want %v, all points %v", key, got, value, collector.points)
+		}
+	}
+	if collector.attrs["game"] != "tankwar" || collector.attrs["k8s.pod.name"] != "gs-0" {
+		t.Errorf("unexpected attributes %v", collector.attrs)
+	}
+	if collector.service != "tankwar-sidecar" {
+		t.Errorf("service.name = %s, want tankwar-sidecar", collector.service)
+	}
+}
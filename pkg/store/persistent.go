@@ -18,110 +18,366 @@ package store
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
 
+	"github.com/magicsong/kidecar/api"
 	"github.com/magicsong/kidecar/pkg/constants"
 	"github.com/magicsong/kidecar/pkg/info"
 	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/util/retry"
 )
 
+const (
+	// persistentMetaKey holds the pod and the update time of an entry, it is not a result type
+	persistentMetaKey       = "_meta"
+	persistentMetaNamespace = "namespace"
+	persistentMetaName      = "name"
+	persistentMetaUpdatedAt = "updatedAt"
+)
+
+// maxConfigMapDataBytes leaves room for the metadata below the 1MiB object limit of the API server
+const maxConfigMapDataBytes = 1000 * 1024
+
+var globalPersistence = &api.PersistenceConfig{}
+
+// SetGlobalPersistence sets where and how long the plugin results are persisted
+func SetGlobalPersistence(config *api.PersistenceConfig) {
+	if config == nil {
+		config = &api.PersistenceConfig{}
+	}
+	globalPersistence = config
+}
+
 type PersistentConfig struct {
 	Type   string            `json:"type"`
 	Result map[string]string `json:"result"`
+	// Checksums of the versions in Result, only kept by the SidecarResult backend
+	Checksums map[string]string `json:"checksums,omitempty"`
+}
+
+// persistentLocation is the ConfigMap shard holding the results of the current pod
+type persistentLocation struct {
+	Namespace string
+	Name      string
+	// PodKey is the key of the current pod in the ConfigMap data
+	PodKey       string
+	PodNamespace string
+	PodName      string
+	// GameServerSet of the pod, empty if the pod is not managed by one
+	GameServerSet string
+	// Labels are set on every shard of the same GameServerSet
+	Labels map[string]string
+}
+
+func (l *persistentLocation) String() string {
+	return l.Namespace + "/" + l.Name
+}
+
+// resolvePersistentLocation shards the pods by GameServerSet, and by the hash of the pod key inside a GameServerSet
+func resolvePersistentLocation(config *api.PersistenceConfig) (*persistentLocation, error) {
+	nsName, err := info.GetCurrentPodNamespaceAndName()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current pod namespace and name: %w", err)
+	}
+	podKey, err := info.GetCurrentPodInfo()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current pod namespace and name: %w", err)
+	}
+	location := &persistentLocation{
+		Namespace:    config.Namespace,
+		Name:         config.ConfigMapName,
+		PodKey:       podKey,
+		PodNamespace: nsName.Namespace,
+		PodName:      nsName.Name,
+	}
+	if location.Namespace == "" {
+		location.Namespace = nsName.Namespace
+	}
+	if location.Name == "" {
+		location.Name = constants.SidecarResultConfigMapName
+	}
+	location.Labels = map[string]string{constants.SidecarResultLabelKey: location.Name}
+	labels, err := info.GetCurrentPodLabels()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get labels of current pod: %w", err)
+	}
+	if gss := labels[constants.GameServerSetLabelKey]; gss != "" {
+		location.Labels[constants.GameServerSetLabelKey] = gss
+		location.GameServerSet = gss
+		location.Name += "-" + gss
+	}
+	if config.Shards > 1 {
+		h := fnv.New32a()
+		h.Write([]byte(podKey))
+		location.Name += fmt.Sprintf("-%d", h.Sum32()%uint32(config.Shards))
+	}
+	return location, nil
 }
 
 func (p *PersistentConfig) GetPersistenceInfo() error {
 	if p == nil {
 		return fmt.Errorf("persistent config is nil")
 	}
-	if p.Type == "" {
+	if p.Type == "" || p.Type == persistentMetaKey {
 		return fmt.Errorf("persistent config type is invalid")
 	}
 
-	cm, err := info.GetConfigmap(context.TODO(), constants.SidecarResultConfigMapName, constants.SidecarResultConfigMapNamespace)
+	location, err := resolvePersistentLocation(globalPersistence)
 	if err != nil {
-		return fmt.Errorf("failed to get hotupdate configmap %s/%s: %v", constants.SidecarResultConfigMapName, constants.SidecarResultConfigMapNamespace, err)
+		return err
+	}
+	switch globalPersistence.Backend {
+	case api.PersistenceBackendSidecarResult:
+		return p.getFromSidecarResult(context.TODO(), location)
+	case api.PersistenceBackendFile:
+		return p.getFromFile(location)
+	}
+	cm, err := info.GetConfigmap(context.TODO(), location.Name, location.Namespace)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to get hotupdate configmap %s: %v", location, err)
+	}
+	if err == nil {
+		if result, ok, err := p.resultOfPod(cm, location.PodKey); err != nil || ok {
+			p.Result = result
+			return err
+		}
 	}
 
-	nameAndNamespace, err := info.GetCurrentPodInfo()
+	// the pod has no result yet, fall back to the results of all pods of the GameServerSet
+	cms, err := info.ListConfigmaps(context.TODO(), location.Namespace, labels.SelectorFromSet(location.Labels))
 	if err != nil {
-		return fmt.Errorf("failed to get current pod namespace and name: %w", err)
+		return fmt.Errorf("failed to list hotupdate configmaps in %s: %v", location.Namespace, err)
 	}
-
 	p.Result = map[string]string{}
+	for i := range cms {
+		result, err := p.resultOfAll(&cms[i])
+		if err != nil {
+			return err
+		}
+		for version, url := range result {
+			p.Result[version] = url
+		}
+	}
+	return nil
+}
 
+// resultOf returns the result of the pod, or the merged results of all pods in the ConfigMap if the pod has none
+func (p *PersistentConfig) resultOf(cm *corev1.ConfigMap, podKey string) (map[string]string, error) {
+	if result, ok, err := p.resultOfPod(cm, podKey); err != nil || ok {
+		return result, err
+	}
+	return p.resultOfAll(cm)
+}
+
+func (p *PersistentConfig) resultOfPod(cm *corev1.ConfigMap, podKey string) (map[string]string, bool, error) {
+	data, ok := cm.Data[podKey]
+	if !ok {
+		return nil, false, nil
+	}
 	persistentInfo := map[string]map[string]string{}
-	if info, ok := cm.Data[nameAndNamespace]; ok {
-		err := yaml.Unmarshal([]byte(info), &persistentInfo)
-		if err != nil {
-			return fmt.Errorf("failed to unmarshal hotUpdateInfo: %v", err)
+	if err := yaml.Unmarshal([]byte(data), &persistentInfo); err != nil {
+		return nil, false, fmt.Errorf("failed to unmarshal hotUpdateInfo: %v", err)
+	}
+	result := persistentInfo[p.Type]
+	if result == nil {
+		result = map[string]string{}
+	}
+	return result, true, nil
+}
+
+func (p *PersistentConfig) resultOfAll(cm *corev1.ConfigMap) (map[string]string, error) {
+	result := map[string]string{}
+	for _, v := range cm.Data {
+		persistentInfo := map[string]map[string]string{}
+		if err := yaml.Unmarshal([]byte(v), &persistentInfo); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal hotUpdateInfo: %v", err)
 		}
+		for version, url := range persistentInfo[p.Type] {
+			result[version] = url
+		}
+	}
+	return result, nil
+}
 
-		if res, ok := persistentInfo[p.Type]; ok {
-			p.Result = res
+// Watch calls the handler with the result every time the configmap changes, until the context is done
+func (p *PersistentConfig) Watch(ctx context.Context, handler func(result map[string]string)) error {
+	if p == nil || p.Type == "" {
+		return fmt.Errorf("persistent config is invalid")
+	}
+	location, err := resolvePersistentLocation(globalPersistence)
+	if err != nil {
+		return err
+	}
+	switch globalPersistence.Backend {
+	case api.PersistenceBackendSidecarResult:
+		return p.watchSidecarResult(ctx, location, handler)
+	case api.PersistenceBackendFile:
+		return p.watchFile(ctx, location, handler)
+	}
+	for {
+		w, err := info.WatchConfigmap(ctx, location.Name, location.Namespace)
+		if err != nil {
+			return fmt.Errorf("failed to watch configmap %s: %w", location, err)
 		}
-	} else {
-		for _, v := range cm.Data {
-			err := yaml.Unmarshal([]byte(v), &persistentInfo)
-			if err != nil {
-				return fmt.Errorf("failed to unmarshal hotUpdateInfo: %v", err)
+		for event := range w.ResultChan() {
+			cm, ok := event.Object.(*corev1.ConfigMap)
+			if !ok || (event.Type != watch.Added && event.Type != watch.Modified) {
+				continue
 			}
-			if res, ok := persistentInfo[p.Type]; ok {
-				for version, url := range res {
-					p.Result[version] = url
-				}
+			if result, err := p.resultOf(cm, location.PodKey); err == nil {
+				handler(result)
 			}
 		}
+		w.Stop()
+		// the server closes watches from time to time, watch again unless we are done
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+		}
 	}
-
-	return nil
 }
 
 func (p *PersistentConfig) SetPersistenceInfo() error {
-	if p == nil || p.Type == "" {
+	if p == nil || p.Type == "" || p.Type == persistentMetaKey {
 		return fmt.Errorf("persistent config is invalid")
 	}
 
-	cm, err := info.GetConfigmap(context.TODO(), constants.SidecarResultConfigMapName, constants.SidecarResultConfigMapNamespace)
+	location, err := resolvePersistentLocation(globalPersistence)
 	if err != nil {
-		return fmt.Errorf("failed to get hotupdate configmap %s/%s: %v", constants.SidecarResultConfigMapName, constants.SidecarResultConfigMapNamespace, err)
+		return err
 	}
-	nameAndNamespace, err := info.GetCurrentPodInfo()
-	if err != nil {
-		return fmt.Errorf("failed to get current pod namespace and name: %w", err)
+	switch globalPersistence.Backend {
+	case api.PersistenceBackendSidecarResult:
+		return p.setToSidecarResult(context.TODO(), location)
+	case api.PersistenceBackendFile:
+		return p.setToFile(location)
 	}
+	return p.setPersistenceInfo(context.TODO(), location)
+}
 
-	persistentInfo := map[string]map[string]string{}
+// persistentKeyLocks serializes the writers of the same pod key, writers of different keys never block each other
+var persistentKeyLocks sync.Map
 
-	if len(cm.Data) == 0 {
-		cm.Data = make(map[string]string)
-	}
+// setPersistenceInfo patches only the key of the pod, so pods sharing the ConfigMap never overwrite each other.
+// The ConfigMap is created on first use, a conflicting create of another pod is retried as a patch.
+func (p *PersistentConfig) setPersistenceInfo(ctx context.Context, location *persistentLocation) error {
+	lock, _ := persistentKeyLocks.LoadOrStore(location.String()+"/"+location.PodKey, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := info.GetConfigmap(ctx, location.Name, location.Namespace)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		exists := err == nil
 
-	if info, ok := cm.Data[nameAndNamespace]; ok {
-		err := yaml.Unmarshal([]byte(info), &persistentInfo)
+		var existing string
+		if exists {
+			existing = cm.Data[location.PodKey]
+		}
+		persistentInfoBytes, err := p.mergeEntry(existing, location)
 		if err != nil {
-			return fmt.Errorf("failed to unmarshal hotUpdateInfo: %v", err)
+			return err
+		}
+		if size := dataSize(cm, location.PodKey, persistentInfoBytes); size > maxConfigMapDataBytes {
+			return fmt.Errorf("configmap %s would hold %d bytes, more than %d, raise persistence.shards or lower persistence.maxVersions",
+				location, size, maxConfigMapDataBytes)
+		}
+
+		if !exists {
+			_, err := info.CreateConfigmap(ctx, &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      location.Name,
+					Namespace: location.Namespace,
+					Labels:    location.Labels,
+				},
+				Data: map[string]string{location.PodKey: string(persistentInfoBytes)},
+			})
+			if apierrors.IsAlreadyExists(err) {
+				// another pod created it first, retry with a patch
+				return apierrors.NewConflict(corev1.Resource("configmaps"), location.Name, err)
+			}
+			return err
 		}
+		patch, err := json.Marshal(map[string]interface{}{
+			"data": map[string]string{location.PodKey: string(persistentInfoBytes)},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal patch: %v", err)
+		}
+		_, err = info.PatchConfigmap(ctx, location.Name, location.Namespace, patch)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update hotupdate configmap %s: %v", location, err)
 	}
+	return nil
+}
 
+// dataSize returns the size of the data of the ConfigMap with the entry of the key replaced
+func dataSize(cm *corev1.ConfigMap, key string, entry []byte) int {
+	size := len(key) + len(entry)
+	if cm == nil {
+		return size
+	}
+	for k, v := range cm.Data {
+		if k != key {
+			size += len(k) + len(v)
+		}
+	}
+	return size
+}
+
+// mergeEntry returns the entry of the pod with the result merged into the existing entry
+func (p *PersistentConfig) mergeEntry(existing string, location *persistentLocation) ([]byte, error) {
+	persistentInfo := map[string]map[string]string{}
+	if existing != "" {
+		if err := yaml.Unmarshal([]byte(existing), &persistentInfo); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal hotUpdateInfo: %v", err)
+		}
+	}
 	if _, ok := persistentInfo[p.Type]; !ok {
 		persistentInfo[p.Type] = make(map[string]string)
 	}
 	for k, v := range p.Result {
 		persistentInfo[p.Type][k] = v
 	}
-
+	pruneVersions(persistentInfo[p.Type], globalPersistence.MaxVersions)
+	persistentInfo[persistentMetaKey] = map[string]string{
+		persistentMetaNamespace: location.PodNamespace,
+		persistentMetaName:      location.PodName,
+		persistentMetaUpdatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
 	persistentInfoBytes, err := yaml.Marshal(persistentInfo)
 	if err != nil {
-		return fmt.Errorf("failed to marshal hotUpdateInfo: %v", err)
+		return nil, fmt.Errorf("failed to marshal hotUpdateInfo: %v", err)
 	}
+	return persistentInfoBytes, nil
+}
 
-	cm.Data[nameAndNamespace] = string(persistentInfoBytes)
-
-	if _, err := info.UpdateConfigmap(context.TODO(), cm); err != nil {
-		return fmt.Errorf("failed to update hotupdate configmap %s/%s: %v", constants.SidecarResultConfigMapName, constants.SidecarResultConfigMapNamespace, err)
+// pruneVersions keeps the latest max versions ordered like compareVersions, 0 means unlimited
+func pruneVersions(result map[string]string, max int) {
+	if max <= 0 || len(result) <= max {
+		return
+	}
+	versions := make([]string, 0, len(result))
+	for v := range result {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return compareVersions(versions[i], versions[j]) > 0 })
+	for _, v := range versions[max:] {
+		delete(result, v)
 	}
-
-	return nil
-
 }
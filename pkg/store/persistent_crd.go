@@ -0,0 +1,352 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/magicsong/kidecar/api/v1alpha1"
+	"github.com/magicsong/kidecar/pkg/constants"
+	"github.com/magicsong/kidecar/pkg/info"
+	"gomodules.xyz/jsonpatch/v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/retry"
+)
+
+var sidecarResultGvr = v1alpha1.GroupVersion.WithResource("sidecarresults")
+
+// sidecarResultName is one SidecarResult per GameServerSet, pods without one share the configured name
+func sidecarResultName(location *persistentLocation) string {
+	if location.GameServerSet != "" {
+		return location.GameServerSet
+	}
+	return location.Labels[constants.SidecarResultLabelKey]
+}
+
+func getSidecarResult(ctx context.Context, namespace, name string) (*v1alpha1.SidecarResult, error) {
+	dyn := info.GetDynamicInterface()
+	if dyn == nil {
+		return nil, fmt.Errorf("dynamic client is not set")
+	}
+	obj, err := dyn.Resource(sidecarResultGvr).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return toSidecarResult(obj)
+}
+
+func toSidecarResult(obj *unstructured.Unstructured) (*v1alpha1.SidecarResult, error) {
+	result := &v1alpha1.SidecarResult{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, result); err != nil {
+		return nil, fmt.Errorf("failed to convert sidecar result: %w", err)
+	}
+	return result, nil
+}
+
+func fromSidecarResult(result *v1alpha1.SidecarResult) (*unstructured.Unstructured, error) {
+	result.APIVersion = v1alpha1.GroupVersion.String()
+	result.Kind = "SidecarResult"
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert sidecar result: %w", err)
+	}
+	return &unstructured.Unstructured{Object: obj}, nil
+}
+
+func (p *PersistentConfig) getFromSidecarResult(ctx context.Context, location *persistentLocation) error {
+	sr, err := getSidecarResult(ctx, location.Namespace, sidecarResultName(location))
+	if apierrors.IsNotFound(err) {
+		p.Result = map[string]string{}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get sidecar result: %w", err)
+	}
+	p.Result = p.resultOfSidecarResult(sr, location)
+	return nil
+}
+
+// resultOfSidecarResult returns the versions applied by the pod, or all versions if the pod has none
+func (p *PersistentConfig) resultOfSidecarResult(sr *v1alpha1.SidecarResult, location *persistentLocation) map[string]string {
+	urls := map[string]string{}
+	for _, v := range sr.Status.Versions {
+		if v.Type == p.Type {
+			urls[v.Version] = v.URL
+		}
+	}
+	if pod := findPodResult(sr, location, p.Type); pod != nil {
+		result := map[string]string{}
+		for _, version := range pod.Versions {
+			result[version] = urls[version]
+		}
+		return result
+	}
+	return urls
+}
+
+func findPodResult(sr *v1alpha1.SidecarResult, location *persistentLocation, resultType string) *v1alpha1.PodResult {
+	if i := podResultIndex(sr, location, resultType); i >= 0 {
+		return &sr.Status.Pods[i]
+	}
+	return nil
+}
+
+func podResultIndex(sr *v1alpha1.SidecarResult, location *persistentLocation, resultType string) int {
+	for i, pod := range sr.Status.Pods {
+		if pod.Namespace == location.PodNamespace && pod.Pod == location.PodName && pod.Type == resultType {
+			return i
+		}
+	}
+	return -1
+}
+
+// sidecarResultBackoff spreads the retries of the pods of a GameServerSet, which write the same SidecarResult at once during a rollout
+var sidecarResultBackoff = wait.Backoff{Steps: 12, Duration: 20 * time.Millisecond, Factor: 2, Jitter: 1, Cap: 5 * time.Second}
+
+// setToSidecarResult records the result of the pod, the SidecarResult is created on first use.
+// Once the versions are recorded a pod only patches its own entry and the counters, instead of sending the whole status.
+func (p *PersistentConfig) setToSidecarResult(ctx context.Context, location *persistentLocation) error {
+	dyn := info.GetDynamicInterface()
+	if dyn == nil {
+		return fmt.Errorf("dynamic client is not set")
+	}
+	client := dyn.Resource(sidecarResultGvr).Namespace(location.Namespace)
+	name := sidecarResultName(location)
+	err := retry.OnError(sidecarResultBackoff, isSidecarResultConflict, func() error {
+		sr, err := getOrCreateSidecarResult(ctx, client, location, name)
+		if err != nil {
+			return err
+		}
+		now := metav1.Now()
+		if p.hasVersions(sr) && len(sr.Status.Pods) > 0 {
+			return p.patchPodResult(ctx, client, sr, location, now)
+		}
+		p.applyTo(sr, location, now)
+		obj, err := fromSidecarResult(sr)
+		if err != nil {
+			return err
+		}
+		_, err = client.UpdateStatus(ctx, obj, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update sidecar result %s/%s: %w", location.Namespace, name, err)
+	}
+	return nil
+}
+
+// isSidecarResultConflict returns true if the SidecarResult changed since it was read,
+// a failed test operation of a json patch is rejected as invalid
+func isSidecarResultConflict(err error) bool {
+	return apierrors.IsConflict(err) || apierrors.IsInvalid(err)
+}
+
+func getOrCreateSidecarResult(ctx context.Context, client dynamic.ResourceInterface, location *persistentLocation, name string) (*v1alpha1.SidecarResult, error) {
+	sr, err := getSidecarResult(ctx, location.Namespace, name)
+	if !apierrors.IsNotFound(err) {
+		return sr, err
+	}
+	sr = &v1alpha1.SidecarResult{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: location.Namespace, Labels: location.Labels},
+		Spec:       v1alpha1.SidecarResultSpec{GameServerSet: location.GameServerSet},
+	}
+	obj, err := fromSidecarResult(sr)
+	if err != nil {
+		return nil, err
+	}
+	created, err := client.Create(ctx, obj, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return nil, apierrors.NewConflict(sidecarResultGvr.GroupResource(), name, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return toSidecarResult(created)
+}
+
+// hasVersions returns true if every version of the result is recorded with the same url and checksum
+func (p *PersistentConfig) hasVersions(sr *v1alpha1.SidecarResult) bool {
+	for version, url := range p.Result {
+		found := false
+		for _, v := range sr.Status.Versions {
+			if v.Type == p.Type && v.Version == version && v.URL == url &&
+				(p.Checksums[version] == "" || p.Checksums[version] == v.Checksum) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// patchPodResult replaces or appends the entry of the pod and refreshes the counters.
+// The counters are computed from the read object, so the patch tests its resourceVersion and fails
+// if another pod or the gc wrote it since it was read, the caller reads it again and retries.
+func (p *PersistentConfig) patchPodResult(ctx context.Context, client dynamic.ResourceInterface, sr *v1alpha1.SidecarResult, location *persistentLocation, now metav1.Time) error {
+	index := podResultIndex(sr, location, p.Type)
+	updated := sr.DeepCopy()
+	p.applyTo(updated, location, now)
+	pod := findPodResult(updated, location, p.Type)
+	var ops []jsonpatch.JsonPatchOperation
+	if sr.ResourceVersion != "" {
+		ops = append(ops, jsonpatch.NewOperation("test", "/metadata/resourceVersion", sr.ResourceVersion))
+	}
+	if index >= 0 {
+		path := fmt.Sprintf("/status/pods/%d", index)
+		ops = append(ops,
+			jsonpatch.NewOperation("test", path+"/namespace", location.PodNamespace),
+			jsonpatch.NewOperation("test", path+"/pod", location.PodName),
+			jsonpatch.NewOperation("test", path+"/type", p.Type),
+			jsonpatch.NewOperation("replace", path, pod),
+		)
+	} else {
+		ops = append(ops, jsonpatch.NewOperation("add", "/status/pods/-", pod))
+	}
+	ops = append(ops,
+		jsonpatch.NewOperation("add", "/status/totalPods", updated.Status.TotalPods),
+		jsonpatch.NewOperation("add", "/status/updatedPods", updated.Status.UpdatedPods),
+	)
+	patch, err := json.Marshal(ops)
+	if err != nil {
+		return fmt.Errorf("failed to marshal patch: %w", err)
+	}
+	_, err = client.Patch(ctx, sr.Name, types.JSONPatchType, patch, metav1.PatchOptions{}, "status")
+	return err
+}
+
+// applyTo records the versions of the result and the versions applied by the pod, and refreshes the summary
+func (p *PersistentConfig) applyTo(sr *v1alpha1.SidecarResult, location *persistentLocation, now metav1.Time) {
+	for version, url := range p.Result {
+		found := false
+		for i := range sr.Status.Versions {
+			v := &sr.Status.Versions[i]
+			if v.Type == p.Type && v.Version == version {
+				v.URL = url
+				if checksum := p.Checksums[version]; checksum != "" {
+					v.Checksum = checksum
+				}
+				found = true
+			}
+		}
+		if !found {
+			sr.Status.Versions = append(sr.Status.Versions, v1alpha1.ResultVersion{
+				Type:      p.Type,
+				Version:   version,
+				URL:       url,
+				Checksum:  p.Checksums[version],
+				CreatedAt: now,
+			})
+		}
+	}
+
+	pod := findPodResult(sr, location, p.Type)
+	if pod == nil {
+		sr.Status.Pods = append(sr.Status.Pods, v1alpha1.PodResult{
+			Namespace: location.PodNamespace,
+			Pod:       location.PodName,
+			Type:      p.Type,
+		})
+		pod = &sr.Status.Pods[len(sr.Status.Pods)-1]
+	}
+	applied := map[string]string{}
+	for _, version := range pod.Versions {
+		applied[version] = ""
+	}
+	for version := range p.Result {
+		applied[version] = ""
+	}
+	pruneVersions(applied, globalPersistence.MaxVersions)
+	pod.Versions = pod.Versions[:0]
+	for version := range applied {
+		pod.Versions = append(pod.Versions, version)
+	}
+	sortVersions(pod.Versions)
+	pod.UpdatedAt = now
+
+	summarize(sr)
+}
+
+// summarize counts the pods on the latest hot update version
+func summarize(sr *v1alpha1.SidecarResult) {
+	sr.Status.LatestVersion = ""
+	for _, v := range sr.Status.Versions {
+		if v.Type == constants.SidecarResultType && (sr.Status.LatestVersion == "" || compareVersions(v.Version, sr.Status.LatestVersion) > 0) {
+			sr.Status.LatestVersion = v.Version
+		}
+	}
+	sr.Status.TotalPods, sr.Status.UpdatedPods = 0, 0
+	for _, pod := range sr.Status.Pods {
+		if pod.Type != constants.SidecarResultType {
+			continue
+		}
+		sr.Status.TotalPods++
+		if len(pod.Versions) > 0 && pod.Versions[len(pod.Versions)-1] == sr.Status.LatestVersion {
+			sr.Status.UpdatedPods++
+		}
+	}
+}
+
+// sortVersions sorts the versions from the oldest to the latest like compareVersions
+func sortVersions(versions []string) {
+	sort.Slice(versions, func(i, j int) bool { return compareVersions(versions[i], versions[j]) < 0 })
+}
+
+func (p *PersistentConfig) watchSidecarResult(ctx context.Context, location *persistentLocation, handler func(result map[string]string)) error {
+	dyn := info.GetDynamicInterface()
+	if dyn == nil {
+		return fmt.Errorf("dynamic client is not set")
+	}
+	name := sidecarResultName(location)
+	for {
+		w, err := dyn.Resource(sidecarResultGvr).Namespace(location.Namespace).Watch(ctx, metav1.ListOptions{
+			FieldSelector: fields.OneTermEqualSelector("metadata.name", name).String(),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to watch sidecar result %s/%s: %w", location.Namespace, name, err)
+		}
+		for event := range w.ResultChan() {
+			obj, ok := event.Object.(*unstructured.Unstructured)
+			if !ok || (event.Type != watch.Added && event.Type != watch.Modified) {
+				continue
+			}
+			if sr, err := toSidecarResult(obj); err == nil {
+				handler(p.resultOfSidecarResult(sr, location))
+			}
+		}
+		w.Stop()
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -0,0 +1,247 @@
+/*
+Copyright 2024
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/magicsong/kidecar/api"
+	"github.com/magicsong/kidecar/api/v1alpha1"
+	"github.com/magicsong/kidecar/pkg/constants"
+	"github.com/magicsong/kidecar/pkg/info"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestPersistentConfig_SidecarResultBackend(t *testing.T) {
+	SetGlobalPersistence(&api.PersistenceConfig{Backend: api.PersistenceBackendSidecarResult})
+	defer SetGlobalPersistence(nil)
+	gssLabels := map[string]string{constants.GameServerSetLabelKey: "minecraft"}
+	info.SetGlobalKubeInterface(fake.NewSimpleClientset(
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "minecraft-0", Namespace: "game", Labels: gssLabels}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "minecraft-1", Namespace: "game", Labels: gssLabels}},
+	))
+	dyn := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		sidecarResultGvr: "SidecarResultList",
+	})
+	info.SetGlobalDynamicInterface(dyn)
+	defer info.SetGlobalDynamicInterface(nil)
+	t.Setenv("POD_NAMESPACE", "game")
+
+	t.Setenv("POD_NAME", "minecraft-0")
+	for _, version := range []string{"v1.0.0", "v1.1.0"} {
+		p := &PersistentConfig{
+			Type:      constants.SidecarResultType,
+			Result:    map[string]string{version: "url-" + version},
+			Checksums: map[string]string{version: "sum-" + version},
+		}
+		if err := p.SetPersistenceInfo(); err != nil {
+			t.Fatalf("SetPersistenceInfo() error = %v", err)
+		}
+	}
+	t.Setenv("POD_NAME", "minecraft-1")
+	p := &PersistentConfig{Type: constants.SidecarResultType, Result: map[string]string{"v1.0.0": "url-v1.0.0"}}
+	if err := p.SetPersistenceInfo(); err != nil {
+		t.Fatalf("SetPersistenceInfo() error = %v", err)
+	}
+
+	sr, err := getSidecarResult(context.TODO(), "game", "minecraft")
+	if err != nil {
+		t.Fatalf("failed to get sidecar result: %v", err)
+	}
+	if sr.Spec.GameServerSet != "minecraft" || len(sr.Status.Versions) != 2 || len(sr.Status.Pods) != 2 {
+		t.Fatalf("unexpected sidecar result %+v", sr)
+	}
+	if sr.Status.LatestVersion != "v1.1.0" || sr.Status.UpdatedPods != 1 || sr.Status.TotalPods != 2 {
+		t.Errorf("unexpected summary %+v", sr.Status)
+	}
+	for _, v := range sr.Status.Versions {
+		if v.Checksum != "sum-"+v.Version || v.CreatedAt.IsZero() {
+			t.Errorf("unexpected version %+v", v)
+		}
+	}
+
+	p = &PersistentConfig{Type: constants.SidecarResultType}
+	if err := p.GetPersistenceInfo(); err != nil {
+		t.Fatalf("GetPersistenceInfo() error = %v", err)
+	}
+	if len(p.Result) != 1 || p.Result["v1.0.0"] != "url-v1.0.0" {
+		t.Errorf("expected the versions of minecraft-1, got %v", p.Result)
+	}
+	// a new pod falls back to all versions of the GameServerSet
+	t.Setenv("POD_NAME", "minecraft-2")
+	info.SetGlobalKubeInterface(fake.NewSimpleClientset(
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "minecraft-2", Namespace: "game", Labels: gssLabels}},
+	))
+	p = &PersistentConfig{Type: constants.SidecarResultType}
+	if err := p.GetPersistenceInfo(); err != nil {
+		t.Fatalf("GetPersistenceInfo() error = %v", err)
+	}
+	if len(p.Result) != 2 || p.Result["v1.1.0"] != "url-v1.1.0" {
+		t.Errorf("expected all versions, got %v", p.Result)
+	}
+}
+
+func TestPersistentConfig_SidecarResultPatchRetriesMovedEntry(t *testing.T) {
+	SetGlobalPersistence(&api.PersistenceConfig{Backend: api.PersistenceBackendSidecarResult})
+	defer SetGlobalPersistence(nil)
+	info.SetGlobalKubeInterface(fake.NewSimpleClientset(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name: "minecraft-0", Namespace: "game", Labels: map[string]string{constants.GameServerSetLabelKey: "minecraft"},
+	}}))
+	dyn := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		sidecarResultGvr: "SidecarResultList",
+	})
+	info.SetGlobalDynamicInterface(dyn)
+	defer info.SetGlobalDynamicInterface(nil)
+	t.Setenv("POD_NAMESPACE", "game")
+	t.Setenv("POD_NAME", "minecraft-0")
+
+	store := func() {
+		p := &PersistentConfig{Type: constants.SidecarResultType, Result: map[string]string{"v1.0.0": "url-v1.0.0"}}
+		if err := p.SetPersistenceInfo(); err != nil {
+			t.Fatalf("SetPersistenceInfo() error = %v", err)
+		}
+	}
+	store()
+	var patches []string
+	dyn.PrependReactor("patch", "sidecarresults", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patches = append(patches, string(action.(k8stesting.PatchAction).GetPatch()))
+		if len(patches) == 1 {
+			// the gc pruned an entry before the one of the pod
+			return true, nil, apierrors.NewInvalid(schema.GroupKind{Kind: "SidecarResult"}, "minecraft", nil)
+		}
+		return false, nil, nil
+	})
+	store()
+
+	if len(patches) != 2 {
+		t.Fatalf("expected the patch to be retried once, got %v", patches)
+	}
+	if !strings.Contains(patches[0], `"op":"test","path":"/status/pods/0/pod","value":"minecraft-0"`) {
+		t.Errorf("expected the patch to test the entry of the pod, got %s", patches[0])
+	}
+	sr, err := getSidecarResult(context.TODO(), "game", "minecraft")
+	if err != nil {
+		t.Fatalf("failed to get sidecar result: %v", err)
+	}
+	if len(sr.Status.Pods) != 1 || sr.Status.TotalPods != 1 || sr.Status.UpdatedPods != 1 {
+		t.Errorf("unexpected status %+v", sr.Status)
+	}
+}
+
+func TestPersistentConfig_SidecarResultPatchRetriesConcurrentWrite(t *testing.T) {
+	SetGlobalPersistence(&api.PersistenceConfig{Backend: api.PersistenceBackendSidecarResult})
+	defer SetGlobalPersistence(nil)
+	gssLabels := map[string]string{constants.GameServerSetLabelKey: "minecraft"}
+	info.SetGlobalKubeInterface(fake.NewSimpleClientset(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "minecraft-1", Namespace: "game", Labels: gssLabels}}))
+	podResult := func(name string) v1alpha1.PodResult {
+		return v1alpha1.PodResult{Namespace: "game", Pod: name, Type: constants.SidecarResultType, Versions: []string{"v1.0.0"}}
+	}
+	sidecarResult := func(resourceVersion string, pods ...string) *unstructured.Unstructured {
+		sr := &v1alpha1.SidecarResult{
+			ObjectMeta: metav1.ObjectMeta{Name: "minecraft", Namespace: "game", ResourceVersion: resourceVersion},
+			Status: v1alpha1.SidecarResultStatus{
+				Versions: []v1alpha1.ResultVersion{{Type: constants.SidecarResultType, Version: "v1.0.0", URL: "url-v1.0.0"}},
+			},
+		}
+		for _, pod := range pods {
+			sr.Status.Pods = append(sr.Status.Pods, podResult(pod))
+		}
+		summarize(sr)
+		obj, err := fromSidecarResult(sr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return obj
+	}
+	dyn := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		sidecarResultGvr: "SidecarResultList",
+	}, sidecarResult("1", "minecraft-0"))
+	info.SetGlobalDynamicInterface(dyn)
+	defer info.SetGlobalDynamicInterface(nil)
+	t.Setenv("POD_NAMESPACE", "game")
+	t.Setenv("POD_NAME", "minecraft-1")
+
+	var patches []string
+	dyn.PrependReactor("patch", "sidecarresults", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patches = append(patches, string(action.(k8stesting.PatchAction).GetPatch()))
+		if len(patches) == 1 {
+			// minecraft-2 wrote its result since minecraft-1 read the object, the test of the resourceVersion fails
+			if err := dyn.Tracker().Update(sidecarResultGvr, sidecarResult("2", "minecraft-0", "minecraft-2"), "game"); err != nil {
+				t.Fatal(err)
+			}
+			return true, nil, apierrors.NewInvalid(schema.GroupKind{Kind: "SidecarResult"}, "minecraft", nil)
+		}
+		return false, nil, nil
+	})
+	p := &PersistentConfig{Type: constants.SidecarResultType, Result: map[string]string{"v1.0.0": "url-v1.0.0"}}
+	if err := p.SetPersistenceInfo(); err != nil {
+		t.Fatalf("SetPersistenceInfo() error = %v", err)
+	}
+
+	if len(patches) != 2 || !strings.Contains(patches[0], `{"op":"test","path":"/metadata/resourceVersion","value":"1"}`) ||
+		!strings.Contains(patches[1], `{"op":"test","path":"/metadata/resourceVersion","value":"2"}`) {
+		t.Fatalf("expected the patch to test the read resourceVersion and be retried, got %v", patches)
+	}
+	sr, err := getSidecarResult(context.TODO(), "game", "minecraft")
+	if err != nil {
+		t.Fatalf("failed to get sidecar result: %v", err)
+	}
+	if len(sr.Status.Pods) != 3 || sr.Status.TotalPods != 3 || sr.Status.UpdatedPods != 3 {
+		t.Errorf("expected the counters of all three pods, got %+v", sr.Status)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	tests := []struct {
+		name     string
+		versions []string
+		pods     [][]string
+		latest   string
+		updated  int32
+	}{
+		{name: "Semantic", versions: []string{"v1.1.0", "v1.0.0"}, pods: [][]string{{"v1.0.0", "v1.1.0"}, {"v1.0.0"}}, latest: "v1.1.0", updated: 1},
+		{name: "NonSemantic", versions: []string{"1.1", "1.0"}, pods: [][]string{{"1.0", "1.1"}, {"1.0"}}, latest: "1.1", updated: 1},
+		{name: "Mixed", versions: []string{"build-42", "v1.0.0"}, pods: [][]string{{"build-42", "v1.0.0"}}, latest: "v1.0.0", updated: 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sr := &v1alpha1.SidecarResult{}
+			for _, v := range tc.versions {
+				sr.Status.Versions = append(sr.Status.Versions, v1alpha1.ResultVersion{Type: constants.SidecarResultType, Version: v})
+			}
+			for i, versions := range tc.pods {
+				sortVersions(versions)
+				sr.Status.Pods = append(sr.Status.Pods, v1alpha1.PodResult{Pod: fmt.Sprintf("pod-%d", i), Type: constants.SidecarResultType, Versions: versions})
+			}
+			summarize(sr)
+			if sr.Status.LatestVersion != tc.latest || sr.Status.UpdatedPods != tc.updated || int(sr.Status.TotalPods) != len(tc.pods) {
+				t.Errorf("unexpected summary %+v", sr.Status)
+			}
+		})
+	}
+}
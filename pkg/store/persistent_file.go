@@ -0,0 +1,118 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/magicsong/kidecar/api"
+	"github.com/magicsong/kidecar/pkg/utils"
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// persistentFileLock serializes the writers of this process, the rename keeps readers consistent
+var persistentFileLock sync.Mutex
+
+func persistentFilePath() string {
+	if globalPersistence.Path != "" {
+		return globalPersistence.Path
+	}
+	return api.DefaultPersistencePath
+}
+
+// readPersistentFile returns the entries of the pods like the data of the result ConfigMap
+func readPersistentFile(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	data := map[string]string{}
+	if err := yaml.Unmarshal(content, &data); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %s: %w", path, err)
+	}
+	return data, nil
+}
+
+func (p *PersistentConfig) getFromFile(location *persistentLocation) error {
+	data, err := readPersistentFile(persistentFilePath())
+	if err != nil {
+		return err
+	}
+	result, err := p.resultOf(&corev1.ConfigMap{Data: data}, location.PodKey)
+	if err != nil {
+		return err
+	}
+	p.Result = result
+	return nil
+}
+
+func (p *PersistentConfig) setToFile(location *persistentLocation) error {
+	persistentFileLock.Lock()
+	defer persistentFileLock.Unlock()
+	path := persistentFilePath()
+	data, err := readPersistentFile(path)
+	if err != nil {
+		return err
+	}
+	entry, err := p.mergeEntry(data[location.PodKey], location)
+	if err != nil {
+		return err
+	}
+	data[location.PodKey] = string(entry)
+	content, err := yaml.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %w", path, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create dir of %s: %w", path, err)
+	}
+	return utils.WriteFileAtomic(path, content)
+}
+
+// watchFile polls the file like the File storage, shared volumes do not reliably support inotify
+func (p *PersistentConfig) watchFile(ctx context.Context, location *persistentLocation, handler func(result map[string]string)) error {
+	path := persistentFilePath()
+	var last []byte
+	ticker := time.NewTicker(fileWatchInterval)
+	defer ticker.Stop()
+	for {
+		content, err := os.ReadFile(path)
+		if err == nil && string(content) != string(last) {
+			last = content
+			data := map[string]string{}
+			if err := yaml.Unmarshal(content, &data); err == nil {
+				if result, err := p.resultOf(&corev1.ConfigMap{Data: data}, location.PodKey); err == nil {
+					handler(result)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/magicsong/kidecar/api"
+	"github.com/magicsong/kidecar/pkg/info"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPersistentConfig_StandaloneFile(t *testing.T) {
+	info.SetStandalonePod(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "game-0", Namespace: "local"}})
+	defer info.SetStandalonePod(nil)
+	SetGlobalPersistence(&api.PersistenceConfig{
+		Backend:     api.PersistenceBackendFile,
+		Path:        filepath.Join(t.TempDir(), "results", "sidecar-result.yaml"),
+		MaxVersions: 2,
+	})
+	defer SetGlobalPersistence(nil)
+	interval := fileWatchInterval
+	fileWatchInterval = 10 * time.Millisecond
+	defer func() { fileWatchInterval = interval }()
+
+	empty := &PersistentConfig{Type: "hot_update"}
+	if err := empty.GetPersistenceInfo(); err != nil || len(empty.Result) != 0 {
+		t.Fatalf("Expected no result before the first write, got %v, err: %v", empty.Result, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watched := make(chan map[string]string, 10)
+	go (&PersistentConfig{Type: "hot_update"}).Watch(ctx, func(result map[string]string) { watched <- result })
+
+	for _, version := range []string{"v1", "v2", "v3"} {
+		p := &PersistentConfig{Type: "hot_update", Result: map[string]string{version: "url-" + version}}
+		if err := p.SetPersistenceInfo(); err != nil {
+			t.Fatalf("Failed to set %s: %v", version, err)
+		}
+	}
+	got := &PersistentConfig{Type: "hot_update"}
+	if err := got.GetPersistenceInfo(); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"v2": "url-v2", "v3": "url-v3"}
+	if !reflect.DeepEqual(got.Result, expected) {
+		t.Errorf("Expected %v, but got %v", expected, got.Result)
+	}
+
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case result := <-watched:
+			if reflect.DeepEqual(result, expected) {
+				return
+			}
+		case <-deadline:
+			t.Fatal("Watch did not see the latest result")
+		}
+	}
+}
+
+func TestStorageFactory_Standalone(t *testing.T) {
+	info.SetStandalonePod(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "game-0", Namespace: "local"}})
+	defer info.SetStandalonePod(nil)
+	factory := NewStorageFactory(nil)
+	if _, err := factory.GetStorage(StorageTypeInKube); !errors.Is(err, info.ErrStandalone) {
+		t.Errorf("Expected InKube to be unavailable, got: %v", err)
+	}
+	if _, err := factory.GetStorage(StorageTypeFile); err != nil {
+		t.Errorf("Expected File to be available, got: %v", err)
+	}
+}
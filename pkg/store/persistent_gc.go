@@ -0,0 +1,395 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/magicsong/kidecar/api"
+	"github.com/magicsong/kidecar/api/v1alpha1"
+	"github.com/magicsong/kidecar/pkg/constants"
+	"golang.org/x/mod/semver"
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	defaultGCIntervalSeconds = 600
+
+	gcLeaseDuration = 60 * time.Second
+	gcRenewDeadline = 40 * time.Second
+	gcRetryPeriod   = 10 * time.Second
+)
+
+// PersistentGC prunes the persisted results of pods which are gone, or which are not updated within the ttl
+type PersistentGC struct {
+	kube    kubernetes.Interface
+	dynamic dynamic.Interface
+	config  *api.PersistenceConfig
+	log     logr.Logger
+}
+
+// persistentEntry is the data of one pod in a result ConfigMap
+type persistentEntry struct {
+	cm        *corev1.ConfigMap
+	key       string
+	results   map[string]map[string]string
+	pod       types.NamespacedName
+	updatedAt time.Time
+}
+
+func NewPersistentGC(kube kubernetes.Interface, dyn dynamic.Interface, config *api.PersistenceConfig) *PersistentGC {
+	if config == nil {
+		config = &api.PersistenceConfig{}
+	}
+	return &PersistentGC{
+		kube:    kube,
+		dynamic: dyn,
+		config:  config,
+		log:     logf.Log.WithName("persistent_gc"),
+	}
+}
+
+// Run collects periodically while the sidecar holds the lease, until the context is done
+func (g *PersistentGC) Run(ctx context.Context) error {
+	location, err := resolvePersistentLocation(g.config)
+	if err != nil {
+		return err
+	}
+	leaseName := ""
+	if g.config.GC != nil {
+		leaseName = g.config.GC.LeaseName
+	}
+	if leaseName == "" {
+		leaseName = location.Labels[constants.SidecarResultLabelKey] + "-gc"
+	}
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: leaseName, Namespace: location.Namespace},
+		Client:     g.kube.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: location.PodKey},
+	}
+	for {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   gcLeaseDuration,
+			RenewDeadline:   gcRenewDeadline,
+			RetryPeriod:     gcRetryPeriod,
+			ReleaseOnCancel: true,
+			Name:            leaseName,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					g.log.Info("start collecting persisted results", "namespace", location.Namespace)
+					g.loop(ctx, location.Namespace)
+				},
+				OnStoppedLeading: func() {
+					g.log.Info("stop collecting persisted results")
+				},
+			},
+		})
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(gcRetryPeriod):
+		}
+	}
+}
+
+func (g *PersistentGC) loop(ctx context.Context, namespace string) {
+	interval := defaultGCIntervalSeconds
+	if g.config.GC != nil && g.config.GC.IntervalSeconds > 0 {
+		interval = g.config.GC.IntervalSeconds
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		pruned, err := g.Collect(ctx, namespace, time.Now())
+		if err != nil {
+			g.log.Error(err, "failed to collect persisted results")
+		} else {
+			g.log.Info("collected persisted results", "pruned", pruned)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Collect prunes the stale entries of the result ConfigMaps in the namespace and returns how many were pruned.
+// The latest version of every result type in a GameServerSet is kept, new pods fall back to it.
+// With the SidecarResult backend the stale pods are pruned from the SidecarResults instead.
+func (g *PersistentGC) Collect(ctx context.Context, namespace string, now time.Time) (int, error) {
+	name := g.config.ConfigMapName
+	if name == "" {
+		name = constants.SidecarResultConfigMapName
+	}
+	if g.config.Backend == api.PersistenceBackendSidecarResult {
+		return g.collectSidecarResults(ctx, namespace, name, now)
+	}
+	cms, err := g.kube.CoreV1().ConfigMaps(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{constants.SidecarResultLabelKey: name}).String(),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list result configmaps: %w", err)
+	}
+	groups := map[string][]*persistentEntry{}
+	for i := range cms.Items {
+		cm := &cms.Items[i]
+		gss := cm.Labels[constants.GameServerSetLabelKey]
+		for key, data := range cm.Data {
+			entry := &persistentEntry{cm: cm, key: key, results: map[string]map[string]string{}}
+			if err := yaml.Unmarshal([]byte(data), &entry.results); err != nil {
+				g.log.Error(err, "skip corrupted entry", "configmap", cm.Name, "key", key)
+				continue
+			}
+			entry.parseMeta()
+			groups[gss] = append(groups[gss], entry)
+		}
+	}
+
+	pruned := 0
+	for _, entries := range groups {
+		var stale []*persistentEntry
+		var alive []*persistentEntry
+		for _, entry := range entries {
+			isStale, err := g.isStale(ctx, entry, now)
+			if err != nil {
+				return pruned, err
+			}
+			if isStale {
+				stale = append(stale, entry)
+			} else {
+				alive = append(alive, entry)
+			}
+		}
+		stale = keepLatestVersions(stale, alive)
+		byConfigMap := map[*corev1.ConfigMap][]*persistentEntry{}
+		for _, entry := range stale {
+			byConfigMap[entry.cm] = append(byConfigMap[entry.cm], entry)
+		}
+		for cm, entries := range byConfigMap {
+			n, err := g.prune(ctx, cm, entries)
+			if err != nil {
+				return pruned, err
+			}
+			pruned += n
+		}
+	}
+	return pruned, nil
+}
+
+func (e *persistentEntry) parseMeta() {
+	meta := e.results[persistentMetaKey]
+	delete(e.results, persistentMetaKey)
+	if meta != nil {
+		e.pod = types.NamespacedName{Namespace: meta[persistentMetaNamespace], Name: meta[persistentMetaName]}
+		e.updatedAt, _ = time.Parse(time.RFC3339, meta[persistentMetaUpdatedAt])
+		return
+	}
+	// entries written before the meta was recorded, the key is <namespace>-<name> of a pod in the same namespace
+	if name, ok := strings.CutPrefix(e.key, e.cm.Namespace+"-"); ok {
+		e.pod = types.NamespacedName{Namespace: e.cm.Namespace, Name: name}
+	}
+}
+
+// isStale returns true if the pod and the GameServer of the entry are gone.
+// The ttl prunes an entry whose pod is gone while the GameServer exists, the entry of a running pod is always kept.
+func (g *PersistentGC) isStale(ctx context.Context, entry *persistentEntry, now time.Time) (bool, error) {
+	if entry.pod.Name == "" {
+		return false, nil
+	}
+	_, err := g.kube.CoreV1().Pods(entry.pod.Namespace).Get(ctx, entry.pod.Name, metav1.GetOptions{})
+	if err == nil || !apierrors.IsNotFound(err) {
+		return false, ignoreNotFound(err)
+	}
+	// the pod may be recreated soon, the GameServer outlives it
+	_, err = g.dynamic.Resource(gameServerGvr).Namespace(entry.pod.Namespace).Get(ctx, entry.pod.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	expired := g.config.GC != nil && g.config.GC.TTLSeconds > 0 && !entry.updatedAt.IsZero() &&
+		now.Sub(entry.updatedAt) > time.Duration(g.config.GC.TTLSeconds)*time.Second
+	return expired, nil
+}
+
+// compareVersions orders semantic versions, versions which are not semantic or compare equal are ordered as strings
+func compareVersions(a, b string) int {
+	if c := semver.Compare(a, b); c != 0 {
+		return c
+	}
+	return strings.Compare(a, b)
+}
+
+// keepLatestVersions removes from stale the entries holding a latest version of the group no alive entry holds
+func keepLatestVersions(stale, alive []*persistentEntry) []*persistentEntry {
+	latest := map[string]string{}
+	for _, entries := range [][]*persistentEntry{stale, alive} {
+		for _, entry := range entries {
+			for resultType, versions := range entry.results {
+				for version := range versions {
+					if current, ok := latest[resultType]; !ok || compareVersions(version, current) > 0 {
+						latest[resultType] = version
+					}
+				}
+			}
+		}
+	}
+	keep := map[*persistentEntry]bool{}
+	for resultType, version := range latest {
+		if holder(alive, resultType, version) != nil {
+			continue
+		}
+		if h := holder(stale, resultType, version); h != nil {
+			keep[h] = true
+		}
+	}
+	result := stale[:0]
+	for _, entry := range stale {
+		if !keep[entry] {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// holder returns the most recently updated entry holding the version of the result type, ties are broken by key
+func holder(entries []*persistentEntry, resultType, version string) *persistentEntry {
+	var found *persistentEntry
+	for _, entry := range entries {
+		if _, ok := entry.results[resultType][version]; !ok {
+			continue
+		}
+		if found == nil || entry.updatedAt.After(found.updatedAt) ||
+			(entry.updatedAt.Equal(found.updatedAt) && entry.key > found.key) {
+			found = entry
+		}
+	}
+	return found
+}
+
+// prune removes only the keys of the entries, the other pods keep writing to the ConfigMap.
+// The patch requires the listed resourceVersion, if the ConfigMap was written since then
+// the entries are skipped and checked again by the next collection.
+func (g *PersistentGC) prune(ctx context.Context, cm *corev1.ConfigMap, entries []*persistentEntry) (int, error) {
+	data := map[string]interface{}{}
+	for _, entry := range entries {
+		data[entry.key] = nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"resourceVersion": cm.ResourceVersion},
+		"data":     data,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal patch: %w", err)
+	}
+	_, err = g.kube.CoreV1().ConfigMaps(cm.Namespace).Patch(ctx, cm.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if apierrors.IsConflict(err) || apierrors.IsNotFound(err) {
+		g.log.Info("configmap changed since it was listed, prune it later", "configmap", cm.Name)
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune configmap %s/%s: %w", cm.Namespace, cm.Name, err)
+	}
+	for _, entry := range entries {
+		g.log.Info("pruned persisted result", "configmap", cm.Name, "key", entry.key, "pod", entry.pod)
+	}
+	return len(entries), nil
+}
+
+// collectSidecarResults prunes the stale pods from the status of the SidecarResults, the versions are kept for new pods.
+// The update requires the listed resourceVersion, a SidecarResult written since then is checked again by the next collection.
+func (g *PersistentGC) collectSidecarResults(ctx context.Context, namespace, name string, now time.Time) (int, error) {
+	list, err := g.dynamic.Resource(sidecarResultGvr).Namespace(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{constants.SidecarResultLabelKey: name}).String(),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list sidecar results: %w", err)
+	}
+	pruned := 0
+	for i := range list.Items {
+		sr, err := toSidecarResult(&list.Items[i])
+		if err != nil {
+			g.log.Error(err, "skip corrupted sidecar result", "name", list.Items[i].GetName())
+			continue
+		}
+		var stale []v1alpha1.PodResult
+		kept := make([]v1alpha1.PodResult, 0, len(sr.Status.Pods))
+		for _, pod := range sr.Status.Pods {
+			entry := &persistentEntry{
+				key:       pod.Namespace + "/" + pod.Pod,
+				pod:       types.NamespacedName{Namespace: pod.Namespace, Name: pod.Pod},
+				updatedAt: pod.UpdatedAt.Time,
+			}
+			isStale, err := g.isStale(ctx, entry, now)
+			if err != nil {
+				return pruned, err
+			}
+			if isStale {
+				stale = append(stale, pod)
+			} else {
+				kept = append(kept, pod)
+			}
+		}
+		if len(stale) == 0 {
+			continue
+		}
+		sr.Status.Pods = kept
+		summarize(sr)
+		obj, err := fromSidecarResult(sr)
+		if err != nil {
+			return pruned, err
+		}
+		_, err = g.dynamic.Resource(sidecarResultGvr).Namespace(namespace).UpdateStatus(ctx, obj, metav1.UpdateOptions{})
+		if apierrors.IsConflict(err) || apierrors.IsNotFound(err) {
+			g.log.Info("sidecar result changed since it was listed, prune it later", "sidecarresult", sr.Name)
+			continue
+		}
+		if err != nil {
+			return pruned, fmt.Errorf("failed to prune sidecar result %s/%s: %w", namespace, sr.Name, err)
+		}
+		for _, pod := range stale {
+			g.log.Info("pruned persisted result", "sidecarresult", sr.Name, "pod", pod.Namespace+"/"+pod.Pod, "type", pod.Type)
+		}
+		pruned += len(stale)
+	}
+	return pruned, nil
+}
+
+func ignoreNotFound(err error) error {
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
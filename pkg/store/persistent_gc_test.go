@@ -0,0 +1,229 @@
+/*
+Copyright 2024
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/magicsong/kidecar/api"
+	"github.com/magicsong/kidecar/api/v1alpha1"
+	"github.com/magicsong/kidecar/pkg/constants"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func persistentEntryData(name, version string, updatedAt time.Time) string {
+	return "_meta:\n" +
+		"  namespace: game\n" +
+		"  name: " + name + "\n" +
+		"  updatedAt: " + updatedAt.UTC().Format(time.RFC3339) + "\n" +
+		"hot_update:\n" +
+		"  " + version + ": url-" + version + "\n"
+}
+
+func TestPersistentGC_Collect(t *testing.T) {
+	now := time.Now()
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "sidecar-result-minecraft",
+			Namespace: "game",
+			Labels: map[string]string{
+				constants.SidecarResultLabelKey: constants.SidecarResultConfigMapName,
+				constants.GameServerSetLabelKey: "minecraft",
+			},
+		},
+		Data: map[string]string{
+			// pod exists
+			"game-minecraft-0": persistentEntryData("minecraft-0", "v1.0.0", now),
+			// pod is gone but the GameServer exists
+			"game-minecraft-1": persistentEntryData("minecraft-1", "v1.0.0", now),
+			// pod and GameServer are gone, but it holds the latest version
+			"game-minecraft-2": persistentEntryData("minecraft-2", "v1.1.0", now),
+			// pod and GameServer are gone
+			"game-minecraft-3": persistentEntryData("minecraft-3", "v1.0.0", now),
+			// pod exists, the ttl does not apply to a running pod
+			"game-minecraft-4": persistentEntryData("minecraft-4", "v1.0.0", now.Add(-2*time.Hour)),
+			// written before the meta was recorded, pod and GameServer are gone
+			"game-minecraft-5": "hot_update:\n  v1.0.0: url-v1.0.0\n",
+			// pod is gone and the entry is older than the ttl, the GameServer exists
+			"game-minecraft-6": persistentEntryData("minecraft-6", "v1.0.0", now.Add(-2*time.Hour)),
+		},
+	}
+	kube := fake.NewSimpleClientset(cm,
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "minecraft-0", Namespace: "game"}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "minecraft-4", Namespace: "game"}},
+	)
+	gs := newTestObject(gsGvr, "GameServer", "minecraft-1", nil, nil)
+	gs.SetNamespace("game")
+	expiredGs := newTestObject(gsGvr, "GameServer", "minecraft-6", nil, nil)
+	expiredGs.SetNamespace("game")
+	dyn := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		gsGvr: "GameServerList",
+	}, gs, expiredGs)
+
+	gc := NewPersistentGC(kube, dyn, &api.PersistenceConfig{GC: &api.PersistenceGCConfig{TTLSeconds: 3600}})
+	pruned, err := gc.Collect(context.TODO(), "game", now)
+	if err != nil {
+		t.Fatalf("Collect() error = %v", err)
+	}
+	if pruned != 3 {
+		t.Errorf("expected 3 pruned entries, got %d", pruned)
+	}
+	got, err := kube.CoreV1().ConfigMaps("game").Get(context.TODO(), cm.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get configmap: %v", err)
+	}
+	for _, key := range []string{"game-minecraft-0", "game-minecraft-1", "game-minecraft-2", "game-minecraft-4"} {
+		if _, ok := got.Data[key]; !ok {
+			t.Errorf("entry %s should be kept", key)
+		}
+	}
+	for _, key := range []string{"game-minecraft-3", "game-minecraft-5", "game-minecraft-6"} {
+		if _, ok := got.Data[key]; ok {
+			t.Errorf("entry %s should be pruned", key)
+		}
+	}
+}
+
+func TestPersistentGC_CollectSkipsChangedConfigMap(t *testing.T) {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "sidecar-result-minecraft",
+			Namespace: "game",
+			Labels:    map[string]string{constants.SidecarResultLabelKey: constants.SidecarResultConfigMapName},
+		},
+		Data: map[string]string{
+			"game-minecraft-0": persistentEntryData("minecraft-0", "v1.0.0", time.Now()),
+			"game-minecraft-1": persistentEntryData("minecraft-1", "v1.1.0", time.Now()),
+		},
+	}
+	kube := fake.NewSimpleClientset(cm)
+	var patch map[string]interface{}
+	kube.PrependReactor("patch", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		json.Unmarshal(action.(k8stesting.PatchAction).GetPatch(), &patch)
+		// a pod wrote its result between the list and the prune
+		return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "configmaps"}, cm.Name, fmt.Errorf("changed"))
+	})
+	dyn := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		gsGvr: "GameServerList",
+	})
+
+	gc := NewPersistentGC(kube, dyn, &api.PersistenceConfig{})
+	pruned, err := gc.Collect(context.TODO(), "game", time.Now())
+	if err != nil {
+		t.Fatalf("Collect() error = %v", err)
+	}
+	if pruned != 0 {
+		t.Errorf("expected nothing pruned after a conflict, got %d", pruned)
+	}
+	if _, ok := patch["metadata"].(map[string]interface{})["resourceVersion"]; !ok {
+		t.Errorf("expected the prune to require the listed resourceVersion, got %v", patch)
+	}
+}
+
+func TestPersistentGC_CollectSidecarResults(t *testing.T) {
+	now := time.Now()
+	pod := func(name, version string, updatedAt time.Time) v1alpha1.PodResult {
+		return v1alpha1.PodResult{Namespace: "game", Pod: name, Type: constants.SidecarResultType, Versions: []string{version}, UpdatedAt: metav1.NewTime(updatedAt)}
+	}
+	sr := &v1alpha1.SidecarResult{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "minecraft",
+			Namespace: "game",
+			Labels:    map[string]string{constants.SidecarResultLabelKey: constants.SidecarResultConfigMapName},
+		},
+		Status: v1alpha1.SidecarResultStatus{
+			Versions: []v1alpha1.ResultVersion{
+				{Type: constants.SidecarResultType, Version: "v1.0.0", URL: "url-v1.0.0"},
+				{Type: constants.SidecarResultType, Version: "v1.1.0", URL: "url-v1.1.0"},
+			},
+			Pods: []v1alpha1.PodResult{
+				// pod exists
+				pod("minecraft-0", "v1.0.0", now.Add(-2*time.Hour)),
+				// pod is gone but the GameServer exists
+				pod("minecraft-1", "v1.0.0", now),
+				// pod and GameServer are gone
+				pod("minecraft-2", "v1.1.0", now),
+				// pod is gone and the entry is older than the ttl, the GameServer exists
+				pod("minecraft-3", "v1.0.0", now.Add(-2*time.Hour)),
+			},
+			TotalPods: 4,
+		},
+	}
+	obj, err := fromSidecarResult(sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kube := fake.NewSimpleClientset(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "minecraft-0", Namespace: "game"}})
+	gs := newTestObject(gsGvr, "GameServer", "minecraft-1", nil, nil)
+	gs.SetNamespace("game")
+	expiredGs := newTestObject(gsGvr, "GameServer", "minecraft-3", nil, nil)
+	expiredGs.SetNamespace("game")
+	dyn := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		gsGvr:            "GameServerList",
+		sidecarResultGvr: "SidecarResultList",
+	}, obj, gs, expiredGs)
+
+	gc := NewPersistentGC(kube, dyn, &api.PersistenceConfig{
+		Backend: api.PersistenceBackendSidecarResult,
+		GC:      &api.PersistenceGCConfig{TTLSeconds: 3600},
+	})
+	pruned, err := gc.Collect(context.TODO(), "game", now)
+	if err != nil {
+		t.Fatalf("Collect() error = %v", err)
+	}
+	if pruned != 2 {
+		t.Errorf("expected 2 pruned pods, got %d", pruned)
+	}
+	updated, err := dyn.Resource(sidecarResultGvr).Namespace("game").Get(context.TODO(), "minecraft", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get sidecar result: %v", err)
+	}
+	got, err := toSidecarResult(updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Status.Pods) != 2 || got.Status.Pods[0].Pod != "minecraft-0" || got.Status.Pods[1].Pod != "minecraft-1" {
+		t.Errorf("expected minecraft-0 and minecraft-1 to be kept, got %+v", got.Status.Pods)
+	}
+	if len(got.Status.Versions) != 2 || got.Status.TotalPods != 2 || got.Status.LatestVersion != "v1.1.0" {
+		t.Errorf("expected the versions to be kept and the summary refreshed, got %+v", got.Status)
+	}
+}
+
+func TestKeepLatestVersions_NonSemanticVersions(t *testing.T) {
+	entry := func(key, version string) *persistentEntry {
+		return &persistentEntry{key: key, results: map[string]map[string]string{"hot_update": {version: "url"}}}
+	}
+	for i := 0; i < 20; i++ {
+		stale := []*persistentEntry{entry("a", "20240101"), entry("b", "20240301"), entry("c", "20240201")}
+		pruned := keepLatestVersions(stale, nil)
+		if len(pruned) != 2 || pruned[0].key != "a" || pruned[1].key != "c" {
+			t.Fatalf("expected the entry of version 20240301 to be kept, pruned %v", pruned)
+		}
+	}
+}
@@ -18,18 +18,31 @@ package store
 
 import (
 	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/magicsong/kidecar/pkg/constants"
 
 	"github.com/agiledragon/gomonkey/v2"
+	"github.com/magicsong/kidecar/api"
 	"github.com/magicsong/kidecar/pkg/info"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 func TestPersistentConfig_GetPersistenceInfo(t *testing.T) {
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
 
-	gomonkey.ApplyFunc(info.GetConfigmap, func(ctx context.Context, name string, namespace string) (*corev1.ConfigMap, error) {
+	patches.ApplyFunc(info.GetConfigmap, func(ctx context.Context, name string, namespace string) (*corev1.ConfigMap, error) {
 		return &corev1.ConfigMap{
 			Data: map[string]string{
 				"pod1-default": `    hot_update:
@@ -41,9 +54,17 @@ func TestPersistentConfig_GetPersistenceInfo(t *testing.T) {
 		}, nil
 	})
 
-	gomonkey.ApplyFunc(info.GetCurrentPodInfo, func() (string, error) {
+	patches.ApplyFunc(info.GetCurrentPodInfo, func() (string, error) {
 		return "pod1-default", nil
 	})
+
+	patches.ApplyFunc(info.GetCurrentPodNamespaceAndName, func() (*types.NamespacedName, error) {
+		return &types.NamespacedName{Namespace: "default", Name: "pod1"}, nil
+	})
+
+	patches.ApplyFunc(info.GetCurrentPod, func() (*corev1.Pod, error) {
+		return &corev1.Pod{}, nil
+	})
 	type fields struct {
 		Type   string
 		Result map[string]string
@@ -78,18 +99,28 @@ func TestPersistentConfig_GetPersistenceInfo(t *testing.T) {
 }
 
 func TestPersistentConfig_SetPersistenceInfo(t *testing.T) {
-	gomonkey.ApplyFunc(info.GetConfigmap, func(ctx context.Context, name string, namespace string) (*corev1.ConfigMap, error) {
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
+	patches.ApplyFunc(info.GetConfigmap, func(ctx context.Context, name string, namespace string) (*corev1.ConfigMap, error) {
 		return &corev1.ConfigMap{}, nil
 	})
 
-	gomonkey.ApplyFunc(info.UpdateConfigmap, func(ctx context.Context, cm *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	patches.ApplyFunc(info.PatchConfigmap, func(ctx context.Context, name, namespace string, patch []byte) (*corev1.ConfigMap, error) {
 		return nil, nil
 	})
 
-	gomonkey.ApplyFunc(info.GetCurrentPodInfo, func() (string, error) {
+	patches.ApplyFunc(info.GetCurrentPodInfo, func() (string, error) {
 		return "pod1-default", nil
 	})
 
+	patches.ApplyFunc(info.GetCurrentPodNamespaceAndName, func() (*types.NamespacedName, error) {
+		return &types.NamespacedName{Namespace: "default", Name: "pod1"}, nil
+	})
+
+	patches.ApplyFunc(info.GetCurrentPod, func() (*corev1.Pod, error) {
+		return &corev1.Pod{}, nil
+	})
+
 	type fields struct {
 		Type   string
 		Result map[string]string
@@ -122,3 +153,191 @@ func TestPersistentConfig_SetPersistenceInfo(t *testing.T) {
 		})
 	}
 }
+
+func TestPersistentConfig_Sharding(t *testing.T) {
+	SetGlobalPersistence(&api.PersistenceConfig{Shards: 4, MaxVersions: 2})
+	defer SetGlobalPersistence(nil)
+	gssLabels := map[string]string{constants.GameServerSetLabelKey: "minecraft"}
+	client := fake.NewSimpleClientset(
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "minecraft-0", Namespace: "game", Labels: gssLabels}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "minecraft-1", Namespace: "game", Labels: gssLabels}},
+	)
+	info.SetGlobalKubeInterface(client)
+	t.Setenv("POD_NAMESPACE", "game")
+
+	t.Setenv("POD_NAME", "minecraft-0")
+	location, err := resolvePersistentLocation(globalPersistence)
+	if err != nil {
+		t.Fatalf("resolvePersistentLocation() error = %v", err)
+	}
+	if location.Namespace != "game" || !strings.HasPrefix(location.Name, "sidecar-result-minecraft-") {
+		t.Errorf("unexpected location %s", location)
+	}
+	for _, version := range []string{"v1.0.0", "v1.1.0", "v1.2.0"} {
+		p := &PersistentConfig{Type: constants.SidecarResultType, Result: map[string]string{version: "url-" + version}}
+		if err := p.SetPersistenceInfo(); err != nil {
+			t.Fatalf("SetPersistenceInfo() error = %v", err)
+		}
+	}
+	p := &PersistentConfig{Type: constants.SidecarResultType}
+	if err := p.GetPersistenceInfo(); err != nil {
+		t.Fatalf("GetPersistenceInfo() error = %v", err)
+	}
+	if len(p.Result) != 2 || p.Result["v1.0.0"] != "" || p.Result["v1.2.0"] == "" {
+		t.Errorf("expected the latest 2 versions, got %v", p.Result)
+	}
+
+	// a new pod of the GameServerSet falls back to the results of the other shards
+	t.Setenv("POD_NAME", "minecraft-1")
+	p = &PersistentConfig{Type: constants.SidecarResultType}
+	if err := p.GetPersistenceInfo(); err != nil {
+		t.Fatalf("GetPersistenceInfo() error = %v", err)
+	}
+	if p.Result["v1.2.0"] != "url-v1.2.0" {
+		t.Errorf("expected fallback to the GameServerSet results, got %v", p.Result)
+	}
+}
+
+// newConflictCheckingClient serializes the configmap requests and rejects stale updates like the api server,
+// the fake tracker alone applies patches without locking and ignores resourceVersion
+func newConflictCheckingClient(objects ...runtime.Object) *fake.Clientset {
+	client := fake.NewSimpleClientset(objects...)
+	var mu sync.Mutex
+	version := 1
+	react := k8stesting.ObjectReaction(client.Tracker())
+	client.PrependReactor("*", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if update, ok := action.(k8stesting.UpdateActionImpl); ok {
+			cm := update.GetObject().(*corev1.ConfigMap)
+			existing, err := client.Tracker().Get(action.GetResource(), cm.Namespace, cm.Name)
+			if err != nil {
+				return true, nil, err
+			}
+			if existing.(*corev1.ConfigMap).ResourceVersion != cm.ResourceVersion {
+				return true, nil, apierrors.NewConflict(action.GetResource().GroupResource(), cm.Name, fmt.Errorf("object has been modified"))
+			}
+		}
+		switch a := action.(type) {
+		case k8stesting.CreateActionImpl:
+			a.Object.(*corev1.ConfigMap).ResourceVersion = strconv.Itoa(version)
+		case k8stesting.UpdateActionImpl:
+			version++
+			a.Object.(*corev1.ConfigMap).ResourceVersion = strconv.Itoa(version)
+		case k8stesting.PatchActionImpl:
+			version++
+			handled, obj, err := react(action)
+			if err == nil {
+				cm := obj.(*corev1.ConfigMap)
+				cm.ResourceVersion = strconv.Itoa(version)
+				err = client.Tracker().Update(action.GetResource(), cm, cm.Namespace)
+			}
+			return handled, obj, err
+		}
+		return react(action)
+	})
+	return client
+}
+
+func TestPersistentConfig_ParallelWriters(t *testing.T) {
+	SetGlobalPersistence(nil)
+	info.SetGlobalKubeInterface(newConflictCheckingClient())
+
+	const writers = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			location := &persistentLocation{
+				Namespace: "default",
+				Name:      constants.SidecarResultConfigMapName,
+				PodKey:    fmt.Sprintf("default-gs-%d", i),
+				Labels:    map[string]string{constants.SidecarResultLabelKey: constants.SidecarResultConfigMapName},
+			}
+			p := &PersistentConfig{Type: constants.SidecarResultType, Result: map[string]string{"v1.0.0": fmt.Sprintf("url-%d", i)}}
+			errs <- p.setPersistenceInfo(context.TODO(), location)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("setPersistenceInfo() error = %v", err)
+		}
+	}
+
+	cm, err := info.GetConfigmap(context.TODO(), constants.SidecarResultConfigMapName, "default")
+	if err != nil {
+		t.Fatalf("GetConfigmap() error = %v", err)
+	}
+	if len(cm.Data) != writers {
+		t.Fatalf("expected %d pod entries, got %d", writers, len(cm.Data))
+	}
+	for i := 0; i < writers; i++ {
+		p := &PersistentConfig{Type: constants.SidecarResultType}
+		result, ok, err := p.resultOfPod(cm, fmt.Sprintf("default-gs-%d", i))
+		if err != nil || !ok || result["v1.0.0"] != fmt.Sprintf("url-%d", i) {
+			t.Errorf("entry of pod %d = %v, %v, %v", i, result, ok, err)
+		}
+	}
+}
+
+func TestPruneVersions(t *testing.T) {
+	tests := []struct {
+		name     string
+		versions []string
+		max      int
+		kept     []string
+	}{
+		{name: "Semantic", versions: []string{"v1.0.0", "v1.2.0", "v1.1.0"}, max: 2, kept: []string{"v1.1.0", "v1.2.0"}},
+		{name: "NonSemantic", versions: []string{"1.0", "1.2", "1.1"}, max: 2, kept: []string{"1.1", "1.2"}},
+		{name: "Mixed", versions: []string{"build-42", "v1.0.0", "1.0", "v1.1.0"}, max: 3, kept: []string{"build-42", "v1.0.0", "v1.1.0"}},
+		{name: "Unlimited", versions: []string{"1.0", "v1.0.0"}, kept: []string{"1.0", "v1.0.0"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			result := map[string]string{}
+			for _, v := range tc.versions {
+				result[v] = "url-" + v
+			}
+			pruneVersions(result, tc.max)
+			var kept []string
+			for v := range result {
+				kept = append(kept, v)
+			}
+			sortVersions(kept)
+			sortVersions(tc.kept)
+			if strings.Join(kept, ",") != strings.Join(tc.kept, ",") {
+				t.Errorf("expected %v to be kept, got %v", tc.kept, kept)
+			}
+		})
+	}
+}
+
+func TestPersistentConfig_SetPersistenceInfoSizeLimit(t *testing.T) {
+	SetGlobalPersistence(nil)
+	info.SetGlobalKubeInterface(fake.NewSimpleClientset(
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "minecraft-0", Namespace: "game"}},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: constants.SidecarResultConfigMapName, Namespace: "game"},
+			Data:       map[string]string{"game-minecraft-1": strings.Repeat("x", maxConfigMapDataBytes-100)},
+		},
+	))
+	t.Setenv("POD_NAMESPACE", "game")
+	t.Setenv("POD_NAME", "minecraft-0")
+
+	p := &PersistentConfig{Type: constants.SidecarResultType, Result: map[string]string{"v1.0.0": strings.Repeat("u", 200)}}
+	err := p.SetPersistenceInfo()
+	if err == nil || !strings.Contains(err.Error(), "raise persistence.shards") {
+		t.Fatalf("expected the size limit error, got %v", err)
+	}
+	cm, err := info.GetConfigmap(context.TODO(), constants.SidecarResultConfigMapName, "game")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cm.Data["game-minecraft-0"]; ok {
+		t.Errorf("expected the entry not to be written")
+	}
+}
@@ -17,19 +17,54 @@ limitations under the License.
 package store
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/magicsong/kidecar/api"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/tidwall/gjson"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
 )
 
+const (
+	MetricTypeGauge     = "Gauge"
+	MetricTypeCounter   = "Counter"
+	MetricTypeHistogram = "Histogram"
+
+	defaultMetricHelp = "Automatically generated metric from collected data"
+)
+
+// metricsRegistry is shared by all plugins, it is the registry of controller-runtime so the metrics server of the manager
+// serves it, the admin server serves it in standalone mode
+var metricsRegistry = ctrlmetrics.Registry
+
+// MetricsHandler returns the handler serving the metrics stored by HTTPMetric storages
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// metricVec is a registered metric and the shape it was created with
+type metricVec struct {
+	collector   prometheus.Collector
+	metricType  string
+	labelNames  []string
+	constLabels map[string]string
+
+	// last is the last stored value of every series of a counter
+	mu   sync.Mutex
+	last map[string]float64
+}
+
 type promMetric struct {
-	registry  *prometheus.Registry
-	metrics   map[string]prometheus.Gauge
+	registry  ctrlmetrics.RegistererGatherer
+	metrics   map[string]*metricVec
 	metricsMu sync.Mutex
 }
 
@@ -40,44 +75,170 @@ func (p *promMetric) IsInitialized() bool {
 
 // SetupWithManager implements Storage.
 func (p *promMetric) SetupWithManager(mgr api.SidecarManager) error {
-	reg := prometheus.NewRegistry()
-	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
-
-	// 启动HTTP服务器
-	fmt.Println("Starting server at :8080")
-	p.registry = reg
-	go http.ListenAndServe(":8080", nil)
+	p.registry = metricsRegistry
+	p.metrics = make(map[string]*metricVec)
 	return nil
 }
 
 // Store implements Storage.
 func (p *promMetric) Store(data string, config interface{}) error {
 	myconfig, ok := config.(*HTTPMetricConfig)
-	if !ok {
+	if !ok || myconfig == nil {
 		return fmt.Errorf("bad config of httpMetricConfig")
 	}
-	f, err := strconv.ParseFloat(data, 64)
+	if err := myconfig.IsValid(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	value, labels, err := extractMetric(data, myconfig)
 	if err != nil {
 		return fmt.Errorf("bad data of httpMetricConfig, err: %w", err)
 	}
-	p.getOrCreateGauge(myconfig).Set(f)
+	vec, err := p.getOrCreateMetric(myconfig)
+	if err != nil {
+		return err
+	}
+	switch c := vec.collector.(type) {
+	case *prometheus.GaugeVec:
+		c.With(labels).Set(value)
+	case *prometheus.CounterVec:
+		if value < 0 {
+			return fmt.Errorf("counter %s can not add negative value %v", myconfig.MetricName, value)
+		}
+		c.With(labels).Add(vec.increase(labels, value))
+	case *prometheus.HistogramVec:
+		c.With(labels).Observe(value)
+	}
 	return nil
 }
 
-// getOrCreateGauge ...
-func (p *promMetric) getOrCreateGauge(config *HTTPMetricConfig) prometheus.Gauge {
+// increase returns how much a counter grows when the stored total of a series becomes value.
+// A total lower than the last one means the source was reset, so the whole value is added.
+func (v *metricVec) increase(labels prometheus.Labels, value float64) float64 {
+	pairs := make([]string, 0, len(labels))
+	for name, label := range labels {
+		pairs = append(pairs, name+"="+label)
+	}
+	sort.Strings(pairs)
+	key := strings.Join(pairs, ",")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	last, ok := v.last[key]
+	v.last[key] = value
+	if !ok || value < last {
+		return value
+	}
+	return value - last
+}
+
+// extractMetric parses the value and the dynamic labels of a sample from the data.
+// The expressions in Labels are expanded once when the plugin config is loaded.
+func extractMetric(data string, config *HTTPMetricConfig) (float64, prometheus.Labels, error) {
+	labels := prometheus.Labels{}
+	for name, value := range config.Labels {
+		labels[name] = value
+	}
+	if len(config.LabelJSONPaths) > 0 || config.ValueJSONPath != "" {
+		if !gjson.Valid(data) {
+			return 0, nil, fmt.Errorf("invalid json")
+		}
+	}
+	for name, path := range config.LabelJSONPaths {
+		result := gjson.Get(data, path)
+		if !result.Exists() {
+			return 0, nil, fmt.Errorf("label %s: path %s not found", name, path)
+		}
+		labels[name] = result.String()
+	}
+	raw := data
+	if config.ValueJSONPath != "" {
+		result := gjson.Get(data, config.ValueJSONPath)
+		if !result.Exists() {
+			return 0, nil, fmt.Errorf("value path %s not found", config.ValueJSONPath)
+		}
+		raw = result.String()
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, nil, err
+	}
+	return value, labels, nil
+}
+
+// getOrCreateMetric returns the metric of the config, creating and registering it on first use.
+// The registry is shared by all plugins, a metric registered by another storage with the same shape is reused.
+func (p *promMetric) getOrCreateMetric(config *HTTPMetricConfig) (*metricVec, error) {
 	p.metricsMu.Lock()
 	defer p.metricsMu.Unlock()
 
-	if gauge, exists := p.metrics[config.MetricName]; exists {
-		return gauge
+	metricType := config.Type
+	if metricType == "" {
+		metricType = MetricTypeGauge
+	}
+	labelNames := config.labelNames()
+	if vec, exists := p.metrics[config.MetricName]; exists {
+		if vec.metricType != metricType || !reflect.DeepEqual(vec.labelNames, labelNames) || !reflect.DeepEqual(vec.constLabels, config.ConstLabels) {
+			return nil, fmt.Errorf("metric %s is already defined with another type or labels", config.MetricName)
+		}
+		return vec, nil
 	}
 
-	gauge := prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: config.MetricName,
-		Help: "Automatically generated metric from collected data",
-	})
-	p.registry.MustRegister(gauge)
-	p.metrics[config.MetricName] = gauge
-	return gauge
+	help := config.Help
+	if help == "" {
+		help = defaultMetricHelp
+	}
+	var collector prometheus.Collector
+	switch metricType {
+	case MetricTypeGauge:
+		collector = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        config.MetricName,
+			Help:        help,
+			ConstLabels: config.ConstLabels,
+		}, labelNames)
+	case MetricTypeCounter:
+		collector = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        config.MetricName,
+			Help:        help,
+			ConstLabels: config.ConstLabels,
+		}, labelNames)
+	case MetricTypeHistogram:
+		collector = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        config.MetricName,
+			Help:        help,
+			ConstLabels: config.ConstLabels,
+			Buckets:     config.Buckets,
+		}, labelNames)
+	}
+	if err := p.registry.Register(collector); err != nil {
+		are := prometheus.AlreadyRegisteredError{}
+		if !errors.As(err, &are) {
+			return nil, fmt.Errorf("failed to register metric %s: %w", config.MetricName, err)
+		}
+		if reflect.TypeOf(are.ExistingCollector) != reflect.TypeOf(collector) {
+			return nil, fmt.Errorf("metric %s is already registered with another type", config.MetricName)
+		}
+		collector = are.ExistingCollector
+	}
+	vec := &metricVec{
+		collector:   collector,
+		metricType:  metricType,
+		labelNames:  labelNames,
+		constLabels: config.ConstLabels,
+		last:        make(map[string]float64),
+	}
+	p.metrics[config.MetricName] = vec
+	return vec, nil
+}
+
+// labelNames returns the sorted names of the dynamic labels
+func (c *HTTPMetricConfig) labelNames() []string {
+	names := make([]string, 0, len(c.Labels)+len(c.LabelJSONPaths))
+	for name := range c.Labels {
+		names = append(names, name)
+	}
+	for name := range c.LabelJSONPaths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
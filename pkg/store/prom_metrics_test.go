@@ -0,0 +1,112 @@
+/*
+Copyright 2024
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"testing"
+
+	"github.com/magicsong/kidecar/pkg/template"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newTestPromMetric() *promMetric {
+	return &promMetric{
+		registry: prometheus.NewRegistry(),
+		metrics:  make(map[string]*metricVec),
+	}
+}
+
+func TestPromMetric_Store(t *testing.T) {
+	t.Setenv("POD_NAME", "gs-0")
+	p := newTestPromMetric()
+	gauge := &HTTPMetricConfig{
+		MetricName:     "players",
+		ConstLabels:    map[string]string{"game": "tankwar"},
+		Labels:         map[string]string{"pod": "${SELF:POD_NAME}"},
+		LabelJSONPaths: map[string]string{"map": "map.name"},
+		ValueJSONPath:  "players",
+	}
+	// labels are expanded once with the plugin config
+	if err := template.ParseConfig(gauge); err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	if err := p.Store(`{"players": 7, "map": {"name": "desert"}}`, gauge); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+	counter := &HTTPMetricConfig{MetricName: "matches_total", Type: MetricTypeCounter}
+	// a steady total does not grow the counter, a lower one is a reset of the source
+	for _, v := range []string{"1", "2", "2", "1"} {
+		if err := p.Store(v, counter); err != nil {
+			t.Fatalf("Store() error = %v", err)
+		}
+	}
+	if err := p.Store("-1", counter); err == nil {
+		t.Errorf("expected error adding a negative value to a counter")
+	}
+	if err := p.Store("1", &HTTPMetricConfig{MetricName: "players"}); err == nil {
+		t.Errorf("expected error redefining a metric with other labels")
+	}
+
+	families, err := p.registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+	got := map[string]float64{}
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			switch f.GetName() {
+			case "players":
+				labels := map[string]string{}
+				for _, l := range m.GetLabel() {
+					labels[l.GetName()] = l.GetValue()
+				}
+				if labels["game"] != "tankwar" || labels["pod"] != "gs-0" || labels["map"] != "desert" {
+					t.Errorf("unexpected labels %v", labels)
+				}
+				got[f.GetName()] = m.GetGauge().GetValue()
+			case "matches_total":
+				got[f.GetName()] = m.GetCounter().GetValue()
+			}
+		}
+	}
+	if got["players"] != 7 || got["matches_total"] != 3 {
+		t.Errorf("unexpected values %v", got)
+	}
+}
+
+func TestPromMetric_ReusesMetricRegisteredByAnotherFactory(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	a := &promMetric{registry: registry, metrics: make(map[string]*metricVec)}
+	b := &promMetric{registry: registry, metrics: make(map[string]*metricVec)}
+	config := &HTTPMetricConfig{MetricName: "players"}
+	if err := a.Store("1", config); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+	if err := b.Store("2", config); err != nil {
+		t.Fatalf("Store() of the second factory error = %v", err)
+	}
+	if err := b.Store("1", &HTTPMetricConfig{MetricName: "players", Type: MetricTypeCounter}); err == nil {
+		t.Errorf("expected error registering a metric with another type")
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+	if len(families) != 1 || families[0].GetMetric()[0].GetGauge().GetValue() != 2 {
+		t.Errorf("expected one shared gauge with value 2, got %v", families)
+	}
+}
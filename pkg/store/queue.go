@@ -0,0 +1,287 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/magicsong/kidecar/api"
+	"github.com/magicsong/kidecar/pkg/template"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	defaultMaxBackoffSeconds = 60
+	queueEntrySuffix         = ".json"
+)
+
+var globalWriteQueue *WriteQueue
+
+// ErrWriteQueued is returned when a write could not be applied now and was queued to be replayed later
+var ErrWriteQueued = errors.New("write queued for retry")
+
+// SetGlobalWriteQueue sets the queue used by all storage factories created afterwards
+func SetGlobalWriteQueue(q *WriteQueue) {
+	globalWriteQueue = q
+}
+
+// queueEntry is a pending storage write persisted as one file in the queue directory
+type queueEntry struct {
+	Seq      uint64         `json:"seq"`
+	Key      string         `json:"key"`
+	Data     string         `json:"data"`
+	Config   *StorageConfig `json:"config"`
+	Enqueued time.Time      `json:"enqueued"`
+
+	attempts    int
+	nextAttempt time.Time
+}
+
+// WriteQueue is a durable queue of storage writes that failed against the API server.
+// A newer write for the same target supersedes the queued one, so writes of one target stay in order.
+// Every entry backs off on its own, a target that keeps failing does not hold back the others.
+type WriteQueue struct {
+	dir        string
+	maxBackoff time.Duration
+	mu         sync.Mutex
+	entries    []*queueEntry
+	seq        uint64
+	notify     chan struct{}
+	log        logr.Logger
+}
+
+// NewWriteQueue creates a queue in the configured directory and loads the writes left by a previous run
+func NewWriteQueue(config *api.WriteQueueConfig) (*WriteQueue, error) {
+	if config == nil || config.Dir == "" {
+		return nil, fmt.Errorf("write queue dir is empty")
+	}
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create write queue dir: %w", err)
+	}
+	maxBackoff := config.MaxBackoffSeconds
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxBackoffSeconds
+	}
+	q := &WriteQueue{
+		dir:        config.Dir,
+		maxBackoff: time.Duration(maxBackoff) * time.Second,
+		notify:     make(chan struct{}, 1),
+		log:        logf.Log.WithName("write_queue"),
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *WriteQueue) load() error {
+	files, err := os.ReadDir(q.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read write queue dir: %w", err)
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), queueEntrySuffix) {
+			continue
+		}
+		bytes, err := os.ReadFile(filepath.Join(q.dir, f.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read queue entry %s: %w", f.Name(), err)
+		}
+		entry := &queueEntry{}
+		if err := json.Unmarshal(bytes, entry); err != nil {
+			q.log.Error(err, "drop corrupted queue entry", "file", f.Name())
+			os.Remove(filepath.Join(q.dir, f.Name()))
+			continue
+		}
+		q.entries = append(q.entries, entry)
+		if entry.Seq > q.seq {
+			q.seq = entry.Seq
+		}
+	}
+	sort.Slice(q.entries, func(i, j int) bool { return q.entries[i].Seq < q.entries[j].Seq })
+	return nil
+}
+
+// Enqueue persists a write, replacing any pending write with the same key
+func (q *WriteQueue) Enqueue(key string, config *StorageConfig, data string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.seq++
+	entry := &queueEntry{
+		Seq:      q.seq,
+		Key:      key,
+		Data:     data,
+		Config:   config,
+		Enqueued: time.Now(),
+	}
+	bytes, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal queue entry: %w", err)
+	}
+	tmp := filepath.Join(q.dir, fmt.Sprintf(".%020d.tmp", entry.Seq))
+	if err := os.WriteFile(tmp, bytes, 0644); err != nil {
+		return fmt.Errorf("failed to write queue entry: %w", err)
+	}
+	if err := os.Rename(tmp, q.entryPath(entry)); err != nil {
+		return fmt.Errorf("failed to commit queue entry: %w", err)
+	}
+	kept := q.entries[:0]
+	for _, e := range q.entries {
+		if e.Key == key {
+			os.Remove(q.entryPath(e))
+			continue
+		}
+		kept = append(kept, e)
+	}
+	q.entries = append(kept, entry)
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// HasPending returns whether a write with the key is still waiting to be replayed
+func (q *WriteQueue) HasPending(key string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, e := range q.entries {
+		if e.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of pending writes
+func (q *WriteQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
+
+// Run replays the pending writes until the context is done.
+// Writes failing with a transient error are retried with backoff, all other failures are dropped.
+func (q *WriteQueue) Run(ctx context.Context, factory StorageFactory) {
+	for {
+		entry, wait := q.next(time.Now())
+		if entry == nil {
+			var timer <-chan time.Time
+			if wait > 0 {
+				timer = time.After(wait)
+			}
+			select {
+			case <-q.notify:
+			case <-timer:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		err := entry.Config.storeDirect(ctx, factory, entry.Data)
+		switch {
+		case err == nil:
+			q.log.Info("replayed queued write", "key", entry.Key, "enqueued", entry.Enqueued)
+			q.remove(entry)
+		case !isRetryable(err):
+			q.log.Error(template.RedactError(err), "drop queued write", "key", entry.Key, "enqueued", entry.Enqueued)
+			q.remove(entry)
+		default:
+			backoff := q.retryLater(entry)
+			q.log.Error(template.RedactError(err), "failed to replay queued write, retry later", "key", entry.Key, "backoff", backoff)
+		}
+	}
+}
+
+// next returns the oldest entry that is due, or how long to wait for the next one.
+// A zero wait means there is nothing queued.
+func (q *WriteQueue) next(now time.Time) (*queueEntry, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var wait time.Duration
+	for _, e := range q.entries {
+		if !e.nextAttempt.After(now) {
+			return e, 0
+		}
+		if d := e.nextAttempt.Sub(now); wait == 0 || d < wait {
+			wait = d
+		}
+	}
+	return nil, wait
+}
+
+// retryLater schedules the next attempt of the entry and returns the backoff
+func (q *WriteQueue) retryLater(entry *queueEntry) time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	backoff := q.maxBackoff
+	if entry.attempts < 16 {
+		backoff = min(time.Second<<entry.attempts, q.maxBackoff)
+	}
+	entry.attempts++
+	entry.nextAttempt = time.Now().Add(backoff)
+	return backoff
+}
+
+// remove drops the entry unless it has already been superseded
+func (q *WriteQueue) remove(entry *queueEntry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, e := range q.entries {
+		if e == entry {
+			q.entries = append(q.entries[:i], q.entries[i+1:]...)
+			os.Remove(q.entryPath(e))
+			return
+		}
+	}
+}
+
+func (q *WriteQueue) entryPath(entry *queueEntry) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", entry.Seq, queueEntrySuffix))
+}
+
+// isRetryable returns true for transient errors, which may go away by sending the same write again
+func isRetryable(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	if apierrors.IsConflict(err) || apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err) || apierrors.IsTooManyRequests(err) {
+		return true
+	}
+	var status apierrors.APIStatus
+	if errors.As(err, &status) {
+		return status.Status().Code >= 500
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return utilnet.IsConnectionRefused(err) || utilnet.IsConnectionReset(err) || utilnet.IsProbableEOF(err)
+}
@@ -0,0 +1,307 @@
+/*
+Copyright 2024
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/magicsong/kidecar/api"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+type fakeStorage struct {
+	mu     sync.Mutex
+	err    error
+	stored []string
+}
+
+func (f *fakeStorage) IsInitialized() bool { return true }
+
+func (f *fakeStorage) SetupWithManager(mgr api.SidecarManager) error { return nil }
+
+func (f *fakeStorage) Store(data string, config interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	f.stored = append(f.stored, data)
+	return nil
+}
+
+func (f *fakeStorage) setErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+func (f *fakeStorage) getStored() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.stored...)
+}
+
+type fakeFactory struct {
+	storage Storage
+	queue   *WriteQueue
+	targetResults
+}
+
+func (f *fakeFactory) GetStorage(storageType StorageType) (Storage, error) { return f.storage, nil }
+
+func (f *fakeFactory) WriteQueue() *WriteQueue { return f.queue }
+
+func (f *fakeFactory) PendingWrites() int { return f.queue.Len() }
+
+func mustQueueKey(t *testing.T, config *StorageConfig) string {
+	key, err := config.queueKey()
+	if err != nil {
+		t.Fatalf("queueKey() error = %v", err)
+	}
+	return key
+}
+
+func newInKubeStorageConfig(annotationKey string) *StorageConfig {
+	return &StorageConfig{
+		Type:   StorageTypeInKube,
+		InKube: &InKubeConfig{AnnotationKey: &annotationKey},
+	}
+}
+
+func TestWriteQueue_EnqueueAndReload(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "game-0")
+	dir := t.TempDir()
+	q, err := NewWriteQueue(&api.WriteQueueConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("NewWriteQueue() error = %v", err)
+	}
+	a, b := newInKubeStorageConfig("a"), newInKubeStorageConfig("b")
+	keyA, keyB := mustQueueKey(t, a), mustQueueKey(t, b)
+	for _, w := range []struct {
+		key    string
+		config *StorageConfig
+		data   string
+	}{{keyA, a, "1"}, {keyB, b, "2"}, {keyA, a, "3"}} {
+		if err := q.Enqueue(w.key, w.config, w.data); err != nil {
+			t.Fatalf("Enqueue() error = %v", err)
+		}
+	}
+	if q.Len() != 2 {
+		t.Fatalf("expected superseded write to be coalesced, got %d entries", q.Len())
+	}
+
+	reloaded, err := NewWriteQueue(&api.WriteQueueConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("NewWriteQueue() error = %v", err)
+	}
+	if reloaded.Len() != 2 {
+		t.Fatalf("expected 2 entries after reload, got %d", reloaded.Len())
+	}
+	if reloaded.entries[0].Data != "2" || reloaded.entries[1].Data != "3" {
+		t.Errorf("unexpected order after reload: %s, %s", reloaded.entries[0].Data, reloaded.entries[1].Data)
+	}
+	if *reloaded.entries[1].Config.InKube.AnnotationKey != "a" {
+		t.Errorf("config not restored: %v", reloaded.entries[1].Config.InKube)
+	}
+}
+
+func TestStorageConfig_StoreDataQueuesFailedWrites(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "game-0")
+	q, err := NewWriteQueue(&api.WriteQueueConfig{Dir: t.TempDir(), MaxBackoffSeconds: 1})
+	if err != nil {
+		t.Fatalf("NewWriteQueue() error = %v", err)
+	}
+	storage := &fakeStorage{err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}
+	factory := &fakeFactory{storage: storage, queue: q}
+	config := newInKubeStorageConfig("result")
+
+	if err := config.StoreData(factory, "v1"); !errors.Is(err, ErrWriteQueued) {
+		t.Fatalf("StoreData() should report the queued write, got error %v", err)
+	}
+	// the api server is back, but v1 is still pending so v2 must not overtake it
+	storage.setErr(nil)
+	if err := config.StoreData(factory, "v2"); !errors.Is(err, ErrWriteQueued) {
+		t.Fatalf("StoreData() should report the queued write, got error %v", err)
+	}
+	if len(storage.getStored()) != 0 || q.Len() != 1 {
+		t.Fatalf("expected v2 to supersede queued v1, stored %v, pending %d", storage.getStored(), q.Len())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Run(ctx, factory)
+	deadline := time.Now().Add(5 * time.Second)
+	for q.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stored := storage.getStored(); len(stored) != 1 || stored[0] != "v2" {
+		t.Errorf("expected only v2 to be replayed, got %v", stored)
+	}
+}
+
+func TestStorageConfig_StoreDataDoesNotQueuePermanentErrors(t *testing.T) {
+	q, err := NewWriteQueue(&api.WriteQueueConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewWriteQueue() error = %v", err)
+	}
+	storage := &fakeStorage{err: fmt.Errorf("failed to resolve target")}
+	factory := &fakeFactory{storage: storage, queue: q}
+	err = newInKubeStorageConfig("result").StoreData(factory, "v1")
+	if err == nil || errors.Is(err, ErrWriteQueued) {
+		t.Fatalf("expected the error to be returned, got %v", err)
+	}
+	if q.Len() != 0 {
+		t.Errorf("expected nothing queued, got %d entries", q.Len())
+	}
+}
+
+// keyedStorage fails every write of the annotation key in failKey
+type keyedStorage struct {
+	fakeStorage
+	failKey string
+}
+
+func (k *keyedStorage) Store(data string, config interface{}) error {
+	if *config.(*InKubeConfig).AnnotationKey == k.failKey {
+		return apierrors.NewServiceUnavailable("unavailable")
+	}
+	return k.fakeStorage.Store(data, config)
+}
+
+func TestWriteQueue_FailingKeyDoesNotBlockOthers(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "game-0")
+	q, err := NewWriteQueue(&api.WriteQueueConfig{Dir: t.TempDir(), MaxBackoffSeconds: 30})
+	if err != nil {
+		t.Fatalf("NewWriteQueue() error = %v", err)
+	}
+	storage := &keyedStorage{failKey: "a"}
+	factory := &fakeFactory{storage: storage, queue: q}
+	a, b := newInKubeStorageConfig("a"), newInKubeStorageConfig("b")
+	keyA, keyB := mustQueueKey(t, a), mustQueueKey(t, b)
+	if err := q.Enqueue(keyA, a, "1"); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	if err := q.Enqueue(keyB, b, "2"); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Run(ctx, factory)
+	deadline := time.Now().Add(5 * time.Second)
+	for q.Len() > 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stored := storage.getStored(); len(stored) != 1 || stored[0] != "2" {
+		t.Errorf("expected b to be replayed while a backs off, got %v", stored)
+	}
+	if !q.HasPending(keyA) {
+		t.Errorf("expected a to stay queued")
+	}
+}
+
+func TestStorageConfig_QueueKey(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "game-0")
+	ready := func(state, value string) ProbeMarkerPolicy {
+		return ProbeMarkerPolicy{State: state, Labels: map[string]string{"ready": value}}
+	}
+	opsState := func(state, value string) ProbeMarkerPolicy {
+		return ProbeMarkerPolicy{State: state, GameServerOpsState: value}
+	}
+	gss := &TargetKubeObject{Group: "game.kruise.io", Version: "v1alpha1", Resource: "gameserversets", PodOwner: true}
+	tests := []struct {
+		name string
+		a, b *InKubeConfig
+		same bool
+	}{
+		{
+			name: "SameFieldsWithDifferentPolicies",
+			a:    &InKubeConfig{MarkerPolices: []ProbeMarkerPolicy{ready("Succeeded", "true")}},
+			b:    &InKubeConfig{MarkerPolices: []ProbeMarkerPolicy{ready("Failed", "false"), ready("Succeeded", "true")}},
+			same: true,
+		},
+		{
+			name: "DifferentAnnotations",
+			a:    newInKubeStorageConfig("a").InKube,
+			b:    newInKubeStorageConfig("b").InKube,
+		},
+		{
+			name: "GameServerAndPod",
+			a:    &InKubeConfig{MarkerPolices: []ProbeMarkerPolicy{opsState("Succeeded", "None")}},
+			b:    &InKubeConfig{MarkerPolices: []ProbeMarkerPolicy{ready("Succeeded", "true")}},
+		},
+		{
+			name: "SameGameServerOpsState",
+			a:    &InKubeConfig{MarkerPolices: []ProbeMarkerPolicy{opsState("Succeeded", "None")}},
+			b:    &InKubeConfig{MarkerPolices: []ProbeMarkerPolicy{opsState("Failed", "Maintaining")}},
+			same: true,
+		},
+		{
+			name: "DifferentTargets",
+			a:    &InKubeConfig{Target: gss, MarkerPolices: []ProbeMarkerPolicy{opsState("Succeeded", "None")}},
+			b:    &InKubeConfig{Target: &TargetKubeObject{Group: gss.Group, Version: gss.Version, Resource: gss.Resource, Name: "game"}, MarkerPolices: []ProbeMarkerPolicy{opsState("Succeeded", "None")}},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			a := mustQueueKey(t, &StorageConfig{Type: StorageTypeInKube, InKube: tc.a})
+			b := mustQueueKey(t, &StorageConfig{Type: StorageTypeInKube, InKube: tc.b})
+			if (a == b) != tc.same {
+				t.Errorf("expected same key %v, got %s and %s", tc.same, a, b)
+			}
+		})
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	gr := schema.GroupResource{Resource: "pods"}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"Conflict", apierrors.NewConflict(gr, "gs-0", fmt.Errorf("changed")), true},
+		{"TooManyRequests", apierrors.NewTooManyRequests("slow down", 1), true},
+		{"InternalError", apierrors.NewInternalError(fmt.Errorf("boom")), true},
+		{"ServerTimeout", apierrors.NewServerTimeout(gr, "patch", 1), true},
+		{"ConnectionRefused", fmt.Errorf("failed to patch: %w", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}), true},
+		{"DeadlineExceeded", context.DeadlineExceeded, true},
+		{"NotFound", apierrors.NewNotFound(gr, "gs-0"), false},
+		{"Invalid", apierrors.NewBadRequest("bad"), false},
+		{"Forbidden", apierrors.NewForbidden(gr, "gs-0", fmt.Errorf("denied")), false},
+		{"Plain", fmt.Errorf("failed to resolve target"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
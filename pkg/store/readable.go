@@ -0,0 +1,61 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"fmt"
+)
+
+// LoadData reads back the data stored with the config, plugins use it to restore state or detect drift
+func (s *StorageConfig) LoadData(ctx context.Context, factory StorageFactory) (string, error) {
+	storage, config, err := s.readable(factory)
+	if err != nil {
+		return "", err
+	}
+	return storage.Load(ctx, config)
+}
+
+// WatchData calls the handler every time the data stored with the config is changed, by anyone
+func (s *StorageConfig) WatchData(ctx context.Context, factory StorageFactory, handler func(data string)) error {
+	storage, config, err := s.readable(factory)
+	if err != nil {
+		return err
+	}
+	return storage.Watch(ctx, config, handler)
+}
+
+func (s *StorageConfig) readable(factory StorageFactory) (ReadableStorage, interface{}, error) {
+	var config interface{}
+	switch s.Type {
+	case StorageTypeInKube:
+		config = s.InKube
+	case StorageTypeFile:
+		config = s.File
+	default:
+		return nil, nil, fmt.Errorf("%w: %s", ErrNotReadable, s.Type)
+	}
+	storage, err := factory.GetStorage(s.Type)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get storage: %w", err)
+	}
+	readable, ok := storage.(ReadableStorage)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %s", ErrNotReadable, s.Type)
+	}
+	return readable, config, nil
+}
@@ -0,0 +1,223 @@
+/*
+Copyright 2024
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/magicsong/kidecar/pkg/constants"
+	"github.com/magicsong/kidecar/pkg/info"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newReadableInKube(objects ...runtime.Object) (*inKube, *dynamicfake.FakeDynamicClient) {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		podGvr: "PodList",
+		gsGvr:  "GameServerList",
+		svcGvr: "ServiceList",
+	}, objects...)
+	return &inKube{dynamic: client, resolver: &targetResolver{dynamic: client}}, client
+}
+
+func TestInKube_Load(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "gs-0")
+	pod := newTestObject(podGvr, "Pod", "gs-0", map[string]string{"ready": "true"}, nil)
+	pod.SetAnnotations(map[string]string{"probe": "Allocated"})
+	gs := newTestObject(gsGvr, "GameServer", "gs-0", nil, nil)
+	unstructured.SetNestedField(gs.Object, "Maintaining", "spec", "opsState")
+	unstructured.SetNestedField(gs.Object, int64(3), "spec", "updatePriority")
+	storage, _ := newReadableInKube(pod, gs)
+
+	annotationKey, labelKey, missingKey := "probe", "ready", "missing"
+	jsonPath := "/spec/updatePriority"
+	tests := []struct {
+		name    string
+		config  *InKubeConfig
+		want    string
+		wantErr error
+	}{
+		{"Annotation", &InKubeConfig{AnnotationKey: &annotationKey}, "Allocated", nil},
+		{"Label", &InKubeConfig{LabelKey: &labelKey}, "true", nil},
+		{"Missing", &InKubeConfig{AnnotationKey: &missingKey}, "", ErrNoData},
+		{"JsonPath", &InKubeConfig{JsonPath: &jsonPath}, "3", nil},
+		{"MarkerPolicy", &InKubeConfig{MarkerPolices: []ProbeMarkerPolicy{
+			{State: "Idle", GameServerOpsState: "None"},
+			{State: "Busy", GameServerOpsState: "Maintaining"},
+		}}, "Busy", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := storage.Load(context.TODO(), tt.config)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Load() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInKube_Watch(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "gs-0")
+	gs := newTestObject(gsGvr, "GameServer", "gs-0", nil, nil)
+	unstructured.SetNestedField(gs.Object, "None", "spec", "opsState")
+	storage, client := newReadableInKube(gs)
+	config := &InKubeConfig{MarkerPolices: []ProbeMarkerPolicy{
+		{State: "Idle", GameServerOpsState: "None"},
+		{State: "Busy", GameServerOpsState: "Maintaining"},
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan string, 10)
+	go storage.Watch(ctx, config, func(data string) { changes <- data })
+	if got := waitForChange(t, changes); got != "Idle" {
+		t.Fatalf("first change = %q, want Idle", got)
+	}
+	// an operator edits the GameServer
+	unstructured.SetNestedField(gs.Object, "Maintaining", "spec", "opsState")
+	if _, err := client.Resource(gsGvr).Namespace("default").Update(ctx, gs, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update gameserver: %v", err)
+	}
+	if got := waitForChange(t, changes); got != "Busy" {
+		t.Errorf("second change = %q, want Busy", got)
+	}
+}
+
+func TestInKube_WatchLabelSelector(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "gs-0")
+	svcA := newTestObject(svcGvr, "Service", "svc-a", map[string]string{"app": "gs"}, nil)
+	svcA.SetAnnotations(map[string]string{"state": "idle"})
+	svcB := newTestObject(svcGvr, "Service", "svc-b", map[string]string{"app": "gs"}, nil)
+	svcB.SetAnnotations(map[string]string{"state": "idle"})
+	storage, client := newReadableInKube(svcA, svcB)
+	config := &InKubeConfig{
+		Target: &TargetKubeObject{Version: "v1", Resource: "services", LabelSelector: &metav1.LabelSelector{
+			MatchLabels: map[string]string{"app": "gs"},
+		}},
+		MarkerPolices: []ProbeMarkerPolicy{
+			{State: "Idle", Annotations: map[string]string{"state": "idle"}},
+			{State: "Busy", Annotations: map[string]string{"state": "busy"}},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan string, 10)
+	go storage.Watch(ctx, config, func(data string) { changes <- data })
+	for i := 0; i < 2; i++ {
+		if got := waitForChange(t, changes); got != "Idle" {
+			t.Fatalf("initial change = %q, want Idle", got)
+		}
+	}
+	// the second matched object is edited
+	svcB.SetAnnotations(map[string]string{"state": "busy"})
+	if _, err := client.Resource(svcGvr).Namespace("default").Update(ctx, svcB, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update service: %v", err)
+	}
+	if got := waitForChange(t, changes); got != "Busy" {
+		t.Errorf("change = %q, want Busy", got)
+	}
+}
+
+func TestFile_LoadAndWatch(t *testing.T) {
+	fileWatchInterval = 10 * time.Millisecond
+	storage := &file{}
+	config := &FileConfig{Path: filepath.Join(t.TempDir(), "result"), Mode: FileModeHistory}
+	if _, err := storage.Load(context.TODO(), config); !errors.Is(err, ErrNoData) {
+		t.Fatalf("Load() of missing file error = %v, want ErrNoData", err)
+	}
+	if err := storage.Store("v1", config); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+	if got, err := storage.Load(context.TODO(), config); err != nil || got != "v1" {
+		t.Fatalf("Load() = %q, %v, want v1", got, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan string, 10)
+	go storage.Watch(ctx, config, func(data string) { changes <- data })
+	time.Sleep(50 * time.Millisecond)
+	if err := storage.Store("v2", config); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+	if got := waitForChange(t, changes); got != "v2" {
+		t.Errorf("change = %q, want v2", got)
+	}
+}
+
+func TestPersistentConfig_Watch(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "gs-0")
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+		Name:      constants.SidecarResultConfigMapName,
+		Namespace: "default",
+	}}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "gs-0", Namespace: "default"}}
+	client := fake.NewSimpleClientset(cm, pod)
+	info.SetGlobalKubeInterface(client)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan string, 10)
+	p := &PersistentConfig{Type: constants.SidecarResultType}
+	go p.Watch(ctx, func(result map[string]string) { changes <- result["v1"] })
+
+	// keep updating until the watch is established and sees the change
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		cm.Data = map[string]string{"default-gs-0": constants.SidecarResultType + ":\n  v1: url1\n"}
+		if _, err := client.CoreV1().ConfigMaps(cm.Namespace).Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+			t.Fatalf("failed to update configmap: %v", err)
+		}
+		select {
+		case got := <-changes:
+			if got != "url1" {
+				t.Errorf("result v1 = %q, want url1", got)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	t.Fatalf("timed out waiting for configmap change")
+}
+
+func waitForChange(t *testing.T, changes <-chan string) string {
+	t.Helper()
+	select {
+	case data := <-changes:
+		return data
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for change")
+		return ""
+	}
+}
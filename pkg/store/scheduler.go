@@ -0,0 +1,217 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/magicsong/kidecar/api"
+	"gomodules.xyz/jsonpatch/v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+var globalWriteScheduler *WriteScheduler
+
+// SetGlobalWriteScheduler sets the scheduler shared by the storages of all plugins
+func SetGlobalWriteScheduler(s *WriteScheduler) {
+	globalWriteScheduler = s
+}
+
+// objectKey identifies a batch of patches sent in one request
+type objectKey struct {
+	gvr       schema.GroupVersionResource
+	namespace string
+	name      string
+	patchType types.PatchType
+}
+
+type patchBatch struct {
+	writers []*batchWriter
+}
+
+// batchWriter is a single patch of a batch and the writer waiting for it
+type batchWriter struct {
+	ctx   context.Context
+	patch interface{}
+	done  chan error
+}
+
+// WriteScheduler sends patches to the API server through a client side token bucket.
+// Patches to the same object submitted within the batch window are merged into a single request.
+type WriteScheduler struct {
+	dynamic     dynamic.Interface
+	limiter     flowcontrol.RateLimiter
+	batchWindow time.Duration
+	// ctx bounds the requests of the scheduler, it is cancelled by Stop
+	ctx     context.Context
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+	batches map[objectKey]*patchBatch
+}
+
+// NewWriteScheduler creates a scheduler, a nil config means no limit and no batching
+func NewWriteScheduler(dyn dynamic.Interface, config *api.KubeWriteLimit) *WriteScheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &WriteScheduler{
+		dynamic: dyn,
+		limiter: flowcontrol.NewFakeAlwaysRateLimiter(),
+		ctx:     ctx,
+		cancel:  cancel,
+		batches: make(map[objectKey]*patchBatch),
+	}
+	if config == nil {
+		return s
+	}
+	if config.QPS > 0 {
+		burst := config.Burst
+		if burst <= 0 {
+			burst = 1
+		}
+		s.limiter = flowcontrol.NewTokenBucketRateLimiter(config.QPS, burst)
+	}
+	if config.BatchWindowMilliseconds > 0 {
+		s.batchWindow = time.Duration(config.BatchWindowMilliseconds) * time.Millisecond
+	}
+	return s
+}
+
+// Stop interrupts the requests waiting for the rate limiter or the API server
+func (s *WriteScheduler) Stop() {
+	s.cancel()
+}
+
+// PatchJSON submits a json patch and waits until the batched request has been sent.
+// If the batched request fails, the patch is sent on its own so the error belongs to this writer.
+func (s *WriteScheduler) PatchJSON(ctx context.Context, gvr schema.GroupVersionResource, namespace, name string, ops []jsonpatch.JsonPatchOperation) error {
+	key := objectKey{gvr: gvr, namespace: namespace, name: name, patchType: types.JSONPatchType}
+	return s.submit(ctx, key, ops)
+}
+
+// PatchStrategicMerge submits a strategic merge patch and waits until the batched request has been sent.
+// If the batched request fails, the patch is sent on its own so the error belongs to this writer.
+func (s *WriteScheduler) PatchStrategicMerge(ctx context.Context, gvr schema.GroupVersionResource, namespace, name string, patch map[string]interface{}) error {
+	key := objectKey{gvr: gvr, namespace: namespace, name: name, patchType: types.StrategicMergePatchType}
+	return s.submit(ctx, key, patch)
+}
+
+// submit adds the patch to the batch of the object. A writer whose ctx is done before the batch
+// is flushed gets ctx.Err() and its patch is not sent.
+func (s *WriteScheduler) submit(ctx context.Context, key objectKey, patch interface{}) error {
+	w := &batchWriter{ctx: ctx, patch: patch, done: make(chan error, 1)}
+	s.mu.Lock()
+	batch, ok := s.batches[key]
+	if !ok {
+		batch = &patchBatch{}
+		s.batches[key] = batch
+		time.AfterFunc(s.batchWindow, func() { s.flush(key) })
+	}
+	batch.writers = append(batch.writers, w)
+	s.mu.Unlock()
+
+	select {
+	case err := <-w.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *WriteScheduler) flush(key objectKey) {
+	s.mu.Lock()
+	batch := s.batches[key]
+	delete(s.batches, key)
+	s.mu.Unlock()
+	if batch == nil {
+		return
+	}
+	var writers []*batchWriter
+	for _, w := range batch.writers {
+		if w.ctx.Err() == nil {
+			writers = append(writers, w)
+		}
+	}
+	if len(writers) == 0 {
+		return
+	}
+	err := s.send(key, mergePatches(key.patchType, writers))
+	if err == nil || len(writers) == 1 {
+		for _, w := range writers {
+			w.done <- err
+		}
+		return
+	}
+	// one bad operation or value fails the whole request, retry every writer on its own
+	for _, w := range writers {
+		if w.ctx.Err() != nil {
+			continue
+		}
+		w.done <- s.send(key, w.patch)
+	}
+}
+
+// mergePatches combines the patches of the writers into one, in the order they were submitted
+func mergePatches(patchType types.PatchType, writers []*batchWriter) interface{} {
+	if patchType == types.JSONPatchType {
+		var ops []jsonpatch.JsonPatchOperation
+		for _, w := range writers {
+			ops = append(ops, w.patch.([]jsonpatch.JsonPatchOperation)...)
+		}
+		return ops
+	}
+	merged := make(map[string]interface{})
+	for _, w := range writers {
+		mergeMaps(merged, w.patch.(map[string]interface{}))
+	}
+	return merged
+}
+
+func (s *WriteScheduler) send(key objectKey, patch interface{}) error {
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		return fmt.Errorf("failed to marshal patch: %w", err)
+	}
+	if err := s.limiter.Wait(s.ctx); err != nil {
+		return fmt.Errorf("rate limiter: %w", err)
+	}
+	_, err = s.dynamic.Resource(key.gvr).Namespace(key.namespace).Patch(s.ctx, key.name, key.patchType, patchBytes, metav1.PatchOptions{})
+	return err
+}
+
+// mergeMaps merges src into dst recursively, values of src win and src is left untouched
+func mergeMaps(dst, src map[string]interface{}) {
+	for k, v := range src {
+		srcMap, ok := v.(map[string]interface{})
+		if !ok {
+			dst[k] = v
+			continue
+		}
+		dstMap, ok := dst[k].(map[string]interface{})
+		if !ok {
+			dstMap = make(map[string]interface{})
+			dst[k] = dstMap
+		}
+		mergeMaps(dstMap, srcMap)
+	}
+}
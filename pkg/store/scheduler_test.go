@@ -0,0 +1,244 @@
+/*
+Copyright 2024
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/magicsong/kidecar/api"
+	"gomodules.xyz/jsonpatch/v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestWriteScheduler_MergesPatchesWithinWindow(t *testing.T) {
+	gs := newTestObject(gsGvr, "GameServer", "gs-0", nil, nil)
+	gs.SetAnnotations(map[string]string{"a": "", "b": ""})
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		gsGvr: "GameServerList",
+	}, gs)
+	patches := 0
+	client.PrependReactor("patch", "gameservers", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patches++
+		return false, nil, nil
+	})
+	scheduler := NewWriteScheduler(client, &api.KubeWriteLimit{QPS: 10, Burst: 1, BatchWindowMilliseconds: 100})
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, key := range []string{"a", "b"} {
+		wg.Add(1)
+		go func(i int, key string) {
+			defer wg.Done()
+			errs[i] = scheduler.PatchJSON(context.TODO(), gsGvr, "default", "gs-0", []jsonpatch.JsonPatchOperation{
+				jsonpatch.NewOperation("replace", "/metadata/annotations/"+key, key+"-value"),
+			})
+		}(i, key)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("PatchJSON() error = %v", err)
+		}
+	}
+	if patches != 1 {
+		t.Errorf("expected patches to be merged into one request, got %d", patches)
+	}
+	obj, err := client.Resource(gsGvr).Namespace("default").Get(context.TODO(), "gs-0", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get gameserver: %v", err)
+	}
+	if annotations := obj.GetAnnotations(); annotations["a"] != "a-value" || annotations["b"] != "b-value" {
+		t.Errorf("unexpected annotations %v", annotations)
+	}
+}
+
+func TestWriteScheduler_FailedBatchFallsBackToSingleWriters(t *testing.T) {
+	gs := newTestObject(gsGvr, "GameServer", "gs-0", nil, nil)
+	gs.SetAnnotations(map[string]string{"a": ""})
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		gsGvr: "GameServerList",
+	}, gs)
+	patches := 0
+	client.PrependReactor("patch", "gameservers", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patches++
+		if strings.Contains(string(action.(k8stesting.PatchAction).GetPatch()), "missing") {
+			return true, nil, apierrors.NewInvalid(schema.GroupKind{Group: gsGvr.Group, Kind: "GameServer"}, "gs-0", nil)
+		}
+		return false, nil, nil
+	})
+	scheduler := NewWriteScheduler(client, &api.KubeWriteLimit{BatchWindowMilliseconds: 100})
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, key := range []string{"a", "missing"} {
+		wg.Add(1)
+		go func(i int, key string) {
+			defer wg.Done()
+			errs[i] = scheduler.PatchJSON(context.TODO(), gsGvr, "default", "gs-0", []jsonpatch.JsonPatchOperation{
+				jsonpatch.NewOperation("replace", "/metadata/annotations/"+key, key+"-value"),
+			})
+		}(i, key)
+	}
+	wg.Wait()
+	if errs[0] != nil {
+		t.Errorf("expected the valid patch to succeed, got %v", errs[0])
+	}
+	if !apierrors.IsInvalid(errs[1]) {
+		t.Errorf("expected the invalid patch to fail, got %v", errs[1])
+	}
+	if patches != 3 {
+		t.Errorf("expected the batch and two single patches, got %d requests", patches)
+	}
+	obj, err := client.Resource(gsGvr).Namespace("default").Get(context.TODO(), "gs-0", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get gameserver: %v", err)
+	}
+	if annotations := obj.GetAnnotations(); annotations["a"] != "a-value" {
+		t.Errorf("unexpected annotations %v", annotations)
+	}
+}
+
+func TestWriteScheduler_FailedMergeBatchFallsBackToSingleWriters(t *testing.T) {
+	gs := newTestObject(gsGvr, "GameServer", "gs-0", nil, nil)
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		gsGvr: "GameServerList",
+	}, gs)
+	var patches []string
+	client.PrependReactor("patch", "gameservers", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := string(action.(k8stesting.PatchAction).GetPatch())
+		patches = append(patches, patch)
+		if strings.Contains(patch, "invalid") {
+			return true, nil, apierrors.NewInvalid(schema.GroupKind{Group: gsGvr.Group, Kind: "GameServer"}, "gs-0", nil)
+		}
+		return true, gs, nil
+	})
+	scheduler := NewWriteScheduler(client, &api.KubeWriteLimit{BatchWindowMilliseconds: 100})
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, value := range []string{"valid", "invalid"} {
+		wg.Add(1)
+		go func(i int, value string) {
+			defer wg.Done()
+			errs[i] = scheduler.PatchStrategicMerge(context.TODO(), gsGvr, "default", "gs-0", map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"labels": map[string]interface{}{value: value},
+				},
+			})
+		}(i, value)
+	}
+	wg.Wait()
+	if errs[0] != nil {
+		t.Errorf("expected the valid patch to succeed, got %v", errs[0])
+	}
+	if !apierrors.IsInvalid(errs[1]) {
+		t.Errorf("expected the invalid patch to fail, got %v", errs[1])
+	}
+	if len(patches) != 3 {
+		t.Fatalf("expected the batch and two single patches, got %v", patches)
+	}
+	for _, patch := range patches[1:] {
+		if strings.Contains(patch, `"valid"`) == strings.Contains(patch, `"invalid"`) {
+			t.Errorf("expected the single patch to hold only its own writer, got %s", patch)
+		}
+	}
+}
+
+func TestWriteScheduler_SkipsCancelledWriters(t *testing.T) {
+	gs := newTestObject(gsGvr, "GameServer", "gs-0", nil, nil)
+	gs.SetAnnotations(map[string]string{"a": "", "b": ""})
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		gsGvr: "GameServerList",
+	}, gs)
+	scheduler := NewWriteScheduler(client, &api.KubeWriteLimit{BatchWindowMilliseconds: 100})
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, c := range []context.Context{ctx, context.TODO()} {
+		wg.Add(1)
+		go func(i int, ctx context.Context) {
+			defer wg.Done()
+			key := []string{"a", "b"}[i]
+			errs[i] = scheduler.PatchJSON(ctx, gsGvr, "default", "gs-0", []jsonpatch.JsonPatchOperation{
+				jsonpatch.NewOperation("replace", "/metadata/annotations/"+key, key+"-value"),
+			})
+		}(i, c)
+	}
+	wg.Wait()
+	if errs[0] != context.Canceled {
+		t.Errorf("expected the cancelled writer to fail, got %v", errs[0])
+	}
+	if errs[1] != nil {
+		t.Errorf("expected the other writer to succeed, got %v", errs[1])
+	}
+	obj, err := client.Resource(gsGvr).Namespace("default").Get(context.TODO(), "gs-0", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get gameserver: %v", err)
+	}
+	if annotations := obj.GetAnnotations(); annotations["a"] != "" || annotations["b"] != "b-value" {
+		t.Errorf("expected only the patch of the live writer, got %v", annotations)
+	}
+}
+
+func TestWriteScheduler_StopInterruptsRateLimiter(t *testing.T) {
+	gs := newTestObject(gsGvr, "GameServer", "gs-0", nil, nil)
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		gsGvr: "GameServerList",
+	}, gs)
+	scheduler := NewWriteScheduler(client, &api.KubeWriteLimit{QPS: 0.001, Burst: 1})
+	scheduler.limiter.Accept()
+	scheduler.Stop()
+
+	err := scheduler.PatchJSON(context.TODO(), gsGvr, "default", "gs-0", []jsonpatch.JsonPatchOperation{
+		jsonpatch.NewOperation("add", "/metadata/annotations", map[string]string{"a": "a"}),
+	})
+	if err == nil {
+		t.Errorf("expected the stopped scheduler to fail the write")
+	}
+}
+
+func TestMergeMaps(t *testing.T) {
+	dst := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]interface{}{"a": "1", "b": "1"},
+		},
+	}
+	mergeMaps(dst, map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      map[string]interface{}{"b": "2"},
+			"annotations": map[string]interface{}{"c": "3"},
+		},
+	})
+	metadata := dst["metadata"].(map[string]interface{})
+	labels := metadata["labels"].(map[string]interface{})
+	if labels["a"] != "1" || labels["b"] != "2" {
+		t.Errorf("unexpected labels %v", labels)
+	}
+	if metadata["annotations"].(map[string]interface{})["c"] != "3" {
+		t.Errorf("unexpected annotations %v", metadata["annotations"])
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/magicsong/kidecar/api"
+	"github.com/magicsong/kidecar/pkg/info"
+	"github.com/magicsong/kidecar/pkg/template"
+)
+
+const (
+	StatsDTypeGauge   = "Gauge"
+	StatsDTypeCounter = "Counter"
+	StatsDTypeTiming  = "Timing"
+)
+
+var _ Storage = &statsD{}
+
+var statsDTypeSuffix = map[string]string{
+	StatsDTypeGauge:   "g",
+	StatsDTypeCounter: "c",
+	StatsDTypeTiming:  "ms",
+}
+
+type statsD struct {
+	mu          sync.Mutex
+	conns       map[string]net.Conn
+	initialized bool
+}
+
+// IsInitialized implements Storage.
+func (s *statsD) IsInitialized() bool {
+	return s.initialized
+}
+
+// SetupWithManager implements Storage.
+func (s *statsD) SetupWithManager(mgr api.SidecarManager) error {
+	s.conns = make(map[string]net.Conn)
+	s.initialized = true
+	return nil
+}
+
+// Store implements Storage.
+func (s *statsD) Store(data string, config interface{}) error {
+	myconfig, ok := config.(*StatsDConfig)
+	if !ok || myconfig == nil {
+		return fmt.Errorf("invalid statsd config type")
+	}
+	if err := myconfig.IsValid(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	if _, err := strconv.ParseFloat(data, 64); err != nil {
+		return fmt.Errorf("bad data of statsd, err: %w", err)
+	}
+	sampleRate := myconfig.SampleRate
+	if sampleRate <= 0 || sampleRate > 1 {
+		sampleRate = 1
+	}
+	if sampleRate < 1 && rand.Float64() >= sampleRate {
+		return nil
+	}
+	tags, err := statsDTags(myconfig)
+	if err != nil {
+		return err
+	}
+	packet := formatStatsD(myconfig, data, sampleRate, tags)
+	conn, err := s.getOrCreateConn(myconfig.Address)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte(packet)); err != nil {
+		return fmt.Errorf("failed to send statsd packet: %w", err)
+	}
+	return nil
+}
+
+func (s *statsD) getOrCreateConn(address string) (net.Conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if conn, ok := s.conns[address]; ok {
+		return conn, nil
+	}
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial statsd %s: %w", address, err)
+	}
+	s.conns[address] = conn
+	return conn, nil
+}
+
+// statsDTags returns the sorted tags of the pod and the configured tags
+func statsDTags(config *StatsDConfig) ([]string, error) {
+	tags := map[string]string{}
+	if nsName, err := info.GetCurrentPodNamespaceAndName(); err == nil {
+		tags["pod"] = nsName.Name
+		tags["namespace"] = nsName.Namespace
+	}
+	for k, v := range config.Tags {
+		expanded, err := template.ExpandString(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to expand tag %s: %w", k, err)
+		}
+		tags[k] = expanded
+	}
+	result := make([]string, 0, len(tags))
+	for k, v := range tags {
+		result = append(result, k+":"+v)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// formatStatsD builds a line like prefix.name:value|type|@rate|#tag:value.
+// A signed gauge value is a delta in statsd, so a negative gauge is sent as a reset to 0 followed by the decrement.
+func formatStatsD(config *StatsDConfig, value string, sampleRate float64, tags []string) string {
+	metricType := config.Type
+	if metricType == "" {
+		metricType = StatsDTypeGauge
+	}
+	if metricType != StatsDTypeGauge {
+		return formatStatsDLine(config, metricType, value, sampleRate, tags)
+	}
+	value = strings.TrimPrefix(value, "+")
+	if !strings.HasPrefix(value, "-") {
+		return formatStatsDLine(config, metricType, value, sampleRate, tags)
+	}
+	return formatStatsDLine(config, metricType, "0", sampleRate, tags) + "\n" + formatStatsDLine(config, metricType, value, sampleRate, tags)
+}
+
+func formatStatsDLine(config *StatsDConfig, metricType, value string, sampleRate float64, tags []string) string {
+	var b strings.Builder
+	b.WriteString(config.Prefix)
+	b.WriteString(config.MetricName)
+	b.WriteString(":")
+	b.WriteString(value)
+	b.WriteString("|")
+	b.WriteString(statsDTypeSuffix[metricType])
+	if sampleRate < 1 {
+		b.WriteString("|@")
+		b.WriteString(strconv.FormatFloat(sampleRate, 'f', -1, 64))
+	}
+	// plain statsd servers do not understand tags
+	if config.DogStatsD && len(tags) > 0 {
+		b.WriteString("|#")
+		b.WriteString(strings.Join(tags, ","))
+	}
+	return b.String()
+}
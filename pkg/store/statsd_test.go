@@ -0,0 +1,103 @@
+/*
+Copyright 2024
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatsD_Store(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "gs-0")
+	t.Setenv("GAME_REGION", "eu")
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	storage := &statsD{}
+	if err := storage.SetupWithManager(nil); err != nil {
+		t.Fatalf("SetupWithManager() error = %v", err)
+	}
+	tests := []struct {
+		name   string
+		config *StatsDConfig
+		data   string
+		want   string
+	}{
+		{
+			name:   "PlainGauge",
+			config: &StatsDConfig{Address: listener.LocalAddr().String(), Prefix: "game.", MetricName: "players", Tags: map[string]string{"x": "y"}},
+			data:   "7",
+			want:   "game.players:7|g",
+		},
+		{
+			name:   "NegativeGauge",
+			config: &StatsDConfig{Address: listener.LocalAddr().String(), MetricName: "balance"},
+			data:   "-5",
+			want:   "balance:0|g\nbalance:-5|g",
+		},
+		{
+			name:   "SignedPositiveGauge",
+			config: &StatsDConfig{Address: listener.LocalAddr().String(), MetricName: "balance"},
+			data:   "+5",
+			want:   "balance:5|g",
+		},
+		{
+			name: "DogStatsDTiming",
+			config: &StatsDConfig{
+				Address:    listener.LocalAddr().String(),
+				MetricName: "probe_latency",
+				Type:       StatsDTypeTiming,
+				SampleRate: 1,
+				DogStatsD:  true,
+				Tags:       map[string]string{"region": "${SELF:GAME_REGION}"},
+			},
+			data: "12.5",
+			want: "probe_latency:12.5|ms|#namespace:default,pod:gs-0,region:eu",
+		},
+	}
+	buf := make([]byte, 1024)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := storage.Store(tt.data, tt.config); err != nil {
+				t.Fatalf("Store() error = %v", err)
+			}
+			listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, _, err := listener.ReadFrom(buf)
+			if err != nil {
+				t.Fatalf("failed to read packet: %v", err)
+			}
+			if got := string(buf[:n]); got != tt.want {
+				t.Errorf("packet = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if err := storage.Store("Allocated", tests[0].config); err == nil {
+		t.Errorf("expected error for non numeric data")
+	}
+}
+
+func TestFormatStatsD_SampleRate(t *testing.T) {
+	got := formatStatsD(&StatsDConfig{MetricName: "matches", Type: StatsDTypeCounter}, "1", 0.25, nil)
+	if got != "matches:1|c|@0.25" {
+		t.Errorf("formatStatsD() = %q", got)
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/magicsong/kidecar/pkg/info"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+)
+
+// maxOwnerDepth limits how far the ownerReferences chain of the pod is walked
+const maxOwnerDepth = 5
+
+// targetResolver finds the concrete kube objects a TargetKubeObject refers to
+type targetResolver struct {
+	dynamic dynamic.Interface
+	mapper  meta.RESTMapper
+}
+
+// Resolve returns the namespaced names of all objects matched by the target.
+// A static name is returned as is, PodOwner walks the ownerReferences of the
+// current pod and LabelSelector lists the matching objects in the namespace.
+// Owners always live in the namespace of the pod, so PodOwner ignores the
+// namespace of the target.
+func (r *targetResolver) Resolve(ctx context.Context, target *TargetKubeObject) ([]types.NamespacedName, error) {
+	if target.PodOwner {
+		owner, err := r.findPodOwner(ctx, target.ToGvr())
+		if err != nil {
+			return nil, err
+		}
+		return []types.NamespacedName{owner}, nil
+	}
+	namespace := target.Namespace
+	if namespace == "" {
+		nsName, err := info.GetCurrentPodNamespaceAndName()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get current pod namespace: %w", err)
+		}
+		namespace = nsName.Namespace
+	}
+	if target.LabelSelector != nil {
+		return r.listBySelector(ctx, target.ToGvr(), namespace, target.LabelSelector)
+	}
+	return []types.NamespacedName{{Namespace: namespace, Name: target.Name}}, nil
+}
+
+// findPodOwner walks up the ownerReferences of the current pod until an owner of the given resource is found.
+// Owners whose kind can not be mapped to a resource are skipped.
+func (r *targetResolver) findPodOwner(ctx context.Context, gvr schema.GroupVersionResource) (types.NamespacedName, error) {
+	pod, err := info.GetCurrentPod()
+	if err != nil {
+		return types.NamespacedName{}, fmt.Errorf("failed to get current pod: %w", err)
+	}
+	owners := pod.OwnerReferences
+	for depth := 0; depth < maxOwnerDepth; depth++ {
+		var next *metav1.OwnerReference
+		var nextGvr schema.GroupVersionResource
+		for i := range owners {
+			ownerGvr, err := r.ownerToGvr(owners[i])
+			if err != nil {
+				continue
+			}
+			if ownerGvr.Group == gvr.Group && ownerGvr.Resource == gvr.Resource {
+				return types.NamespacedName{Namespace: pod.Namespace, Name: owners[i].Name}, nil
+			}
+			if next == nil || (owners[i].Controller != nil && *owners[i].Controller) {
+				next = &owners[i]
+				nextGvr = ownerGvr
+			}
+		}
+		if next == nil {
+			break
+		}
+		obj, err := r.dynamic.Resource(nextGvr).Namespace(pod.Namespace).Get(ctx, next.Name, metav1.GetOptions{})
+		if err != nil {
+			return types.NamespacedName{}, fmt.Errorf("failed to get owner %s %s: %w", next.Kind, next.Name, err)
+		}
+		owners = obj.GetOwnerReferences()
+	}
+	return types.NamespacedName{}, fmt.Errorf("no owner of resource %s found for pod %s", gvr.String(), pod.Name)
+}
+
+func (r *targetResolver) ownerToGvr(owner metav1.OwnerReference) (schema.GroupVersionResource, error) {
+	gv, err := schema.ParseGroupVersion(owner.APIVersion)
+	if err != nil {
+		return schema.GroupVersionResource{}, fmt.Errorf("invalid apiVersion of owner %s: %w", owner.Name, err)
+	}
+	mapping, err := r.mapper.RESTMapping(gv.WithKind(owner.Kind).GroupKind(), gv.Version)
+	if err != nil {
+		return schema.GroupVersionResource{}, fmt.Errorf("failed to map owner kind %s: %w", owner.Kind, err)
+	}
+	return mapping.Resource, nil
+}
+
+func (r *targetResolver) listBySelector(ctx context.Context, gvr schema.GroupVersionResource, namespace string, labelSelector *metav1.LabelSelector) ([]types.NamespacedName, error) {
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid label selector: %w", err)
+	}
+	list, err := r.dynamic.Resource(gvr).Namespace(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", gvr.String(), err)
+	}
+	if len(list.Items) == 0 {
+		return nil, fmt.Errorf("no %s matches label selector %q in namespace %s", gvr.String(), selector.String(), namespace)
+	}
+	names := make([]types.NamespacedName, 0, len(list.Items))
+	for _, item := range list.Items {
+		names = append(names, types.NamespacedName{Namespace: item.GetNamespace(), Name: item.GetName()})
+	}
+	return names, nil
+}
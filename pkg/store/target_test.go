@@ -0,0 +1,157 @@
+/*
+Copyright 2024
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"testing"
+
+	"github.com/agiledragon/gomonkey/v2"
+	"github.com/magicsong/kidecar/pkg/info"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+var (
+	gsGvr  = schema.GroupVersionResource{Group: "game.kruise.io", Version: "v1alpha1", Resource: "gameservers"}
+	gssGvr = schema.GroupVersionResource{Group: "game.kruise.io", Version: "v1alpha1", Resource: "gameserversets"}
+	stsGvr = schema.GroupVersionResource{Group: "apps.kruise.io", Version: "v1beta1", Resource: "statefulsets"}
+	svcGvr = schema.GroupVersionResource{Group: "", Version: "v1", Resource: "services"}
+)
+
+func newTestObject(gvr schema.GroupVersionResource, kind, name string, labels map[string]string, owner *metav1.OwnerReference) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(gvr.GroupVersion().String())
+	obj.SetKind(kind)
+	obj.SetNamespace("default")
+	obj.SetName(name)
+	obj.SetLabels(labels)
+	if owner != nil {
+		obj.SetOwnerReferences([]metav1.OwnerReference{*owner})
+	}
+	return obj
+}
+
+func newTestResolver(objects ...runtime.Object) *targetResolver {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(gsGvr.GroupVersion().WithKind("GameServer"), meta.RESTScopeNamespace)
+	mapper.Add(gssGvr.GroupVersion().WithKind("GameServerSet"), meta.RESTScopeNamespace)
+	mapper.Add(stsGvr.GroupVersion().WithKind("StatefulSet"), meta.RESTScopeNamespace)
+	mapper.Add(svcGvr.GroupVersion().WithKind("Service"), meta.RESTScopeNamespace)
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		gsGvr:  "GameServerList",
+		gssGvr: "GameServerSetList",
+		stsGvr: "StatefulSetList",
+		svcGvr: "ServiceList",
+	}, objects...)
+	return &targetResolver{dynamic: client, mapper: mapper}
+}
+
+func TestTargetResolver_Resolve(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "gs-0")
+	controller := true
+	patchPod := gomonkey.ApplyFunc(info.GetCurrentPod, func() (*corev1.Pod, error) {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "gs-0",
+				Namespace: "default",
+				OwnerReferences: []metav1.OwnerReference{
+					{APIVersion: "example.com/v1", Kind: "Unknown", Name: "unknown"},
+					{APIVersion: "apps.kruise.io/v1beta1", Kind: "StatefulSet", Name: "gs", Controller: &controller},
+				},
+			},
+		}, nil
+	})
+	defer patchPod.Reset()
+
+	resolver := newTestResolver(
+		newTestObject(stsGvr, "StatefulSet", "gs", nil, &metav1.OwnerReference{APIVersion: "game.kruise.io/v1alpha1", Kind: "GameServerSet", Name: "gs-set", Controller: &controller}),
+		newTestObject(gssGvr, "GameServerSet", "gs-set", nil, nil),
+		newTestObject(svcGvr, "Service", "svc-a", map[string]string{"app": "gs"}, nil),
+		newTestObject(svcGvr, "Service", "svc-b", map[string]string{"app": "gs"}, nil),
+		newTestObject(svcGvr, "Service", "svc-c", map[string]string{"app": "other"}, nil),
+	)
+
+	tests := []struct {
+		name    string
+		target  *TargetKubeObject
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "StaticName",
+			target: &TargetKubeObject{Version: "v1", Resource: "services", Name: "svc-c"},
+			want:   []string{"svc-c"},
+		},
+		{
+			name:   "DirectOwner",
+			target: &TargetKubeObject{Group: "apps.kruise.io", Version: "v1beta1", Resource: "statefulsets", PodOwner: true},
+			want:   []string{"gs"},
+		},
+		{
+			name:   "OwnerOfOwner",
+			target: &TargetKubeObject{Group: "game.kruise.io", Version: "v1alpha1", Resource: "gameserversets", PodOwner: true},
+			want:   []string{"gs-set"},
+		},
+		{
+			name:   "OwnerIgnoresTargetNamespace",
+			target: &TargetKubeObject{Group: "apps.kruise.io", Version: "v1beta1", Resource: "statefulsets", Namespace: "other", PodOwner: true},
+			want:   []string{"gs"},
+		},
+		{
+			name:    "OwnerNotFound",
+			target:  &TargetKubeObject{Version: "v1", Resource: "services", PodOwner: true},
+			wantErr: true,
+		},
+		{
+			name: "LabelSelector",
+			target: &TargetKubeObject{Version: "v1", Resource: "services", LabelSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": "gs"},
+			}},
+			want: []string{"svc-a", "svc-b"},
+		},
+		{
+			name: "LabelSelectorMatchesNothing",
+			target: &TargetKubeObject{Version: "v1", Resource: "services", LabelSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": "none"},
+			}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolver.Resolve(context.TODO(), tt.target)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Resolve() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Resolve() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i].Name != tt.want[i] || got[i].Namespace != "default" {
+					t.Errorf("Resolve() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
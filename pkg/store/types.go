@@ -16,10 +16,37 @@ limitations under the License.
 
 package store
 
-import "github.com/magicsong/kidecar/api"
+import (
+	"context"
+	"errors"
+
+	"github.com/magicsong/kidecar/api"
+)
+
+var (
+	// ErrNotReadable is returned when the storage can not read back the stored data
+	ErrNotReadable = errors.New("storage is not readable")
+	// ErrNoData is returned when nothing has been stored with the config yet
+	ErrNoData = errors.New("no stored data")
+)
 
 type Storage interface {
 	IsInitialized() bool
 	SetupWithManager(mgr api.SidecarManager) error
 	Store(data string, config interface{}) error
 }
+
+// ContextStorage is a Storage whose writes stop when the context is done
+type ContextStorage interface {
+	Storage
+	StoreWithContext(ctx context.Context, data string, config interface{}) error
+}
+
+// ReadableStorage is a Storage which can read back what is stored with a config
+type ReadableStorage interface {
+	Storage
+	// Load returns the data currently stored with the config
+	Load(ctx context.Context, config interface{}) (string, error)
+	// Watch calls the handler with the stored data every time it changes, until the context is done
+	Watch(ctx context.Context, config interface{}, handler func(data string)) error
+}
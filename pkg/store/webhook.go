@@ -0,0 +1,162 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/magicsong/kidecar/api"
+	"github.com/magicsong/kidecar/pkg/info"
+	"github.com/magicsong/kidecar/pkg/template"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// WebhookSignatureHeader carries the hex encoded HMAC-SHA256 of the request body
+	WebhookSignatureHeader = "X-Kidecar-Signature"
+
+	defaultWebhookTimeoutSeconds = 5
+	maxWebhookBackoff            = 30 * time.Second
+)
+
+var _ ContextStorage = &webhook{}
+
+// WebhookPayload is the json body posted to the webhook
+type WebhookPayload struct {
+	Value        string    `json:"value"`
+	Plugin       string    `json:"plugin,omitempty"`
+	Endpoint     string    `json:"endpoint,omitempty"`
+	PodNamespace string    `json:"podNamespace"`
+	PodName      string    `json:"podName"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+type webhook struct {
+	client *http.Client
+	log    logr.Logger
+}
+
+// IsInitialized implements Storage.
+func (w *webhook) IsInitialized() bool {
+	return w.client != nil
+}
+
+// SetupWithManager implements Storage.
+func (w *webhook) SetupWithManager(mgr api.SidecarManager) error {
+	w.client = &http.Client{}
+	w.log = logf.Log.WithName("webhook")
+	return nil
+}
+
+// Store implements Storage.
+func (w *webhook) Store(data string, config interface{}) error {
+	return w.StoreWithContext(context.Background(), data, config)
+}
+
+// StoreWithContext implements ContextStorage, retries stop when the context is done.
+func (w *webhook) StoreWithContext(ctx context.Context, data string, config interface{}) error {
+	myconfig, ok := config.(*WebhookConfig)
+	if !ok || myconfig == nil {
+		return fmt.Errorf("invalid webhook config type")
+	}
+	if err := myconfig.IsValid(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	nsName, err := info.GetCurrentPodNamespaceAndName()
+	if err != nil {
+		return fmt.Errorf("failed to get current pod namespace and name: %w", err)
+	}
+	body, err := json.Marshal(&WebhookPayload{
+		Value:        data,
+		Plugin:       myconfig.source.Plugin,
+		Endpoint:     myconfig.source.Endpoint,
+		PodNamespace: nsName.Namespace,
+		PodName:      nsName.Name,
+		Timestamp:    time.Now().UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook payload: %w", err)
+	}
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		retryable, err := w.post(ctx, myconfig, body)
+		if err == nil {
+			return nil
+		}
+		if !retryable || attempt >= myconfig.Retries {
+			return fmt.Errorf("failed to post webhook after %d attempts: %w", attempt+1, err)
+		}
+		w.log.Error(template.RedactError(err), "failed to post webhook, retry again", "url", template.Redact(myconfig.URL), "backoff", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("failed to post webhook after %d attempts: %w", attempt+1, ctx.Err())
+		}
+		backoff = min(backoff*2, maxWebhookBackoff)
+	}
+}
+
+// post sends the body once and returns whether a failure is worth retrying.
+// Client errors are not retried, except for request timeouts and rate limiting.
+func (w *webhook) post(ctx context.Context, config *WebhookConfig, body []byte) (bool, error) {
+	timeout := config.TimeoutSeconds
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeoutSeconds
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range config.Headers {
+		req.Header.Set(key, value)
+	}
+	if config.SigningSecret != "" {
+		req.Header.Set(WebhookSignatureHeader, "sha256="+signPayload(config.SigningSecret, body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+		return retryable, fmt.Errorf("unexpected status code %d, body: %s", resp.StatusCode, string(respBody))
+	}
+	return false, nil
+}
+
+// signPayload returns the hex encoded HMAC-SHA256 of the body
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2024
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhook_Store(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "gs-0")
+
+	requests := 0
+	var payload WebhookPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		// fail the first attempt to exercise the retry
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if got, want := r.Header.Get(WebhookSignatureHeader), "sha256="+signPayload("secret", body); got != want {
+			t.Errorf("signature = %s, want %s", got, want)
+		}
+		if r.Header.Get("X-Token") != "token" {
+			t.Errorf("missing custom header")
+		}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("invalid payload: %v", err)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	config := &StorageConfig{
+		Type: StorageTypeWebhook,
+		Webhook: &WebhookConfig{
+			URL:           server.URL,
+			Headers:       map[string]string{"X-Token": "token"},
+			SigningSecret: "secret",
+			Retries:       1,
+		},
+	}
+	config.SetSource(DataSource{Plugin: "http_probe", Endpoint: "http://localhost:8080"})
+	storage := &webhook{}
+	if err := storage.SetupWithManager(nil); err != nil {
+		t.Fatalf("SetupWithManager() error = %v", err)
+	}
+	if err := config.storeDirect(context.TODO(), &fakeFactory{storage: storage}, "Allocated"); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+	if requests != 2 {
+		t.Errorf("expected 2 requests, got %d", requests)
+	}
+	if payload.Value != "Allocated" || payload.Plugin != "http_probe" || payload.Endpoint != "http://localhost:8080" ||
+		payload.PodNamespace != "default" || payload.PodName != "gs-0" || payload.Timestamp.IsZero() {
+		t.Errorf("unexpected payload %+v", payload)
+	}
+}
+
+func TestWebhook_StoreRetries(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "gs-0")
+
+	tests := []struct {
+		name         string
+		status       int
+		wantRequests int
+	}{
+		{"BadRequestIsNotRetried", http.StatusBadRequest, 1},
+		{"NotFoundIsNotRetried", http.StatusNotFound, 1},
+		{"TooManyRequestsIsRetried", http.StatusTooManyRequests, 2},
+		{"ServerErrorIsRetried", http.StatusInternalServerError, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+			storage := &webhook{}
+			storage.SetupWithManager(nil)
+			if err := storage.Store("Allocated", &WebhookConfig{URL: server.URL, Retries: 1}); err == nil {
+				t.Fatalf("Store() expected an error")
+			}
+			if requests != tt.wantRequests {
+				t.Errorf("expected %d requests, got %d", tt.wantRequests, requests)
+			}
+		})
+	}
+}
+
+func TestWebhook_StoreWithContextStopsRetrying(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "gs-0")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	storage := &webhook{}
+	storage.SetupWithManager(nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := storage.StoreWithContext(ctx, "Allocated", &WebhookConfig{URL: server.URL, Retries: 10})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("StoreWithContext() error = %v, want deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected retries to stop with the context, took %v", elapsed)
+	}
+}
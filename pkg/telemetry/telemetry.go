@@ -0,0 +1,151 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package telemetry
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/magicsong/kidecar/api"
+	"github.com/magicsong/kidecar/pkg/info"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	ProtocolGRPC = "grpc"
+	ProtocolHTTP = "http"
+
+	defaultServiceName = "kidecar"
+	tracerName         = "github.com/magicsong/kidecar"
+
+	// GameServerNameKey is the name of the GameServer, which is the same as the pod name
+	GameServerNameKey = attribute.Key("game.kruise.io.gameserver.name")
+)
+
+var serviceName = defaultServiceName
+
+// SetServiceName sets the service name of the resource describing the sidecar, empty keeps the default
+func SetServiceName(name string) {
+	if name != "" {
+		serviceName = name
+	}
+}
+
+// ServiceName returns the service name of the resource describing the sidecar
+func ServiceName() string {
+	return serviceName
+}
+
+// Setup installs the global tracer provider exporting spans to the collector.
+// Without calling it, spans are created by the noop provider and cost nothing.
+func Setup(ctx context.Context, config *api.TelemetryConfig) (func(context.Context) error, error) {
+	exporter, err := NewTraceExporter(ctx, &config.OTLP)
+	if err != nil {
+		return nil, err
+	}
+	SetServiceName(config.ServiceName)
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(NewResource(ServiceName())),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the tracer of the sidecar
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// EndSpan records the error of the operation and ends the span
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// NewResource describes the sidecar with the identity of its pod and GameServer
+func NewResource(serviceName string) *resource.Resource {
+	attrs := []attribute.KeyValue{attribute.String("service.name", serviceName)}
+	attrs = append(attrs, PodAttributes()...)
+	return resource.NewSchemaless(attrs...)
+}
+
+// PodAttributes returns the identity of the current pod and its GameServer
+func PodAttributes() []attribute.KeyValue {
+	nsName, err := info.GetCurrentPodNamespaceAndName()
+	if err != nil {
+		return nil
+	}
+	return []attribute.KeyValue{
+		attribute.String("k8s.namespace.name", nsName.Namespace),
+		attribute.String("k8s.pod.name", nsName.Name),
+		GameServerNameKey.String(nsName.Name),
+	}
+}
+
+// NewTraceExporter creates an OTLP span exporter over grpc or http
+func NewTraceExporter(ctx context.Context, config *api.OTLPConfig) (sdktrace.SpanExporter, error) {
+	switch config.Protocol {
+	case "", ProtocolGRPC:
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(config.Endpoint), otlptracegrpc.WithHeaders(config.Headers)}
+		if config.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		return otlptracegrpc.New(ctx, opts...)
+	case ProtocolHTTP:
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.Endpoint), otlptracehttp.WithHeaders(config.Headers)}
+		if config.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unsupported otlp protocol %s", config.Protocol)
+	}
+}
+
+// NewMetricExporter creates an OTLP metric exporter over grpc or http
+func NewMetricExporter(ctx context.Context, config *api.OTLPConfig) (sdkmetric.Exporter, error) {
+	switch config.Protocol {
+	case "", ProtocolGRPC:
+		opts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithEndpoint(config.Endpoint), otlpmetricgrpc.WithHeaders(config.Headers)}
+		if config.Insecure {
+			opts = append(opts, otlpmetricgrpc.WithInsecure())
+		}
+		return otlpmetricgrpc.New(ctx, opts...)
+	case ProtocolHTTP:
+		opts := []otlpmetrichttp.Option{otlpmetrichttp.WithEndpoint(config.Endpoint), otlpmetrichttp.WithHeaders(config.Headers)}
+		if config.Insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		}
+		return otlpmetrichttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unsupported otlp protocol %s", config.Protocol)
+	}
+}
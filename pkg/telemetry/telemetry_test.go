@@ -0,0 +1,96 @@
+/*
+Copyright 2024
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/magicsong/kidecar/api"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSetup(t *testing.T) {
+	os.Setenv("POD_NAMESPACE", "default")
+	os.Setenv("POD_NAME", "gs-0")
+
+	// the server stands in for an OTLP collector receiving traces over http
+	var mu sync.Mutex
+	spans := map[string]bool{}
+	resourceAttrs := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		req := &coltracepb.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.GetResourceSpans() {
+			for _, kv := range rs.GetResource().GetAttributes() {
+				resourceAttrs[kv.GetKey()] = kv.GetValue().GetStringValue()
+			}
+			for _, ss := range rs.GetScopeSpans() {
+				for _, span := range ss.GetSpans() {
+					spans[span.GetName()] = span.GetStatus().GetMessage() != ""
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	shutdown, err := Setup(context.TODO(), &api.TelemetryConfig{
+		OTLP: api.OTLPConfig{Endpoint: strings.TrimPrefix(server.URL, "http://"), Protocol: ProtocolHTTP, Insecure: true},
+	})
+	if err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+	ctx, parent := Tracer().Start(context.TODO(), "http_probe.Probe")
+	_, child := Tracer().Start(ctx, "store.InKube")
+	EndSpan(child, fmt.Errorf("patch failed"))
+	EndSpan(parent, nil)
+	if err := shutdown(context.TODO()); err != nil {
+		t.Fatalf("shutdown error = %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if failed, ok := spans["store.InKube"]; !ok || !failed {
+		t.Errorf("expected failed store span, got %v", spans)
+	}
+	if failed, ok := spans["http_probe.Probe"]; !ok || failed {
+		t.Errorf("expected successful probe span, got %v", spans)
+	}
+	if resourceAttrs["service.name"] != "kidecar" || resourceAttrs["k8s.pod.name"] != "gs-0" || resourceAttrs[string(GameServerNameKey)] != "gs-0" {
+		t.Errorf("unexpected resource attributes %v", resourceAttrs)
+	}
+}
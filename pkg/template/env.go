@@ -0,0 +1,253 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package template
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/magicsong/kidecar/pkg/info"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// podEnv resolves ${POD:VAR} in the default container and ${POD:container/VAR} in the named one
+func (r *resolver) podEnv(key string) (string, bool, error) {
+	containerName, name, named := strings.Cut(key, "/")
+	if !named {
+		name = containerName
+	}
+	var container *corev1.Container
+	if named {
+		pod, err := r.currentPod()
+		if err != nil {
+			return "", false, err
+		}
+		if container = findContainer(pod, containerName); container == nil {
+			return "", false, fmt.Errorf("container %s not found", containerName)
+		}
+	} else {
+		if r.container == nil {
+			pod, err := r.currentPod()
+			if err != nil {
+				return "", false, err
+			}
+			if len(pod.Spec.Containers) == 0 {
+				return "", false, nil
+			}
+			r.container = &pod.Spec.Containers[0]
+		}
+		container = r.container
+	}
+	return r.containerEnv(container, name)
+}
+
+func findContainer(pod *corev1.Pod, name string) *corev1.Container {
+	for i := range pod.Spec.Containers {
+		if pod.Spec.Containers[i].Name == name {
+			return &pod.Spec.Containers[i]
+		}
+	}
+	for i := range pod.Spec.InitContainers {
+		if pod.Spec.InitContainers[i].Name == name {
+			return &pod.Spec.InitContainers[i]
+		}
+	}
+	return nil
+}
+
+// containerEnv resolves the variable like the kubelet does, env overrides envFrom and later entries override earlier ones
+func (r *resolver) containerEnv(container *corev1.Container, name string) (string, bool, error) {
+	for i := len(container.Env) - 1; i >= 0; i-- {
+		if container.Env[i].Name == name {
+			return r.envVarValue(container, &container.Env[i])
+		}
+	}
+	for i := len(container.EnvFrom) - 1; i >= 0; i-- {
+		value, found, err := r.envFromValue(&container.EnvFrom[i], name)
+		if err != nil || found {
+			return value, found, err
+		}
+	}
+	return "", false, nil
+}
+
+func (r *resolver) envVarValue(container *corev1.Container, envVar *corev1.EnvVar) (string, bool, error) {
+	from := envVar.ValueFrom
+	if from == nil {
+		return envVar.Value, true, nil
+	}
+	switch {
+	case from.FieldRef != nil:
+		return r.podField(from.FieldRef.FieldPath)
+	case from.ResourceFieldRef != nil:
+		return r.resourceFieldValue(container, from.ResourceFieldRef)
+	case from.ConfigMapKeyRef != nil:
+		ref := from.ConfigMapKeyRef
+		cm, err := r.configMap(ref.Name, isOptional(ref.Optional))
+		if err != nil || cm == nil {
+			return "", false, err
+		}
+		if value, ok := cm.Data[ref.Key]; ok {
+			return value, true, nil
+		}
+		if value, ok := cm.BinaryData[ref.Key]; ok {
+			return string(value), true, nil
+		}
+		if isOptional(ref.Optional) {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("key %s not found in configmap %s", ref.Key, ref.Name)
+	case from.SecretKeyRef != nil:
+		ref := from.SecretKeyRef
+		secret, err := r.secret(ref.Name, isOptional(ref.Optional))
+		if err != nil || secret == nil {
+			return "", false, err
+		}
+		if value, ok := secret.Data[ref.Key]; ok {
+			addRedaction(string(value))
+			return string(value), true, nil
+		}
+		if isOptional(ref.Optional) {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("key %s not found in secret %s", ref.Key, ref.Name)
+	}
+	return "", false, fmt.Errorf("unsupported valueFrom of environment variable %s", envVar.Name)
+}
+
+func (r *resolver) envFromValue(source *corev1.EnvFromSource, name string) (string, bool, error) {
+	key, ok := strings.CutPrefix(name, source.Prefix)
+	if !ok {
+		return "", false, nil
+	}
+	switch {
+	case source.ConfigMapRef != nil:
+		cm, err := r.configMap(source.ConfigMapRef.Name, isOptional(source.ConfigMapRef.Optional))
+		if err != nil || cm == nil {
+			return "", false, err
+		}
+		value, ok := cm.Data[key]
+		return value, ok, nil
+	case source.SecretRef != nil:
+		secret, err := r.secret(source.SecretRef.Name, isOptional(source.SecretRef.Optional))
+		if err != nil || secret == nil {
+			return "", false, err
+		}
+		value, ok := secret.Data[key]
+		addRedaction(string(value))
+		return string(value), ok, nil
+	}
+	return "", false, nil
+}
+
+// resourceFieldValue divides the limit or request by the divisor rounding up, a missing limit falls back to the allocatable of the node
+func (r *resolver) resourceFieldValue(container *corev1.Container, ref *corev1.ResourceFieldSelector) (string, bool, error) {
+	if ref.ContainerName != "" && ref.ContainerName != container.Name {
+		pod, err := r.currentPod()
+		if err != nil {
+			return "", false, err
+		}
+		if container = findContainer(pod, ref.ContainerName); container == nil {
+			return "", false, fmt.Errorf("container %s not found", ref.ContainerName)
+		}
+	}
+	kind, resourceName, ok := strings.Cut(ref.Resource, ".")
+	if !ok || (kind != "limits" && kind != "requests") {
+		return "", false, fmt.Errorf("unsupported resource %s", ref.Resource)
+	}
+	list := container.Resources.Requests
+	if kind == "limits" {
+		list = container.Resources.Limits
+	}
+	quantity, ok := list[corev1.ResourceName(resourceName)]
+	if !ok && kind == "limits" {
+		node, err := r.currentNode()
+		if err != nil {
+			return "", false, err
+		}
+		quantity, ok = node.Status.Allocatable[corev1.ResourceName(resourceName)]
+	}
+	if !ok {
+		return "0", true, nil
+	}
+	divisor := ref.Divisor
+	if divisor.IsZero() {
+		divisor = resource.MustParse("1")
+	}
+	var value float64
+	if corev1.ResourceName(resourceName) == corev1.ResourceCPU {
+		value = float64(quantity.MilliValue()) / float64(divisor.MilliValue())
+	} else {
+		value = float64(quantity.Value()) / float64(divisor.Value())
+	}
+	return strconv.FormatInt(int64(math.Ceil(value)), 10), true, nil
+}
+
+// configMap returns nil if an optional configmap does not exist
+func (r *resolver) configMap(name string, optional bool) (*corev1.ConfigMap, error) {
+	if cm, ok := r.configMaps[name]; ok {
+		return cm, nil
+	}
+	nsName, err := info.GetCurrentPodNamespaceAndName()
+	if err != nil {
+		return nil, err
+	}
+	cm, err := info.GetConfigmap(context.TODO(), name, nsName.Namespace)
+	if apierrors.IsNotFound(err) && optional {
+		cm, err = nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get configmap %s: %w", name, err)
+	}
+	if r.configMaps == nil {
+		r.configMaps = map[string]*corev1.ConfigMap{}
+	}
+	r.configMaps[name] = cm
+	return cm, nil
+}
+
+// secret returns nil if an optional secret does not exist
+func (r *resolver) secret(name string, optional bool) (*corev1.Secret, error) {
+	if secret, ok := r.secrets[name]; ok {
+		return secret, nil
+	}
+	nsName, err := info.GetCurrentPodNamespaceAndName()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := info.GetSecret(context.TODO(), name, nsName.Namespace)
+	if apierrors.IsNotFound(err) && optional {
+		secret, err = nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret %s: %w", name, err)
+	}
+	if r.secrets == nil {
+		r.secrets = map[string]*corev1.Secret{}
+	}
+	r.secrets[name] = secret
+	return secret, nil
+}
+
+func isOptional(optional *bool) bool {
+	return optional != nil && *optional
+}
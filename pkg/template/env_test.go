@@ -0,0 +1,117 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package template
+
+import (
+	"testing"
+
+	"github.com/magicsong/kidecar/pkg/info"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestExpandPodEnv(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "expand-pod-env")
+	optional := true
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "expand-pod-env", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			NodeName: "node1",
+			Containers: []corev1.Container{
+				{Name: "sidecar", Env: []corev1.EnvVar{{Name: "PORT", Value: "9090"}}},
+				{
+					Name: "game",
+					Env: []corev1.EnvVar{
+						{Name: "PORT", Value: "8080"},
+						{Name: "POD_IP", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.podIP"}}},
+						{Name: "REGION", ValueFrom: &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+							LocalObjectReference: corev1.LocalObjectReference{Name: "game-config"}, Key: "region"}}},
+						{Name: "OPTIONAL", ValueFrom: &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+							LocalObjectReference: corev1.LocalObjectReference{Name: "missing"}, Key: "region", Optional: &optional}}},
+						{Name: "MISSING", ValueFrom: &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+							LocalObjectReference: corev1.LocalObjectReference{Name: "missing"}, Key: "region"}}},
+						{Name: "TOKEN", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+							LocalObjectReference: corev1.LocalObjectReference{Name: "game-secret"}, Key: "token"}}},
+						{Name: "MEMORY", ValueFrom: &corev1.EnvVarSource{ResourceFieldRef: &corev1.ResourceFieldSelector{
+							Resource: "limits.memory", Divisor: resource.MustParse("1Mi")}}},
+						{Name: "CPU", ValueFrom: &corev1.EnvVarSource{ResourceFieldRef: &corev1.ResourceFieldSelector{
+							Resource: "limits.cpu"}}},
+						{Name: "MAX_PLAYERS", Value: "200"},
+					},
+					EnvFrom: []corev1.EnvFromSource{
+						{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "game-config"}}},
+						{Prefix: "SECRET_", SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "game-secret"}}},
+					},
+					Resources: corev1.ResourceRequirements{
+						Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("512Mi")},
+					},
+				},
+			},
+		},
+		Status: corev1.PodStatus{PodIP: "10.0.0.2"},
+	}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "game-config", Namespace: "default"},
+		Data:       map[string]string{"region": "cn", "MAX_PLAYERS": "100", "MODE": "pvp"},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "game-secret", Namespace: "default"},
+		Data:       map[string][]byte{"token": []byte("s3cr3t")},
+	}
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Status:     corev1.NodeStatus{Allocatable: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("3500m")}},
+	}
+	info.SetGlobalKubeInterface(fake.NewSimpleClientset(pod, cm, secret, node))
+
+	tests := []struct {
+		name          string
+		value         string
+		expectedValue string
+		wantErr       bool
+	}{
+		{name: "FirstContainer", value: "${POD:PORT}", expectedValue: "9090"},
+		{name: "NamedContainer", value: "${POD:game/PORT}", expectedValue: "8080"},
+		{name: "ContainerNotFound", value: "${POD:web/PORT}", wantErr: true},
+		{name: "FieldRef", value: "${POD:game/POD_IP}", expectedValue: "10.0.0.2"},
+		{name: "ConfigMapKeyRef", value: "${POD:game/REGION}", expectedValue: "cn"},
+		{name: "OptionalConfigMapKeyRef", value: "${POD:game/OPTIONAL:-none}", expectedValue: "none"},
+		{name: "MissingConfigMapKeyRef", value: "${POD:game/MISSING}", wantErr: true},
+		{name: "SecretKeyRef", value: "${POD:game/TOKEN}", expectedValue: "s3cr3t"},
+		{name: "ResourceFieldRef", value: "${POD:game/MEMORY}", expectedValue: "512"},
+		{name: "ResourceFieldRefOfNode", value: "${POD:game/CPU}", expectedValue: "4"},
+		{name: "EnvOverridesEnvFrom", value: "${POD:game/MAX_PLAYERS}", expectedValue: "200"},
+		{name: "EnvFromConfigMap", value: "${POD:game/MODE}", expectedValue: "pvp"},
+		{name: "EnvFromSecretWithPrefix", value: "${POD:game/SECRET_token}", expectedValue: "s3cr3t"},
+		{name: "EnvFromNotFound", value: "${POD:game/token}", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			value, err := ExpandString(tc.value)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Expected error: %v, but got: %v", tc.wantErr, err)
+			}
+			if value != tc.expectedValue {
+				t.Errorf("Expected value: %s, but got: %s", tc.expectedValue, value)
+			}
+		})
+	}
+}
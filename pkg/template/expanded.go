@@ -0,0 +1,204 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package template
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/magicsong/kidecar/pkg/info"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Expanded keeps a raw config and a copy of it with the expressions expanded,
+// so the config is parsed once at Init instead of on every use, and again when the pod or a used secret changes.
+type Expanded[T any] struct {
+	mu          sync.RWMutex
+	raw         T
+	expanded    T
+	usesSecrets bool
+	// failed is set while the config could not be expanded, the expansion is retried periodically
+	failed bool
+}
+
+// NewExpanded copies the raw config and expands the copy, the raw config is never modified.
+// If the expansion fails, the error is returned along with an Expanded holding the raw config
+// until a refresh succeeds, for example once the GameServer of the pod is created.
+func NewExpanded[T any](raw T) (*Expanded[T], error) {
+	e := &Expanded[T]{raw: deepCopy(raw)}
+	if _, err := e.refresh(&resolver{}); err != nil {
+		e.expanded = deepCopy(e.raw)
+		return e, err
+	}
+	return e, nil
+}
+
+// Get returns a copy of the expanded config, which the caller may modify
+func (e *Expanded[T]) Get() T {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return deepCopy(e.expanded)
+}
+
+// Refresh expands the raw config again and returns whether the result changed
+func (e *Expanded[T]) Refresh() (bool, error) {
+	return e.refresh(&resolver{})
+}
+
+func (e *Expanded[T]) refresh(r *resolver) (bool, error) {
+	expanded := deepCopy(e.raw)
+	err := parseValue(reflect.ValueOf(&expanded), false, r, "")
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failed = err != nil
+	if err != nil {
+		return false, err
+	}
+	changed := !sameConfig(e.expanded, expanded)
+	e.expanded = expanded
+	e.usesSecrets = r.usesSecrets
+	return changed, nil
+}
+
+// RefreshOnPodChange expands the config every time the pod or its GameServer changes until the context is done,
+// a config using secrets or failing to expand is also expanded every secretRefreshInterval to pick up rotated secrets.
+// onChange is called with the expanded config when it changed. A failed expansion keeps the previous config.
+// The changes are only noticed once info.UseCache serves the pod from a running cache.
+func (e *Expanded[T]) RefreshOnPodChange(ctx context.Context, onChange func(config T)) {
+	log := logf.Log.WithName("template")
+	// refreshes are serialized and read the latest objects from the informer cache,
+	// so changes arriving during a refresh are coalesced into one more refresh
+	changes := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+	unsubscribePod := info.OnPodChange(func(*corev1.Pod) { notify() })
+	defer unsubscribePod()
+	unsubscribeGs := info.OnGameServerChange(func(*unstructured.Unstructured) { notify() })
+	defer unsubscribeGs()
+
+	ticker := time.NewTicker(secretRefreshInterval)
+	defer ticker.Stop()
+	for {
+		var r *resolver
+		select {
+		case <-ctx.Done():
+			return
+		case <-changes:
+			r = &resolver{}
+		case <-ticker.C:
+			e.mu.RLock()
+			usesSecrets, failed := e.usesSecrets, e.failed
+			e.mu.RUnlock()
+			if !usesSecrets && !failed {
+				continue
+			}
+			r = &resolver{refreshSecrets: usesSecrets}
+		}
+		changed, err := e.refresh(r)
+		if err != nil {
+			log.Error(err, "Failed to expand config, keep the previous one")
+			continue
+		}
+		if changed && onChange != nil {
+			onChange(e.Get())
+		}
+	}
+}
+
+// sameConfig compares the exported fields only, inner fields are filled lazily by the users of the config
+func sameConfig(a, b interface{}) bool {
+	aBytes, aErr := json.Marshal(a)
+	bBytes, bErr := json.Marshal(b)
+	if aErr != nil || bErr != nil {
+		return reflect.DeepEqual(a, b)
+	}
+	return string(aBytes) == string(bBytes)
+}
+
+// deepCopy copies the exported fields recursively, unexported fields are copied shallowly
+func deepCopy[T any](v T) T {
+	src := reflect.ValueOf(&v).Elem()
+	dst := reflect.New(src.Type()).Elem()
+	copyValue(dst, src)
+	return dst.Interface().(T)
+}
+
+func copyValue(dst, src reflect.Value) {
+	copyValueWith(dst, src, nil)
+}
+
+// copyValueWith copies src to dst, the strings reached through exported fields, slices, maps and pointers
+// are passed through transform if it is set
+func copyValueWith(dst, src reflect.Value, transform func(string) string) {
+	switch src.Kind() {
+	case reflect.Ptr:
+		if src.IsNil() {
+			return
+		}
+		dst.Set(reflect.New(src.Elem().Type()))
+		copyValueWith(dst.Elem(), src.Elem(), transform)
+	case reflect.Interface:
+		if src.IsNil() {
+			return
+		}
+		elem := reflect.New(src.Elem().Type()).Elem()
+		copyValueWith(elem, src.Elem(), transform)
+		dst.Set(elem)
+	case reflect.Struct:
+		dst.Set(src)
+		for i := 0; i < src.NumField(); i++ {
+			if src.Type().Field(i).IsExported() {
+				copyValueWith(dst.Field(i), src.Field(i), transform)
+			}
+		}
+	case reflect.Slice:
+		if src.IsNil() {
+			return
+		}
+		dst.Set(reflect.MakeSlice(src.Type(), src.Len(), src.Len()))
+		for i := 0; i < src.Len(); i++ {
+			copyValueWith(dst.Index(i), src.Index(i), transform)
+		}
+	case reflect.Map:
+		if src.IsNil() {
+			return
+		}
+		dst.Set(reflect.MakeMapWithSize(src.Type(), src.Len()))
+		iter := src.MapRange()
+		for iter.Next() {
+			elem := reflect.New(iter.Value().Type()).Elem()
+			copyValueWith(elem, iter.Value(), transform)
+			dst.SetMapIndex(iter.Key(), elem)
+		}
+	case reflect.String:
+		dst.Set(src)
+		if transform != nil {
+			dst.SetString(transform(src.String()))
+		}
+	default:
+		dst.Set(src)
+	}
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package template
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/magicsong/kidecar/pkg/info"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/controller-runtime/pkg/cache/informertest"
+)
+
+func TestExpanded(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "expanded")
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "expanded", Namespace: "default", Labels: map[string]string{"version": "v1"}},
+	}
+	gs := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "game.kruise.io/v1alpha1",
+		"kind":       "GameServer",
+		"metadata":   map[string]interface{}{"name": "expanded", "namespace": "default"},
+		"spec":       map[string]interface{}{"opsState": "None"},
+	}}
+	client := fake.NewSimpleClientset(pod)
+	client.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		review.Status.Allowed = true
+		return true, review, nil
+	})
+	info.SetGlobalKubeInterface(client)
+	info.SetGlobalDynamicInterface(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), gs))
+	informers := &informertest.FakeInformers{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := info.UseCache(ctx, informers); err != nil {
+		t.Fatalf("Failed to use cache: %v", err)
+	}
+	podInformer, err := informers.FakeInformerFor(ctx, &corev1.Pod{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gsInformer, err := informers.FakeInformerFor(ctx, gs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	podInformer.Add(pod.DeepCopy())
+	podInformer.Synced = true
+	gsInformer.Add(gs.DeepCopy())
+
+	raw := nestedConfig{
+		URL:     "http://game/${LABEL:version}",
+		Headers: map[string]string{"X-Version": "${LABEL:version}", "X-OpsState": "${GS:spec.opsState}"},
+	}
+	expanded, err := NewExpanded(raw)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if got := expanded.Get(); got.URL != "http://game/v1" || got.Headers["X-Version"] != "v1" {
+		t.Errorf("Unexpected expanded config: %+v", got)
+	}
+	if raw.Headers["X-Version"] != "${LABEL:version}" {
+		t.Errorf("Raw config was modified: %+v", raw)
+	}
+	expanded.Get().Headers["X-Version"] = "modified"
+	if got := expanded.Get(); got.Headers["X-Version"] != "v1" {
+		t.Errorf("Expanded config was modified through a copy: %+v", got)
+	}
+
+	changes := make(chan nestedConfig, 1)
+	go expanded.RefreshOnPodChange(ctx, func(config nestedConfig) { changes <- config })
+	// wait for the subscription
+	time.Sleep(100 * time.Millisecond)
+
+	updated := pod.DeepCopy()
+	updated.Labels["version"] = "v2"
+	podInformer.Update(pod, updated)
+	select {
+	case config := <-changes:
+		if config.URL != "http://game/v2" {
+			t.Errorf("Expected refreshed url, but got: %s", config.URL)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Config was not refreshed")
+	}
+
+	maintaining := gs.DeepCopy()
+	if err := unstructured.SetNestedField(maintaining.Object, "Maintaining", "spec", "opsState"); err != nil {
+		t.Fatal(err)
+	}
+	gsInformer.Update(gs, maintaining)
+	select {
+	case config := <-changes:
+		if config.Headers["X-OpsState"] != "Maintaining" {
+			t.Errorf("Expected refreshed ops state, but got: %s", config.Headers["X-OpsState"])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Config was not refreshed")
+	}
+
+	// an update not affecting the config does not notify
+	annotated := updated.DeepCopy()
+	annotated.Annotations = map[string]string{"other": "value"}
+	podInformer.Update(updated, annotated)
+	select {
+	case config := <-changes:
+		t.Errorf("Unexpected change: %+v", config)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestExpanded_RetriesFailedExpansion(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "not-created")
+	interval := secretRefreshInterval
+	secretRefreshInterval = 100 * time.Millisecond
+	defer func() { secretRefreshInterval = interval }()
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "not-created", Namespace: "default"}}
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	info.SetGlobalKubeInterface(fake.NewSimpleClientset(pod))
+	info.SetGlobalDynamicInterface(dynamicClient)
+
+	// the GameServer of the pod is not created yet
+	raw := nestedConfig{URL: "http://game/${GS:spec.opsState}"}
+	expanded, err := NewExpanded(raw)
+	if err == nil {
+		t.Fatal("Expected an error, but got none")
+	}
+	if got := expanded.Get(); got.URL != raw.URL {
+		t.Errorf("Expected the raw config, but got: %+v", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan nestedConfig, 1)
+	go expanded.RefreshOnPodChange(ctx, func(config nestedConfig) { changes <- config })
+	gs := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "game.kruise.io/v1alpha1",
+		"kind":       "GameServer",
+		"metadata":   map[string]interface{}{"name": "not-created", "namespace": "default"},
+		"spec":       map[string]interface{}{"opsState": "None"},
+	}}
+	if _, err := dynamicClient.Resource(schema.GroupVersionResource{Group: "game.kruise.io", Version: "v1alpha1", Resource: "gameservers"}).
+		Namespace("default").Create(ctx, gs, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create gameserver: %v", err)
+	}
+	select {
+	case config := <-changes:
+		if config.URL != "http://game/None" {
+			t.Errorf("Expected expanded url, but got: %s", config.URL)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Failed expansion was not retried")
+	}
+}
@@ -19,62 +19,91 @@ package template
 import (
 	"fmt"
 	"reflect"
-
-	"github.com/magicsong/kidecar/pkg/info"
-	corev1 "k8s.io/api/core/v1"
 )
 
-func expressionReplaceValue(value string, pod *corev1.Pod) (string, error) {
-	// Add your own template parsing logic here
-	return ReplaceValue(value, &pod.Spec.Containers[0])
+func expressionReplaceValue(value string) (string, error) {
+	// the pod is only fetched when needed, so that SELF expressions work without a cluster
+	return expand(value, &resolver{})
 }
 
-// ParseConfig Parse the fields in the configuration structure recursively
-func ParseConfig(config interface{}) error {
-	pod, err := info.GetCurrentPod()
-	if err != nil {
-		return fmt.Errorf("failed to get current pod: %w", err)
-	}
-	v := reflect.ValueOf(config)
-	if v.Kind() == reflect.Ptr {
-		v = v.Elem()
-	}
-	if !v.IsValid() {
-		return nil
-	}
+// ExpandString replaces all expressions in a single value
+func ExpandString(value string) (string, error) {
+	return expressionReplaceValue(value)
+}
 
-	t := v.Type()
-	for i := 0; i < v.NumField(); i++ {
-		field := v.Field(i)
-		fieldType := t.Field(i)
+// ParseConfig expands the expressions in the fields tagged with `parse:"true"` recursively.
+// A tagged struct, pointer, map, slice or interface has all the strings inside it expanded.
+func ParseConfig(config interface{}) error {
+	return parseValue(reflect.ValueOf(config), false, &resolver{}, "")
+}
 
-		if !field.CanInterface() {
-			continue
+func parseValue(v reflect.Value, all bool, r *resolver, path string) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
 		}
-
-		// Check if there is a `parse:"true"` tag
-		if tagValue, ok := fieldType.Tag.Lookup("parse"); ok && tagValue == "true" {
-			// Parse the field value
-			if field.Kind() == reflect.String {
-				parsedValue, err := expressionReplaceValue(field.String(), pod)
-				if err != nil {
-					return fmt.Errorf("failed to parse field %s: %w", fieldType.Name, err)
-				}
-				field.SetString(parsedValue)
+		return parseValue(v.Elem(), all, r, path)
+	case reflect.Interface:
+		if !all || v.IsNil() || !v.CanSet() {
+			return nil
+		}
+		// the value in an interface is not addressable, expand a copy and put it back
+		elem := reflect.New(v.Elem().Type()).Elem()
+		elem.Set(v.Elem())
+		if err := parseValue(elem, all, r, path); err != nil {
+			return err
+		}
+		v.Set(elem)
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			fieldType := t.Field(i)
+			if !fieldType.IsExported() {
+				continue
+			}
+			// Check if there is a `parse:"true"` tag
+			tagged := all || fieldType.Tag.Get("parse") == "true"
+			if err := parseValue(v.Field(i), tagged, r, joinPath(path, fieldType.Name)); err != nil {
+				return err
 			}
 		}
-
-		// If it is a structure or a pointer to a structure, handle it recursively
-		if field.Kind() == reflect.Struct {
-			if err := ParseConfig(field.Addr().Interface()); err != nil {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := parseValue(v.Index(i), all, r, fmt.Sprintf("%s[%d]", path, i)); err != nil {
 				return err
 			}
-		} else if field.Kind() == reflect.Ptr && field.Elem().Kind() == reflect.Struct {
-			if err := ParseConfig(field.Interface()); err != nil {
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			// map values are not addressable either
+			elem := reflect.New(iter.Value().Type()).Elem()
+			elem.Set(iter.Value())
+			if err := parseValue(elem, all, r, fmt.Sprintf("%s[%v]", path, iter.Key())); err != nil {
 				return err
 			}
+			v.SetMapIndex(iter.Key(), elem)
+		}
+	case reflect.String:
+		if !all || !v.CanSet() {
+			return nil
 		}
+		parsedValue, err := expand(v.String(), r)
+		if err != nil {
+			return fmt.Errorf("failed to parse field %s: %w", path, err)
+		}
+		v.SetString(parsedValue)
 	}
-
 	return nil
 }
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -91,3 +91,40 @@ func TestParseConfig(t *testing.T) {
 		})
 	}
 }
+
+type nestedConfig struct {
+	URL      string            `parse:"true"`
+	Headers  map[string]string `parse:"true"`
+	Policies []nestedPolicy
+	Raw      string
+	Extra    interface{} `parse:"true"`
+}
+
+type nestedPolicy struct {
+	Annotations map[string]string `parse:"true"`
+	State       string
+}
+
+func TestParseConfigRecursive(t *testing.T) {
+	t.Setenv("ENV_VAR", "value")
+	config := &nestedConfig{
+		URL:      "http://${SELF:ENV_VAR}:8080",
+		Headers:  map[string]string{"X-Env": "${SELF:ENV_VAR}"},
+		Policies: []nestedPolicy{{Annotations: map[string]string{"a": "${SELF:ENV_VAR}"}, State: "${SELF:ENV_VAR}"}},
+		Raw:      "${SELF:ENV_VAR}",
+		Extra:    map[string]interface{}{"list": []interface{}{"${SELF:ENV_VAR}"}},
+	}
+	if err := ParseConfig(config); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	expected := &nestedConfig{
+		URL:      "http://value:8080",
+		Headers:  map[string]string{"X-Env": "value"},
+		Policies: []nestedPolicy{{Annotations: map[string]string{"a": "value"}, State: "${SELF:ENV_VAR}"}},
+		Raw:      "${SELF:ENV_VAR}",
+		Extra:    map[string]interface{}{"list": []interface{}{"value"}},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("Expected: %+v, but got: %+v", expected, config)
+	}
+}
@@ -17,51 +17,307 @@ limitations under the License.
 package template
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
-	"regexp"
+	"strconv"
+	"strings"
 
+	"github.com/magicsong/kidecar/pkg/info"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 // Expression format:
 // ${SELF:VAR_NAME}: Indicates the environment variable of the sidecar itself.
-// ${POD:VAR_NAME}: Indicates the environment variable of the Pod.
+// ${POD:VAR_NAME}: Indicates the environment variable of the first container of the Pod, valueFrom and envFrom are resolved.
+// ${POD:CONTAINER/VAR_NAME}: Indicates the environment variable of the named container of the Pod.
+// ${LABEL:KEY}: Indicates a label of the Pod, read from the downward API volume if mounted.
+// ${ANNOTATION:KEY}: Indicates an annotation of the Pod, read from the downward API volume if mounted.
+// ${FIELD:PATH}: Indicates a field of the Pod, like status.podIP or metadata.labels['app'].
+// ${NODE:KEY}: Indicates a label of the node the Pod runs on.
+// ${GS:PATH}: Indicates a field of the GameServer of the Pod, like spec.opsState.
+// ${SECRET:NAME/KEY}: Indicates a key of a Secret in the namespace of the Pod, ${SECRET:/PATH} reads a mounted file.
+//
+// ${SOURCE:KEY:-fallback} uses fallback when the value is not found or empty,
+// $${ is a literal ${. Expressions of unknown sources are left untouched.
 
 const (
-	pattern = `\$\{(SELF|POD):([^}]+)\}`
+	SourceSelf       = "SELF"
+	SourcePod        = "POD"
+	SourceLabel      = "LABEL"
+	SourceAnnotation = "ANNOTATION"
+	SourceField      = "FIELD"
+	SourceNode       = "NODE"
+	SourceGameServer = "GS"
+
+	defaultSeparator = ":-"
 )
 
+// resolver looks up the sources of one expansion, the objects are fetched at most once and only when needed
+type resolver struct {
+	container *corev1.Container
+	pod       *corev1.Pod
+	node      *corev1.Node
+	gs        *unstructured.Unstructured
+	// configMaps and secrets referenced by env vars, nil if optional and missing
+	configMaps map[string]*corev1.ConfigMap
+	secrets    map[string]*corev1.Secret
+	// usesSecrets is set when a secret was resolved, refreshSecrets bypasses the secret cache
+	usesSecrets    bool
+	refreshSecrets bool
+}
+
+// ReplaceValue replaces all expressions in value, ${POD:X} is looked up in the env of container
 func ReplaceValue(value string, container *corev1.Container) (string, error) {
-	re := regexp.MustCompile(pattern)
-	matches := re.FindStringSubmatch(value)
-	if matches == nil {
-		return value, nil
-	}
-
-	envType := matches[1]
-	envName := matches[2]
-
-	var envValue string
-	var found bool
-	if envType == "SELF" {
-		envValue, found = os.LookupEnv(envName)
-	} else if envType == "POD" {
-		// Search from the environment variables of the container
-		for _, envVar := range container.Env {
-			if envVar.Name == envName {
-				envValue = envVar.Value
-				found = true
-				break
-			}
+	return expand(value, &resolver{container: container})
+}
+
+func expand(value string, r *resolver) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(value); {
+		rest := value[i:]
+		if strings.HasPrefix(rest, "$${") {
+			b.WriteString("${")
+			i += 3
+			continue
+		}
+		if !strings.HasPrefix(rest, "${") {
+			b.WriteByte(value[i])
+			i++
+			continue
+		}
+		end := strings.IndexByte(rest, '}')
+		if end < 0 {
+			b.WriteString(rest)
+			break
 		}
-	} else {
-		return "", fmt.Errorf("unknown environment variable type: %s", envType)
+		replaced, ok, err := r.resolve(rest[2:end])
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			b.WriteString(replaced)
+		} else {
+			b.WriteString(rest[:end+1])
+		}
+		i += end + 1
+	}
+	return b.String(), nil
+}
+
+// resolve returns false if the source of the expression is unknown
+func (r *resolver) resolve(expression string) (string, bool, error) {
+	source, key, found := strings.Cut(expression, ":")
+	if !found {
+		return "", false, nil
+	}
+	fallback, hasFallback := "", false
+	if idx := strings.Index(key, defaultSeparator); idx >= 0 {
+		key, fallback, hasFallback = key[:idx], key[idx+len(defaultSeparator):], true
 	}
 
+	var value string
+	var err error
+	switch source {
+	case SourceSelf:
+		value, found = os.LookupEnv(key)
+	case SourcePod:
+		value, found, err = r.podEnv(key)
+	case SourceLabel:
+		value, found, err = podMeta(key, info.GetCurrentPodLabels)
+	case SourceAnnotation:
+		value, found, err = podMeta(key, info.GetCurrentPodAnnotations)
+	case SourceField:
+		value, found, err = r.podField(key)
+	case SourceNode:
+		value, found, err = r.nodeLabel(key)
+	case SourceGameServer:
+		value, found, err = r.gameServerField(key)
+	case SourceSecret:
+		value, found, err = r.secretSource(key)
+	default:
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if found && value != "" {
+		return value, true, nil
+	}
+	if hasFallback {
+		return fallback, true, nil
+	}
 	if !found {
-		return "", fmt.Errorf("environment variable %s not found", envName)
+		return "", false, notFoundError(source, key)
+	}
+	return value, true, nil
+}
+
+func notFoundError(source, key string) error {
+	switch source {
+	case SourceSelf, SourcePod:
+		return fmt.Errorf("environment variable %s not found", key)
+	case SourceNode:
+		return fmt.Errorf("node label %s not found", key)
+	case SourceGameServer:
+		return fmt.Errorf("gameserver field %s not found", key)
+	case SourceSecret:
+		return fmt.Errorf("secret %s not found", key)
+	default:
+		return fmt.Errorf("%s %s not found", strings.ToLower(source), key)
+	}
+}
+
+func (r *resolver) currentPod() (*corev1.Pod, error) {
+	if r.pod != nil {
+		return r.pod, nil
+	}
+	pod, err := info.GetCurrentPod()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current pod: %w", err)
+	}
+	r.pod = pod
+	return pod, nil
+}
+
+// podMeta reads labels and annotations from the downward API volume if mounted, so they do not need to get the pod
+func podMeta(key string, get func() (map[string]string, error)) (string, bool, error) {
+	meta, err := get()
+	if err != nil {
+		return "", false, err
 	}
+	value, ok := meta[key]
+	return value, ok, nil
+}
 
-	return envValue, nil
+func (r *resolver) podField(path string) (string, bool, error) {
+	pod, err := r.currentPod()
+	if err != nil {
+		return "", false, err
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pod)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to convert pod: %w", err)
+	}
+	return lookupField(obj, path)
+}
+
+func (r *resolver) currentNode() (*corev1.Node, error) {
+	if r.node != nil {
+		return r.node, nil
+	}
+	pod, err := r.currentPod()
+	if err != nil {
+		return nil, err
+	}
+	if pod.Spec.NodeName == "" {
+		return nil, fmt.Errorf("pod %s is not scheduled", pod.Name)
+	}
+	node, err := info.GetNode(context.TODO(), pod.Spec.NodeName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get node %s: %w", pod.Spec.NodeName, err)
+	}
+	r.node = node
+	return node, nil
+}
+
+func (r *resolver) nodeLabel(key string) (string, bool, error) {
+	node, err := r.currentNode()
+	if err != nil {
+		return "", false, err
+	}
+	value, ok := node.Labels[key]
+	return value, ok, nil
+}
+
+func (r *resolver) gameServerField(path string) (string, bool, error) {
+	if r.gs == nil {
+		gs, err := info.GetCurrentGameServer(context.TODO())
+		if err != nil {
+			return "", false, fmt.Errorf("failed to get gameserver: %w", err)
+		}
+		r.gs = gs
+	}
+	return lookupField(r.gs.Object, path)
+}
+
+// lookupField walks a path like status.conditions[0].type or metadata.labels['app.kubernetes.io/name'],
+// values that are not strings are formatted as json
+func lookupField(obj map[string]interface{}, path string) (string, bool, error) {
+	segments, err := splitFieldPath(path)
+	if err != nil {
+		return "", false, err
+	}
+	var current interface{} = obj
+	for _, segment := range segments {
+		switch v := current.(type) {
+		case map[string]interface{}:
+			next, ok := v[segment]
+			if !ok {
+				return "", false, nil
+			}
+			current = next
+		case []interface{}:
+			idx, err := strconv.Atoi(segment)
+			if err != nil || idx < 0 || idx >= len(v) {
+				return "", false, nil
+			}
+			current = v[idx]
+		default:
+			return "", false, nil
+		}
+	}
+	switch v := current.(type) {
+	case nil:
+		return "", false, nil
+	case string:
+		return v, true, nil
+	case map[string]interface{}, []interface{}:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to marshal field %s: %w", path, err)
+		}
+		return string(data), true, nil
+	default:
+		return fmt.Sprint(v), true, nil
+	}
+}
+
+// splitFieldPath splits a path by dots, keys in brackets may contain dots
+func splitFieldPath(path string) ([]string, error) {
+	var segments []string
+	var current strings.Builder
+	for i := 0; i < len(path); i++ {
+		switch path[i] {
+		case '.':
+			if current.Len() > 0 {
+				segments = append(segments, current.String())
+				current.Reset()
+			}
+		case '[':
+			if current.Len() > 0 {
+				segments = append(segments, current.String())
+				current.Reset()
+			}
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid field path %s", path)
+			}
+			key := strings.Trim(path[i+1:i+end], `'"`)
+			segments = append(segments, key)
+			i += end
+		default:
+			current.WriteByte(path[i])
+		}
+	}
+	if current.Len() > 0 {
+		segments = append(segments, current.String())
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("invalid field path %s", path)
+	}
+	return segments, nil
 }
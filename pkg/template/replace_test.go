@@ -18,9 +18,16 @@ package template
 
 import (
 	"fmt"
-	corev1 "k8s.io/api/core/v1"
 	"os"
 	"testing"
+
+	"github.com/magicsong/kidecar/pkg/info"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 func TestReplaceValue(t *testing.T) {
@@ -111,3 +118,69 @@ func TestReplaceValue(t *testing.T) {
 		})
 	}
 }
+
+func TestExpandSources(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "expand-sources")
+	t.Setenv("POD_IP", "10.0.0.1")
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "expand-sources",
+			Namespace:   "default",
+			Labels:      map[string]string{"app.kubernetes.io/name": "game"},
+			Annotations: map[string]string{"region": "cn"},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node1",
+			Containers: []corev1.Container{
+				{Name: "game", Env: []corev1.EnvVar{{Name: "PORT", Value: "8080"}, {Name: "EMPTY"}}},
+			},
+		},
+		Status: corev1.PodStatus{PodIP: "10.0.0.2"},
+	}
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{"zone": "a"}}}
+	gs := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "game.kruise.io/v1alpha1",
+		"kind":       "GameServer",
+		"metadata":   map[string]interface{}{"name": "expand-sources", "namespace": "default"},
+		"spec":       map[string]interface{}{"opsState": "None", "updatePriority": int64(3)},
+	}}
+	info.SetGlobalKubeInterface(fake.NewSimpleClientset(pod, node))
+	info.SetGlobalDynamicInterface(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), gs))
+
+	tests := []struct {
+		name          string
+		value         string
+		expectedValue string
+		wantErr       bool
+	}{
+		{name: "AllOccurrences", value: "http://${SELF:POD_IP}:${POD:PORT}/x", expectedValue: "http://10.0.0.1:8080/x"},
+		{name: "Fallback", value: "${SELF:NOT_FOUND_VAR:-def}", expectedValue: "def"},
+		{name: "FallbackOfEmpty", value: "${POD:EMPTY:-def}", expectedValue: "def"},
+		{name: "FallbackNotUsed", value: "${POD:PORT:-80}", expectedValue: "8080"},
+		{name: "Escaped", value: "$${SELF:POD_IP} ${SELF:POD_IP}", expectedValue: "${SELF:POD_IP} 10.0.0.1"},
+		{name: "Unterminated", value: "${SELF:POD_IP", expectedValue: "${SELF:POD_IP"},
+		{name: "Label", value: "${LABEL:app.kubernetes.io/name}", expectedValue: "game"},
+		{name: "Annotation", value: "${ANNOTATION:region}", expectedValue: "cn"},
+		{name: "AnnotationNotFound", value: "${ANNOTATION:zone}", wantErr: true},
+		{name: "Field", value: "${FIELD:status.podIP}", expectedValue: "10.0.0.2"},
+		{name: "FieldInBrackets", value: "${FIELD:metadata.labels['app.kubernetes.io/name']}", expectedValue: "game"},
+		{name: "FieldIndex", value: "${FIELD:spec.containers[0].name}", expectedValue: "game"},
+		{name: "Node", value: "${NODE:zone}", expectedValue: "a"},
+		{name: "NodeNotFound", value: "${NODE:region:-none}", expectedValue: "none"},
+		{name: "GameServer", value: "${GS:spec.opsState}/${GS:spec.updatePriority}", expectedValue: "None/3"},
+		{name: "GameServerNotFound", value: "${GS:status.networkStatus}", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			value, err := ExpandString(tc.value)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Expected error: %v, but got: %v", tc.wantErr, err)
+			}
+			if value != tc.expectedValue {
+				t.Errorf("Expected value: %s, but got: %s", tc.expectedValue, value)
+			}
+		})
+	}
+}
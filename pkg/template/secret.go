@@ -0,0 +1,212 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package template
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/magicsong/kidecar/pkg/info"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// SourceSecret is ${SECRET:name/key} of a Secret in the namespace of the pod, or ${SECRET:/path} of a mounted file
+const SourceSecret = "SECRET"
+
+const redactedValue = "******"
+
+// minEmbeddedRedactedLength is the length of the shortest secret value redacted inside other words,
+// shorter values like PINs are only redacted as whole tokens so the rest of a log line stays readable
+const minEmbeddedRedactedLength = 6
+
+// secretRefreshInterval is how long a secret is cached, rotated secrets are picked up after it
+var secretRefreshInterval = time.Minute
+
+type secretEntry struct {
+	value   string
+	found   bool
+	expires time.Time
+}
+
+// secretCache is shared by all expansions, so a secret used by several plugins is read once per interval
+type secretCache struct {
+	mu      sync.Mutex
+	entries map[string]secretEntry
+}
+
+var globalSecretCache = &secretCache{entries: map[string]secretEntry{}}
+
+// redactedSecrets holds every resolved secret value, they are replaced in Redact.
+// The value reports whether the secret is only replaced as a whole token.
+var redactedSecrets sync.Map
+
+func (c *secretCache) get(key string, refresh bool) (string, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[key]; ok && !refresh && time.Now().Before(entry.expires) {
+		return entry.value, entry.found, nil
+	}
+	value, found, err := loadSecret(key)
+	if err != nil {
+		return "", false, err
+	}
+	c.entries[key] = secretEntry{value: value, found: found, expires: time.Now().Add(secretRefreshInterval)}
+	return value, found, nil
+}
+
+func loadSecret(key string) (string, bool, error) {
+	if strings.HasPrefix(key, "/") {
+		data, err := os.ReadFile(key)
+		if os.IsNotExist(err) {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, fmt.Errorf("failed to read secret file %s: %w", key, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), true, nil
+	}
+	name, dataKey, ok := strings.Cut(key, "/")
+	if !ok {
+		return "", false, fmt.Errorf("invalid secret %s, expected name/key or an absolute path", key)
+	}
+	nsName, err := info.GetCurrentPodNamespaceAndName()
+	if err != nil {
+		return "", false, err
+	}
+	secret, err := info.GetSecret(context.TODO(), name, nsName.Namespace)
+	if apierrors.IsNotFound(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to get secret %s: %w", name, err)
+	}
+	value, ok := secret.Data[dataKey]
+	return string(value), ok, nil
+}
+
+func (r *resolver) secretSource(key string) (string, bool, error) {
+	r.usesSecrets = true
+	value, found, err := globalSecretCache.get(key, r.refreshSecrets)
+	if err != nil {
+		return "", false, err
+	}
+	addRedaction(value)
+	return value, found, nil
+}
+
+// addRedaction records the secret value and the forms it takes when quoted in an error or escaped in a url
+func addRedaction(value string) {
+	if value == "" {
+		return
+	}
+	wholeToken := len(value) < minEmbeddedRedactedLength
+	quoted := strconv.Quote(value)
+	for _, form := range []string{value, quoted[1 : len(quoted)-1], url.QueryEscape(value), url.PathEscape(value)} {
+		redactedSecrets.Store(form, wholeToken)
+	}
+}
+
+// Redact replaces the secret values resolved so far in s, a secret containing another one is replaced first
+func Redact(s string) string {
+	var secrets []string
+	wholeTokens := map[string]bool{}
+	redactedSecrets.Range(func(key, value interface{}) bool {
+		secrets = append(secrets, key.(string))
+		wholeTokens[key.(string)] = value.(bool)
+		return true
+	})
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+	for _, secret := range secrets {
+		if wholeTokens[secret] {
+			s = replaceToken(s, secret)
+		} else {
+			s = strings.ReplaceAll(s, secret, redactedValue)
+		}
+	}
+	return s
+}
+
+// replaceToken replaces the occurrences of token which are not part of a longer word
+func replaceToken(s, token string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, token)
+		if i < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		end := i + len(token)
+		before, _ := utf8.DecodeLastRuneInString(s[:i])
+		after, _ := utf8.DecodeRuneInString(s[end:])
+		b.WriteString(s[:i])
+		if isWordRune(before) || isWordRune(after) {
+			b.WriteString(token)
+		} else {
+			b.WriteString(redactedValue)
+		}
+		s = s[end:]
+	}
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// Redacted formats a config as json with the secret values replaced, for logging.
+// The strings are redacted before they are escaped by the json encoding.
+func Redacted(v interface{}) string {
+	src := reflect.ValueOf(&v).Elem()
+	dst := reflect.New(src.Type()).Elem()
+	copyValueWith(dst, src, Redact)
+	data, err := json.Marshal(dst.Interface())
+	if err != nil {
+		return Redact(fmt.Sprintf("%+v", v))
+	}
+	return string(data)
+}
+
+// redactedError redacts the message of an error, which may contain an expanded url
+type redactedError struct {
+	err error
+}
+
+func (e *redactedError) Error() string {
+	return Redact(e.err.Error())
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// RedactError returns the error with the secret values replaced in its message, for logging
+func RedactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &redactedError{err: err}
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2024  .
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package template
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/magicsong/kidecar/pkg/info"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestExpandSecret(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "expand-secret")
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "probe-token", Namespace: "default"},
+		Data:       map[string][]byte{"token": []byte("t0ken-v1")},
+	}
+	info.SetGlobalKubeInterface(fake.NewSimpleClientset(secret))
+	path := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(path, []byte("p4ssw0rd\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		value         string
+		expectedValue string
+		wantErr       bool
+	}{
+		{name: "KubeSecret", value: "Bearer ${SECRET:probe-token/token}", expectedValue: "Bearer t0ken-v1"},
+		{name: "MountedFile", value: "${SECRET:" + path + "}", expectedValue: "p4ssw0rd"},
+		{name: "MissingKey", value: "${SECRET:probe-token/other:-none}", expectedValue: "none"},
+		{name: "MissingSecret", value: "${SECRET:other/token}", wantErr: true},
+		{name: "InvalidKey", value: "${SECRET:probe-token}", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			value, err := ExpandString(tc.value)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Expected error: %v, but got: %v", tc.wantErr, err)
+			}
+			if value != tc.expectedValue {
+				t.Errorf("Expected value: %s, but got: %s", tc.expectedValue, value)
+			}
+		})
+	}
+
+	redacted := Redacted(map[string]string{"Authorization": "Bearer t0ken-v1", "password": "p4ssw0rd"})
+	if strings.Contains(redacted, "t0ken-v1") || strings.Contains(redacted, "p4ssw0rd") {
+		t.Errorf("Secret values are not redacted: %s", redacted)
+	}
+	if !strings.Contains(redacted, "Bearer "+redactedValue) {
+		t.Errorf("Expected redacted value, but got: %s", redacted)
+	}
+}
+
+func TestExpandedSecretRotation(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_NAME", "secret-rotation")
+	interval := secretRefreshInterval
+	secretRefreshInterval = 100 * time.Millisecond
+	defer func() { secretRefreshInterval = interval }()
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "secret-rotation", Namespace: "default"}}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "rotated", Namespace: "default"},
+		Data:       map[string][]byte{"token": []byte("old-token")},
+	}
+	client := fake.NewSimpleClientset(pod, secret)
+	info.SetGlobalKubeInterface(client)
+
+	expanded, err := NewExpanded(nestedConfig{Headers: map[string]string{"Authorization": "${SECRET:rotated/token}"}})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan nestedConfig, 1)
+	go expanded.RefreshOnPodChange(ctx, func(config nestedConfig) { changes <- config })
+
+	secret.Data["token"] = []byte("new-token")
+	if _, err := client.CoreV1().Secrets("default").Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update secret: %v", err)
+	}
+	select {
+	case config := <-changes:
+		if config.Headers["Authorization"] != "new-token" {
+			t.Errorf("Expected rotated token, but got: %s", config.Headers["Authorization"])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Config was not refreshed")
+	}
+	if Redact("new-token") != redactedValue {
+		t.Errorf("Rotated token is not redacted")
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	addRedaction(`p&ss"<w>\rd`)
+	addRedaction("1234")
+	config := &nestedConfig{
+		URL:     `http://user:p&ss"<w>\rd@game/v1234?pin=1234`,
+		Headers: map[string]string{"Authorization": `Basic p&ss"<w>\rd`},
+	}
+
+	tests := []struct {
+		name     string
+		redacted string
+	}{
+		{name: "Config", redacted: Redacted(config)},
+		{name: "Error", redacted: RedactError(fmt.Errorf("request failed: Get %q: connection refused", config.URL)).Error()},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// neither the secret nor its escaped forms may appear
+			for _, leaked := range []string{`p&ss`, `p\u0026ss`, `<w>`, `\u003cw\u003e`, `=1234`} {
+				if strings.Contains(tc.redacted, leaked) {
+					t.Errorf("Secret value leaked as %s: %s", leaked, tc.redacted)
+				}
+			}
+			// a value shorter than minEmbeddedRedactedLength is only redacted as a whole token
+			if !strings.Contains(tc.redacted, "game/v1234") {
+				t.Errorf("Expected a short value inside a word to be kept, but got: %s", tc.redacted)
+			}
+		})
+	}
+	if !errors.Is(RedactError(context.Canceled), context.Canceled) {
+		t.Errorf("Expected the redacted error to wrap the error")
+	}
+	if config.URL != `http://user:p&ss"<w>\rd@game/v1234?pin=1234` {
+		t.Errorf("Config was modified: %+v", config)
+	}
+}
+
+func TestReplaceToken(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want string
+	}{
+		{name: "Whole", s: "1234", want: redactedValue},
+		{name: "Separated", s: "pin=1234&id=1234", want: "pin=" + redactedValue + "&id=" + redactedValue},
+		{name: "InsideWord", s: "v1234 12345 1234_a", want: "v1234 12345 1234_a"},
+		{name: "Mixed", s: "a1234 1234", want: "a1234 " + redactedValue},
+		{name: "Unicode", s: "密码1234 密码:1234", want: "密码1234 密码:" + redactedValue},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := replaceToken(tc.s, "1234"); got != tc.want {
+				t.Errorf("replaceToken() = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}